@@ -0,0 +1,621 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gengo/goship/handlers/commits"
+	"github.com/gengo/goship/handlers/lock"
+	"github.com/gengo/goship/lib/auth"
+	"github.com/gengo/goship/lib/config"
+	"github.com/gengo/goship/lib/freeze"
+	"github.com/gengo/goship/lib/history"
+	"github.com/gengo/goship/lib/revision"
+	"github.com/gengo/goship/lib/token"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+const (
+	// apiPrefix is the path prefix of the JSON REST API.
+	apiPrefix = "/api/v1/"
+	// defaultHistoryLimit is the default number of deployments in responses of deploy history.
+	defaultHistoryLimit = 20
+)
+
+// APIHandler serves the JSON REST API.
+// i.e. http://127.0.0.1:8000/api/v1/projects
+//
+// Responses are JSON. Errors are responded as apiError with a proper status code.
+type APIHandler struct {
+	dh DeployHandler
+}
+
+// apiError is the response body of the API on errors.
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// apiProject is a project in responses of the API.
+type apiProject struct {
+	Name         string           `json:"name"`
+	RepoOwner    string           `json:"repo_owner"`
+	RepoName     string           `json:"repo_name"`
+	Pipeline     []string         `json:"pipeline,omitempty"`
+	Environments []apiEnvironment `json:"environments"`
+}
+
+// apiEnvironment is an environment in responses of the API.
+type apiEnvironment struct {
+	Name    string   `json:"name"`
+	Branch  string   `json:"branch"`
+	Hosts   []string `json:"hosts"`
+	Comment string   `json:"comment,omitempty"`
+	// Locked is true if deployments into the environment are prohibited.
+	Locked bool         `json:"locked"`
+	Lock   *config.Lock `json:"lock,omitempty"`
+	// Freezes are active freeze windows of the environment.
+	Freezes          []freeze.Window `json:"freezes,omitempty"`
+	RequiresApproval bool            `json:"requires_approval,omitempty"`
+}
+
+// apiDeployRequest is the request body of deployments.
+type apiDeployRequest struct {
+	// FromRevision defaults to the revision of the latest successful deployment.
+	FromRevision       revision.Revision `json:"from_revision"`
+	ToRevision         revision.Revision `json:"to_revision"`
+	FromSourceRevision revision.Revision `json:"from_source_revision"`
+	ToSourceRevision   revision.Revision `json:"to_source_revision"`
+	Force              bool              `json:"force"`
+	// DryRun is true if the response should be the plan of the deployment instead of starting it.
+	DryRun     bool   `json:"dry_run"`
+	RollbackOf string `json:"rollback_of"`
+}
+
+// apiLockRequest is the request body of locks.
+type apiLockRequest struct {
+	Reason string `json:"reason"`
+	// ExpiresIn is a duration after which the lock is released, e.g. "2h".
+	ExpiresIn string `json:"expires_in"`
+}
+
+// apiCommentRequest is the request body of comments.
+type apiCommentRequest struct {
+	Comment string `json:"comment"`
+}
+
+// apiOutput is a part of the output of a deployment.
+type apiOutput struct {
+	ID    string        `json:"id"`
+	State history.State `json:"state"`
+	// Output is the output since the requested offset.
+	Output string `json:"output"`
+	// Offset is the offset to request the rest of the output from.
+	Offset int `json:"offset"`
+	// Finished is true if the deployment has finished, i.e. no more output is written.
+	Finished bool `json:"finished"`
+}
+
+func (h APIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u, err := auth.CurrentUser(r)
+	if err != nil {
+		glog.Errorf("Failed to fetch current user: %v", err)
+		writeAPIError(w, requestError{http.StatusUnauthorized, err.Error()})
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, apiPrefix), "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "projects":
+		h.projects(w, r, u)
+	case len(parts) == 2 && parts[0] == "projects":
+		h.project(w, r, u, parts[1])
+	case len(parts) == 3 && parts[0] == "projects" && parts[2] == "status":
+		h.projectStatus(w, r, u, parts[1])
+	case len(parts) == 4 && parts[0] == "projects" && parts[2] == "environments":
+		h.environment(w, r, u, parts[1], parts[3])
+	case len(parts) == 5 && parts[0] == "projects" && parts[2] == "environments":
+		projName, envName := parts[1], parts[3]
+		switch parts[4] {
+		case "status":
+			h.environmentStatus(w, r, u, projName, envName)
+		case "deploys":
+			h.deploys(w, r, u, projName, envName)
+		case "lock":
+			h.lock(w, r, u, projName, envName)
+		case "comment":
+			h.comment(w, r, u, projName, envName)
+		default:
+			writeAPIError(w, requestError{http.StatusNotFound, "not found"})
+		}
+	case len(parts) == 1 && parts[0] == "tokens":
+		h.tokens(w, r, u)
+	case len(parts) == 2 && parts[0] == "tokens":
+		h.revokeToken(w, r, u, parts[1])
+	case len(parts) == 2 && parts[0] == "deploys":
+		h.deploy(w, r, u, parts[1])
+	case len(parts) == 3 && parts[0] == "deploys" && parts[2] == "output":
+		h.output(w, r, u, parts[1])
+	default:
+		writeAPIError(w, requestError{http.StatusNotFound, "not found"})
+	}
+}
+
+// projects responds with the projects which "u" can read.
+func (h APIHandler) projects(w http.ResponseWriter, r *http.Request, u auth.User) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+	c, err := config.Load(h.dh.ecl)
+	if err != nil {
+		glog.Errorf("Failed to fetch latest configuration: %v", err)
+		writeAPIError(w, err)
+		return
+	}
+	projs := []apiProject{}
+	now := time.Now()
+	for _, p := range c.Projects {
+		repo := p.SourceRepo()
+		if !u.Allowed(p.Name, token.ScopeRead) || !h.dh.ac.Readable(repo.RepoOwner, repo.RepoName, u.Name) {
+			continue
+		}
+		projs = append(projs, newAPIProject(c, p, now))
+	}
+	writeAPIJSON(w, http.StatusOK, projs)
+}
+
+// project responds with the project "projName".
+func (h APIHandler) project(w http.ResponseWriter, r *http.Request, u auth.User, projName string) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+	c, p, err := h.loadProject(u, projName)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, newAPIProject(c, p, time.Now()))
+}
+
+// environment responds with the environment "envName" of the project "projName".
+func (h APIHandler) environment(w http.ResponseWriter, r *http.Request, u auth.User, projName, envName string) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+	c, p, env, err := h.loadEnvironment(u, projName, envName)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, newAPIEnvironment(c, p, env, time.Now()))
+}
+
+// projectStatus responds with the latest deployment status of the project in each environment.
+func (h APIHandler) projectStatus(w http.ResponseWriter, r *http.Request, u auth.User, projName string) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+	envs, err := h.fetchStatuses(u, projName)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, envs)
+}
+
+// environmentStatus responds with the latest deployment status of the project in the environment.
+func (h APIHandler) environmentStatus(w http.ResponseWriter, r *http.Request, u auth.User, projName, envName string) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+	envs, err := h.fetchStatuses(u, projName)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	for _, env := range envs {
+		if env.Name == envName {
+			writeAPIJSON(w, http.StatusOK, env)
+			return
+		}
+	}
+	writeAPIError(w, requestError{http.StatusNotFound, "no such project/environment"})
+}
+
+func (h APIHandler) fetchStatuses(u auth.User, projName string) ([]commits.Environment, error) {
+	if !u.Allowed(projName, token.ScopeRead) {
+		return nil, requestError{http.StatusForbidden, "token is not allowed to read the project"}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	envs, err := commits.FetchStatuses(ctx, h.dh.ac, h.dh.ecl, h.dh.controls, projName, u)
+	switch err {
+	case nil:
+		return envs, nil
+	case commits.ErrNoSuchProject:
+		return nil, requestError{http.StatusNotFound, "no such project"}
+	case commits.ErrProjectUnaccessible:
+		return nil, requestError{http.StatusForbidden, "permission denied"}
+	default:
+		return nil, err
+	}
+}
+
+// deploys responds with the deploy history of the environment to GET requests,
+// and starts a deployment on POST requests.
+func (h APIHandler) deploys(w http.ResponseWriter, r *http.Request, u auth.User, projName, envName string) {
+	if !allowMethods(w, r, "GET", "POST") {
+		return
+	}
+	_, p, _, err := h.loadEnvironment(u, projName, envName)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if r.Method == "POST" {
+		if err := h.checkAllowed(p, u, token.ScopeDeploy); err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		h.startDeploy(w, r, u, projName, envName)
+		return
+	}
+
+	q := history.Query{Project: projName, Environment: envName, User: r.FormValue("user"), Limit: defaultHistoryLimit}
+	if s := r.FormValue("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			writeAPIError(w, requestError{http.StatusBadRequest, fmt.Sprintf("invalid limit %q", s)})
+			return
+		}
+		q.Limit = n
+	}
+	entries, err := h.dh.store.Query(q)
+	if err != nil {
+		glog.Errorf("Failed to read entries of %s-%s: %v", projName, envName, err)
+		writeAPIError(w, err)
+		return
+	}
+	if entries == nil {
+		entries = []history.Entry{}
+	}
+	writeAPIJSON(w, http.StatusOK, entries)
+}
+
+// startDeploy starts a deployment into the environment, or responds with its plan if it is a dry run.
+func (h APIHandler) startDeploy(w http.ResponseWriter, r *http.Request, u auth.User, projName, envName string) {
+	var body apiDeployRequest
+	if err := decodeAPIRequest(r, &body); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if body.ToRevision == "" {
+		writeAPIError(w, requestError{http.StatusBadRequest, "to_revision not specified"})
+		return
+	}
+	req := deployRequest{
+		Project:     projName,
+		Environment: envName,
+		Range:       history.RevRange{From: body.FromRevision, To: body.ToRevision},
+		SourceRange: history.RevRange{From: body.FromSourceRevision, To: body.ToSourceRevision},
+		User:        u.Name,
+		Force:       body.Force,
+		RollbackOf:  body.RollbackOf,
+	}
+	if req.Range.From == "" {
+		if cur, err := currentDeploy(h.dh.store, projName, envName); err == nil {
+			req.Range.From = cur.Range.To
+		}
+	}
+
+	ctx := context.Background()
+	if body.DryRun {
+		p, err := h.dh.plan(ctx, req)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		writeAPIJSON(w, http.StatusOK, p)
+		return
+	}
+	entry, pos, err := h.dh.start(ctx, req)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeAPIJSON(w, http.StatusAccepted, deployResponse{ID: entry.ID, State: entry.State, Position: pos, Approval: entry.Approval})
+}
+
+// deploy responds with the deployment "id".
+func (h APIHandler) deploy(w http.ResponseWriter, r *http.Request, u auth.User, id string) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+	e, err := h.loadDeploy(u, id)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, e)
+}
+
+// output responds with the output of the deployment "id" since the byte offset "offset".
+func (h APIHandler) output(w http.ResponseWriter, r *http.Request, u auth.User, id string) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+	var offset int
+	if s := r.FormValue("offset"); s != "" {
+		var err error
+		if offset, err = strconv.Atoi(s); err != nil || offset < 0 {
+			writeAPIError(w, requestError{http.StatusBadRequest, fmt.Sprintf("invalid offset %q", s)})
+			return
+		}
+	}
+	e, err := h.loadDeploy(u, id)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	b, err := readDeployOutput(e)
+	if os.IsNotExist(err) && e.State.Finished() {
+		writeAPIError(w, requestError{http.StatusNotFound, fmt.Sprintf("no output of %s; it may have been removed by the retention policy", id)})
+		return
+	}
+	if err != nil && e.State.Finished() {
+		glog.Errorf("Failed to read output of %s: %v", id, err)
+		writeAPIError(w, err)
+		return
+	}
+	if offset > len(b) {
+		offset = len(b)
+	}
+	writeAPIJSON(w, http.StatusOK, apiOutput{
+		ID:       e.ID,
+		State:    e.State,
+		Output:   string(b[offset:]),
+		Offset:   len(b),
+		Finished: e.State.Finished(),
+	})
+}
+
+// lock responds with the current lock of the environment to GET requests.
+// PUT requests lock the environment and DELETE requests unlock it.
+func (h APIHandler) lock(w http.ResponseWriter, r *http.Request, u auth.User, projName, envName string) {
+	if !allowMethods(w, r, "GET", "PUT", "DELETE") {
+		return
+	}
+	c, p, env, err := h.loadEnvironment(u, projName, envName)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if r.Method == "GET" {
+		writeAPIJSON(w, http.StatusOK, env.Lock)
+		return
+	}
+	if err := h.checkAllowed(p, u, token.ScopeLock); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	if r.Method == "DELETE" {
+		err = config.ReleaseLock(h.dh.ecl, projName, envName, u.Name, c.IsAdmin(u.Name))
+		if err == nil {
+			glog.Infof("%s-%s was unlocked by %s", projName, envName, u.Name)
+			lock.Publish(h.dh.hub, projName, envName, u.Name, nil)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	} else {
+		var body apiLockRequest
+		if err := decodeAPIRequest(r, &body); err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		l := config.Lock{Owner: u.Name, Reason: body.Reason, Time: time.Now()}
+		if body.ExpiresIn != "" {
+			d, err := time.ParseDuration(body.ExpiresIn)
+			if err != nil || d <= 0 {
+				writeAPIError(w, requestError{http.StatusBadRequest, fmt.Sprintf("invalid expires_in %q", body.ExpiresIn)})
+				return
+			}
+			l.Expiry = l.Time.Add(d)
+		}
+		err = config.AcquireLock(h.dh.ecl, projName, envName, l)
+		if err == nil {
+			glog.Infof("%s-%s was locked by %s", projName, envName, u.Name)
+			lock.Publish(h.dh.hub, projName, envName, u.Name, &l)
+			writeAPIJSON(w, http.StatusOK, l)
+			return
+		}
+	}
+	switch err {
+	case config.ErrLocked:
+		msg := err.Error()
+		if env.Lock != nil {
+			msg = fmt.Sprintf("%s-%s is %s", projName, envName, env.Lock)
+		}
+		writeAPIError(w, requestError{http.StatusConflict, msg})
+	case config.ErrNotLockOwner:
+		writeAPIError(w, requestError{http.StatusForbidden, fmt.Sprintf("%s; %s-%s is %s", err, projName, envName, env.Lock)})
+	case config.ErrNotLocked, config.ErrLockChanged:
+		writeAPIError(w, requestError{http.StatusConflict, err.Error()})
+	default:
+		glog.Errorf("Failed to lock/unlock project=%s env=%s: %v", projName, envName, err)
+		writeAPIError(w, err)
+	}
+}
+
+// comment updates the comment on the environment.
+func (h APIHandler) comment(w http.ResponseWriter, r *http.Request, u auth.User, projName, envName string) {
+	if !allowMethods(w, r, "PUT") {
+		return
+	}
+	_, p, _, err := h.loadEnvironment(u, projName, envName)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if err := h.checkAllowed(p, u, token.ScopeLock); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	var body apiCommentRequest
+	if err := decodeAPIRequest(r, &body); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if err := config.SetComment(h.dh.ecl, projName, envName, body.Comment); err != nil {
+		glog.Errorf("Failed to store comment for project=%s env=%s: %v", projName, envName, err)
+		writeAPIError(w, err)
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, body)
+}
+
+// loadProject returns the latest configuration and the project "projName" if "u" can read the project.
+func (h APIHandler) loadProject(u auth.User, projName string) (config.Config, config.Project, error) {
+	c, err := config.Load(h.dh.ecl)
+	if err != nil {
+		glog.Errorf("Failed to fetch latest configuration: %v", err)
+		return config.Config{}, config.Project{}, err
+	}
+	p, err := config.ProjectFromName(c.Projects, projName)
+	if err != nil {
+		return config.Config{}, config.Project{}, requestError{http.StatusNotFound, "no such project"}
+	}
+	if !u.Allowed(p.Name, token.ScopeRead) {
+		return config.Config{}, config.Project{}, requestError{http.StatusForbidden, "token is not allowed to read the project"}
+	}
+	repo := p.SourceRepo()
+	if !h.dh.ac.Readable(repo.RepoOwner, repo.RepoName, u.Name) {
+		return config.Config{}, config.Project{}, requestError{http.StatusForbidden, "permission denied"}
+	}
+	return c, p, nil
+}
+
+// loadEnvironment is like loadProject but also returns the environment "envName" of the project.
+func (h APIHandler) loadEnvironment(u auth.User, projName, envName string) (config.Config, config.Project, config.Environment, error) {
+	c, p, err := h.loadProject(u, projName)
+	if err != nil {
+		return config.Config{}, config.Project{}, config.Environment{}, err
+	}
+	env, err := config.EnvironmentFromName(c.Projects, projName, envName)
+	if err != nil {
+		return config.Config{}, config.Project{}, config.Environment{}, requestError{http.StatusNotFound, "no such project/environment"}
+	}
+	return c, p, *env, nil
+}
+
+// loadDeploy returns the deployment "id" if "u" can read its project.
+func (h APIHandler) loadDeploy(u auth.User, id string) (history.Entry, error) {
+	e, err := h.dh.store.Get(id)
+	if err == history.ErrNotFound {
+		return history.Entry{}, requestError{http.StatusNotFound, "no such deploy"}
+	}
+	if err != nil {
+		glog.Errorf("Failed to get deploy %s: %v", id, err)
+		return history.Entry{}, err
+	}
+	if _, _, err := h.loadProject(u, e.Project); err != nil {
+		return history.Entry{}, err
+	}
+	return e, nil
+}
+
+// checkAllowed returns an error unless "u" can deploy the project "p" and is allowed to do "s" in it.
+func (h APIHandler) checkAllowed(p config.Project, u auth.User, s token.Scope) error {
+	if !u.Allowed(p.Name, s) {
+		return requestError{http.StatusForbidden, fmt.Sprintf("token is not allowed to %s the project", s)}
+	}
+	repo := p.SourceRepo()
+	if !h.dh.ac.Deployable(repo.RepoOwner, repo.RepoName, u.Name) {
+		return requestError{http.StatusForbidden, "permission denied"}
+	}
+	return nil
+}
+
+func newAPIProject(c config.Config, p config.Project, now time.Time) apiProject {
+	proj := apiProject{
+		Name:         p.Name,
+		RepoOwner:    p.RepoOwner,
+		RepoName:     p.RepoName,
+		Pipeline:     p.Pipeline,
+		Environments: []apiEnvironment{},
+	}
+	for _, e := range p.Environments {
+		proj.Environments = append(proj.Environments, newAPIEnvironment(c, p, e, now))
+	}
+	return proj
+}
+
+func newAPIEnvironment(c config.Config, p config.Project, e config.Environment, now time.Time) apiEnvironment {
+	return apiEnvironment{
+		Name:             e.Name,
+		Branch:           e.Branch,
+		Hosts:            e.Hosts,
+		Comment:          e.Comment,
+		Locked:           e.Locked(),
+		Lock:             e.Lock,
+		Freezes:          c.ActiveFreezes(p, e, now),
+		RequiresApproval: e.RequiresApproval,
+	}
+}
+
+// allowMethods responds with 405 and returns false unless the method of "r" is one of "methods".
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeAPIError(w, requestError{http.StatusMethodNotAllowed, "method not allowed"})
+	return false
+}
+
+// decodeAPIRequest decodes the JSON request body of "r" into "v". An empty body leaves "v" unchanged.
+// The body must be sent as application/json so that browsers do not send it across origins without preflight.
+func decodeAPIRequest(r *http.Request, v interface{}) error {
+	if mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mt != "application/json" {
+		return requestError{http.StatusUnsupportedMediaType, "request body must be application/json"}
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil && err != io.EOF {
+		return requestError{http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err)}
+	}
+	return nil
+}
+
+// writeAPIJSON responds with "v" in JSON.
+func writeAPIJSON(w http.ResponseWriter, status int, v interface{}) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		glog.Errorf("Failed to marshal response: %v", err)
+		writeAPIError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(buf)
+}
+
+// writeAPIError responds with "err" as apiError.
+// The status code is the one of "err" if it is a requestError, or 500 otherwise.
+func writeAPIError(w http.ResponseWriter, err error) {
+	status, msg := http.StatusInternalServerError, err.Error()
+	if re, ok := err.(requestError); ok {
+		status, msg = re.status, re.msg
+	}
+	buf, _ := json.Marshal(apiError{Error: msg})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(buf)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gengo/goship/lib/auth"
+	"github.com/gengo/goship/lib/config"
+	"github.com/gengo/goship/lib/history"
+	"github.com/gengo/goship/lib/notification"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// ApproveHandler approves a deployment which is awaiting approval and enqueues it.
+// i.e. http://127.0.0.1:8000/approve?id=<deploy ID>
+type ApproveHandler struct {
+	dh DeployHandler
+}
+
+func (h ApproveHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	u, err := auth.CurrentUser(r)
+	if err != nil {
+		glog.Errorf("Failed to fetch current user: %v", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	entry, pos, err := h.dh.approve(r.FormValue("id"), u.Name, time.Now())
+	if re, ok := err.(requestError); ok {
+		http.Error(w, re.msg, re.status)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp := deployResponse{ID: entry.ID, State: entry.State, Position: pos, Approval: entry.Approval}
+	buf, err := json.Marshal(resp)
+	if err != nil {
+		glog.Errorf("Failed to marshal response: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(buf)
+}
+
+// requestApproval records "entry" as a deployment awaiting approval by another user.
+func (h DeployHandler) requestApproval(c config.Config, env config.Environment, entry history.Entry) (history.Entry, int, error) {
+	entry.State = history.StateAwaitingApproval
+	entry.Approval = &history.Approval{Expiry: entry.Time.Add(config.ApprovalExpiry(env))}
+	if _, err := h.store.Append(entry); err != nil {
+		glog.Errorf("Failed to record deployment %s: %v", entry.ID, err)
+		return history.Entry{}, 0, err
+	}
+	h.awaiting.add(entry.ID)
+	glog.Infof("Deployment %s of %s-%s by %s is awaiting approval until %s", entry.ID, entry.Project, entry.Environment, entry.User, entry.Approval.Expiry)
+	broadcastEvent(h.hub, entry, string(entry.State), entry.User)
+	if c.Notify != "" {
+		msg := fmt.Sprintf("%s requests approval to deploy %s to *%s* (%s).", entry.User, entry.Project, entry.Environment, entry.ID)
+		if err := notify(c.Notify, msg); err != nil {
+			glog.Errorf("Failed to notify approval request of %s: %v", entry.ID, err)
+		}
+	}
+	return entry, 0, nil
+}
+
+// approve approves the deployment "id" on behalf of "approver" at "t" and enqueues it.
+// Locks and freeze windows are checked again for the user who requested the deployment.
+func (h DeployHandler) approve(id, approver string, t time.Time) (history.Entry, int, error) {
+	h.approving.Lock()
+	defer h.approving.Unlock()
+
+	e, err := h.store.Get(id)
+	if err == history.ErrNotFound {
+		return history.Entry{}, 0, requestError{http.StatusNotFound, "no such deploy"}
+	}
+	if err != nil {
+		glog.Errorf("Failed to get deploy %s: %v", id, err)
+		return history.Entry{}, 0, err
+	}
+	if e.State != history.StateAwaitingApproval || e.Approval == nil {
+		return history.Entry{}, 0, requestError{http.StatusConflict, "deployment is not awaiting approval"}
+	}
+	if expired, err := expireApproval(h.store, h.hub, &e, t); err != nil {
+		return history.Entry{}, 0, err
+	} else if expired {
+		return history.Entry{}, 0, requestError{http.StatusConflict, "approval request has expired"}
+	}
+	if approver == e.User {
+		return history.Entry{}, 0, requestError{http.StatusForbidden, "deployments must be approved by another user"}
+	}
+
+	c, err := config.Load(h.ecl)
+	if err != nil {
+		glog.Errorf("Failed to fetch latest configuration: %v", err)
+		return history.Entry{}, 0, err
+	}
+	proj, err := config.ProjectFromName(c.Projects, e.Project)
+	if err != nil {
+		return history.Entry{}, 0, requestError{http.StatusNotFound, "no such project"}
+	}
+	env, err := config.EnvironmentFromName(c.Projects, e.Project, e.Environment)
+	if err != nil {
+		return history.Entry{}, 0, requestError{http.StatusNotFound, "no such project/environment"}
+	}
+	repo := proj.SourceRepo()
+	if !h.ac.Deployable(repo.RepoOwner, repo.RepoName, approver) {
+		return history.Entry{}, 0, requestError{http.StatusForbidden, fmt.Sprintf("%s does not have permission to deploy %s", approver, proj.Name)}
+	}
+	if status, err := checkDeployable(h.ac, c, proj, *env, e.User, e.Forced, t); err != nil {
+		glog.Warningf("Rejected approved deployment %s into %s-%s: %v", e.ID, proj.Name, env.Name, err)
+		return history.Entry{}, 0, requestError{status, err.Error()}
+	}
+
+	e.Approval.ApprovedBy, e.Approval.ApprovedAt = approver, t
+	e, pos, err := h.enqueueEntry(c, proj, *env, e)
+	if err != nil {
+		return history.Entry{}, 0, err
+	}
+	glog.Infof("Deployment %s of %s-%s by %s was approved by %s", e.ID, e.Project, e.Environment, e.User, approver)
+	broadcastEvent(h.hub, e, "approved", approver)
+	return e, pos, nil
+}
+
+// runApprovalExpiry cancels deployments whose approval requests have expired every "interval" until "ctx" is done.
+func (h DeployHandler) runApprovalExpiry(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		expired, err := h.expireApprovals(time.Now())
+		if err != nil {
+			glog.Errorf("Failed to expire approval requests: %v", err)
+		}
+		if len(expired) > 0 {
+			h.notifyExpired(expired)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// expireApprovals cancels all the deployments whose approval requests have expired at "t" and returns them.
+// It reads only the deployments in h.awaiting, and forgets the ones which are no longer awaiting approval.
+func (h DeployHandler) expireApprovals(t time.Time) ([]history.Entry, error) {
+	h.approving.Lock()
+	defer h.approving.Unlock()
+
+	var expired []history.Entry
+	for _, id := range h.awaiting.list() {
+		e, err := h.store.Get(id)
+		if err == history.ErrNotFound {
+			h.awaiting.remove(id)
+			continue
+		}
+		if err != nil {
+			return expired, err
+		}
+		if e.State != history.StateAwaitingApproval {
+			h.awaiting.remove(id)
+			continue
+		}
+		ok, err := expireApproval(h.store, h.hub, &e, t)
+		if err != nil {
+			return expired, err
+		}
+		if ok {
+			h.awaiting.remove(id)
+			expired = append(expired, e)
+		}
+	}
+	return expired, nil
+}
+
+// notifyExpired sends notifications of the expired approval requests of "entries".
+func (h DeployHandler) notifyExpired(entries []history.Entry) {
+	c, err := config.Load(h.ecl)
+	if err != nil {
+		glog.Errorf("Failed to fetch latest configuration: %v", err)
+		return
+	}
+	if c.Notify == "" {
+		return
+	}
+	for _, e := range entries {
+		msg := fmt.Sprintf("Approval request of %s to deploy %s to *%s* (%s) has expired.", e.User, e.Project, e.Environment, e.ID)
+		if err := notify(c.Notify, msg); err != nil {
+			glog.Errorf("Failed to notify expiry of approval request of %s: %v", e.ID, err)
+		}
+	}
+}
+
+// expireApproval cancels "e" if its approval request has expired at "t".
+// It returns true if "e" has been cancelled.
+func expireApproval(store history.DeployStore, hub *notification.Hub, e *history.Entry, t time.Time) (bool, error) {
+	if e.State != history.StateAwaitingApproval || e.Approval == nil || !e.Approval.Expired(t) {
+		return false, nil
+	}
+	e.Finish(history.StateCancelled, t)
+	e.Reason = history.ReasonApprovalExpired
+	if err := store.Update(*e); err != nil {
+		glog.Errorf("Failed to update the entry %s: %v", e.ID, err)
+		return false, err
+	}
+	glog.Infof("Approval request of deployment %s of %s-%s has expired", e.ID, e.Project, e.Environment)
+	broadcastEvent(hub, *e, string(e.State), "")
+	return true, nil
+}
+
+// awaitingApprovals tracks IDs of deployments awaiting approval so that expired requests are found without scanning the history.
+type awaitingApprovals struct {
+	mu  sync.Mutex
+	ids map[string]bool
+}
+
+// loadAwaitingApprovals returns awaitingApprovals which has the deployments awaiting approval in "store".
+func loadAwaitingApprovals(store history.DeployStore) (*awaitingApprovals, error) {
+	entries, err := store.Query(history.Query{})
+	if err != nil {
+		return nil, err
+	}
+	a := &awaitingApprovals{ids: make(map[string]bool)}
+	for _, e := range entries {
+		if e.State == history.StateAwaitingApproval {
+			a.add(e.ID)
+		}
+	}
+	return a, nil
+}
+
+// add starts tracking the deployment "id".
+func (a *awaitingApprovals) add(id string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.ids[id] = true
+}
+
+// remove stops tracking the deployment "id".
+func (a *awaitingApprovals) remove(id string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.ids, id)
+}
+
+// list returns the IDs of the tracked deployments.
+func (a *awaitingApprovals) list() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var ids []string
+	for id := range a.ids {
+		ids = append(ids, id)
+	}
+	return ids
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/gengo/goship/lib/acl"
+	"github.com/gengo/goship/lib/auth"
+	"github.com/gengo/goship/lib/config"
+	"github.com/gengo/goship/lib/history"
+	"github.com/gengo/goship/lib/notification"
+	"github.com/gengo/goship/lib/process"
+	"github.com/gengo/goship/lib/queue"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// runningDeploys tracks deploy commands which are running.
+type runningDeploys struct {
+	// grace is the grace period between SIGTERM and SIGKILL.
+	grace time.Duration
+
+	mu    sync.Mutex
+	procs map[string]*runningDeploy
+}
+
+type runningDeploy struct {
+	// proc is nil until the deploy command starts.
+	proc *process.Process
+	// stop cancels the context returned by watch if any.
+	stop context.CancelFunc
+	// cancelledBy is the name of the user who cancelled the deployment.
+	cancelledBy string
+}
+
+// newRunningDeploys returns a new runningDeploys.
+// Deploy commands are killed if they do not exit within "grace" after SIGTERM.
+func newRunningDeploys(grace time.Duration) *runningDeploys {
+	return &runningDeploys{
+		grace: grace,
+		procs: make(map[string]*runningDeploy),
+	}
+}
+
+// add registers a deployment "id" which is about to start.
+// The deployment is cancellable until it is removed.
+func (r *runningDeploys) add(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.procs[id] = new(runningDeploy)
+}
+
+// remove unregisters the deployment "id" and returns the name of the user who cancelled it.
+func (r *runningDeploys) remove(id string) (cancelledBy string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d, ok := r.procs[id]
+	if !ok {
+		return ""
+	}
+	delete(r.procs, id)
+	return d.cancelledBy
+}
+
+// attach associates "proc" with the deployment "id".
+// It terminates "proc" if the deployment has already been cancelled.
+func (r *runningDeploys) attach(id string, proc *process.Process) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d, ok := r.procs[id]
+	if !ok {
+		return
+	}
+	d.proc = proc
+	if d.cancelledBy != "" {
+		go proc.Terminate(r.grace)
+	}
+}
+
+// watch returns a context derived from "ctx" which is cancelled when the deployment "id" is cancelled.
+func (r *runningDeploys) watch(ctx context.Context, id string) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d, ok := r.procs[id]
+	if !ok {
+		return ctx, cancel
+	}
+	if d.cancelledBy != "" {
+		cancel()
+	}
+	d.stop = cancel
+	return ctx, cancel
+}
+
+// cancelled returns true if the deployment "id" has been cancelled.
+func (r *runningDeploys) cancelled(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d, ok := r.procs[id]
+	return ok && d.cancelledBy != ""
+}
+
+// cancel terminates the deploy command of the deployment "id" on behalf of "user", or stops its health check.
+// It returns false if the deployment is not running.
+func (r *runningDeploys) cancel(id, user string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d, ok := r.procs[id]
+	if !ok {
+		return false
+	}
+	if d.cancelledBy != "" {
+		return true
+	}
+	d.cancelledBy = user
+	if d.proc != nil {
+		go d.proc.Terminate(r.grace)
+	}
+	if d.stop != nil {
+		d.stop()
+	}
+	return true
+}
+
+// CancelHandler cancels a pending or running deployment.
+// i.e. http://127.0.0.1:8000/cancel?id=<deploy ID>
+type CancelHandler struct {
+	ac      acl.AccessControl
+	ecl     *etcd.Client
+	hub     *notification.Hub
+	store   history.DeployStore
+	queue   *queue.Queue
+	running *runningDeploys
+	// approving is DeployHandler.approving, which serializes approvals and cancellations of approval requests.
+	approving *sync.Mutex
+}
+
+func (h CancelHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	u, err := auth.CurrentUser(r)
+	if err != nil {
+		glog.Errorf("Failed to fetch current user: %v", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	id := r.FormValue("id")
+	e, err := h.store.Get(id)
+	if err == history.ErrNotFound {
+		http.Error(w, "no such deploy", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		glog.Errorf("Failed to get deploy %s: %v", id, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	c, err := config.Load(h.ecl)
+	if err != nil {
+		glog.Errorf("Failed to fetch latest configuration: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	proj, err := config.ProjectFromName(c.Projects, e.Project)
+	if err != nil {
+		http.Error(w, "no such project", http.StatusNotFound)
+		return
+	}
+	repo := proj.SourceRepo()
+	if !h.ac.Deployable(repo.RepoOwner, repo.RepoName, u.Name) {
+		http.Error(w, "permission denied", http.StatusForbidden)
+		return
+	}
+
+	switch {
+	case e.State == history.StateAwaitingApproval:
+		ok, err := h.cancelApproval(&e, u.Name, time.Now())
+		if err != nil {
+			glog.Errorf("Failed to cancel the approval request of %s: %v", e.ID, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "deploy is no longer awaiting approval", http.StatusConflict)
+			return
+		}
+	case e.State == history.StatePending && h.queue.Remove(queueKey(e.Project, e.Environment), e.ID):
+		e.Finish(history.StateCancelled, time.Now())
+		e.CancelledBy = u.Name
+		if err := h.store.Update(e); err != nil {
+			glog.Errorf("Failed to update the entry %s: %v", e.ID, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	case h.running.cancel(e.ID, u.Name):
+	default:
+		http.Error(w, "deploy is not running", http.StatusConflict)
+		return
+	}
+	glog.Infof("Deployment %s of %s-%s was cancelled by %s", e.ID, e.Project, e.Environment, u.Name)
+	broadcastEvent(h.hub, e, "cancelled", u.Name)
+
+	buf, err := json.Marshal(map[string]string{"id": e.ID, "cancelled_by": u.Name})
+	if err != nil {
+		glog.Errorf("Failed to marshal response: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(buf)
+}
+
+// cancelApproval cancels the deployment "e" awaiting approval on behalf of "user" at "t".
+// It returns false if "e" is no longer awaiting approval, e.g. it has been approved or has expired.
+func (h CancelHandler) cancelApproval(e *history.Entry, user string, t time.Time) (bool, error) {
+	h.approving.Lock()
+	defer h.approving.Unlock()
+
+	cur, err := h.store.Get(e.ID)
+	if err != nil {
+		return false, err
+	}
+	if cur.State != history.StateAwaitingApproval {
+		return false, nil
+	}
+	cur.Finish(history.StateCancelled, t)
+	cur.CancelledBy = user
+	if err := h.store.Update(cur); err != nil {
+		return false, err
+	}
+	*e = cur
+	return true, nil
+}
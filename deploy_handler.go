@@ -9,36 +9,59 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
-	"path"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/coreos/go-etcd/etcd"
+	"github.com/gengo/goship/lib/acl"
 	"github.com/gengo/goship/lib/auth"
+	"github.com/gengo/goship/lib/command"
 	"github.com/gengo/goship/lib/config"
+	"github.com/gengo/goship/lib/history"
 	"github.com/gengo/goship/lib/notification"
+	"github.com/gengo/goship/lib/output"
+	"github.com/gengo/goship/lib/process"
+	"github.com/gengo/goship/lib/queue"
 	"github.com/gengo/goship/lib/revision"
 	"github.com/golang/glog"
 	"golang.org/x/net/context"
 )
 
 type DeployHandler struct {
-	ecl  *etcd.Client
-	ctrl revision.Control
-	hub  *notification.Hub
+	ac  acl.AccessControl
+	ecl *etcd.Client
+	// controls builds revision.Control of projects.
+	controls revision.ControlFactory
+	hub      *notification.Hub
+	store    history.DeployStore
+	queue    *queue.Queue
+	// running tracks running deploy commands so that they can be cancelled.
+	running *runningDeploys
+	// outputs keeps the output files of running deployments open.
+	outputs *deployOutputs
+	// approving serializes approvals so that a deployment is not enqueued twice.
+	approving *sync.Mutex
+	// awaiting tracks deployments awaiting approval.
+	awaiting *awaitingApprovals
+}
+
+// deployResponse is the response body of DeployHandler.
+type deployResponse struct {
+	ID    string        `json:"id"`
+	State history.State `json:"state"`
+	// Position is the position of the deployment in the queue of the environment.
+	// It is 0 if the deployment is running.
+	Position int `json:"position"`
+	// Approval is the approval request of the deployment if the environment requires approval.
+	Approval *history.Approval `json:"approval,omitempty"`
 }
 
 func (h DeployHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx := context.Background()
 
-	c, err := config.Load(h.ecl)
-	if err != nil {
-		glog.Errorf("Failed to fetch latest configuration: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
 	u, err := auth.CurrentUser(r)
 	if err != nil {
 		glog.Errorf("Failed to fetch current user: %v", err)
@@ -46,23 +69,23 @@ func (h DeployHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var (
-		user              = u.Name
-		projName, envName string
-		deploy            RevRange
-		src               = RevRange{
+	req := deployRequest{
+		User: u.Name,
+		SourceRange: history.RevRange{
 			From: revision.Revision(r.FormValue("from_source_revision")),
 			To:   revision.Revision(r.FormValue("to_source_revision")),
-		}
-	)
+		},
+		Force:      r.FormValue("force") != "",
+		RollbackOf: r.FormValue("rollback_of"),
+	}
 	for _, spec := range []struct {
 		name  string
 		value *string
 	}{
-		{name: "project", value: &projName},
-		{name: "environment", value: &envName},
-		{name: "from_revision", value: (*string)(&deploy.From)},
-		{name: "to_revision", value: (*string)(&deploy.To)},
+		{name: "project", value: &req.Project},
+		{name: "environment", value: &req.Environment},
+		{name: "from_revision", value: (*string)(&req.Range.From)},
+		{name: "to_revision", value: (*string)(&req.Range.To)},
 	} {
 		*spec.value = r.FormValue(spec.name)
 		if *spec.value == "" {
@@ -71,72 +94,306 @@ func (h DeployHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
-	proj, err := config.ProjectFromName(c.Projects, projName)
+
+	if r.FormValue("dry_run") != "" {
+		h.servePlan(ctx, w, req)
+		return
+	}
+
+	entry, pos, err := h.start(ctx, req)
+	if re, ok := err.(requestError); ok {
+		http.Error(w, re.msg, re.status)
+		return
+	}
 	if err != nil {
-		http.Error(w, "no such project", http.StatusNotFound)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	env, err := config.EnvironmentFromName(c.Projects, projName, envName)
+	resp := deployResponse{ID: entry.ID, State: entry.State, Position: pos, Approval: entry.Approval}
+	buf, err := json.Marshal(resp)
 	if err != nil {
-		http.Error(w, "no such project/environment", http.StatusNotFound)
+		glog.Errorf("Failed to marshal response: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(buf)
+}
 
-	h.deploy(ctx, w, c, user, proj, *env, deploy, src)
+// deployRequest is a request of a deployment.
+type deployRequest struct {
+	Project     string
+	Environment string
+	// Range is the range of revisions to deploy.
+	Range history.RevRange
+	// SourceRange is the range of source revisions. It is optional.
+	SourceRange history.RevRange
+	// User is the name of the user who requested the deployment.
+	User string
+	// Force is true if an admin wants to deploy into a locked environment.
+	Force bool
+	// RollbackOf is the ID of a successful deployment to roll back to.
+	// Range.To is replaced with the revision of the deployment if not empty.
+	RollbackOf string
+	// ScheduleID is the ID of the schedule which started the deployment if any.
+	ScheduleID string
+	// PromotedFrom is the name of the previous stage in the pipeline if the deployment is a promotion.
+	PromotedFrom string
 }
 
-func (h DeployHandler) deploy(ctx context.Context, w http.ResponseWriter, c config.Config, user string, proj config.Project, env config.Environment, deploy, src RevRange) {
-	if c.Notify != "" {
-		err := startNotify(c.Notify, user, proj.Name, env.Name)
+// requestError is an error caused by a deploy request which must be rejected.
+type requestError struct {
+	// status is an HTTP status code which describes the error.
+	status int
+	msg    string
+}
+
+func (e requestError) Error() string {
+	return e.msg
+}
+
+// start validates "req" and then enqueues the deployment.
+// If the environment requires approval, it records the deployment as awaiting approval instead.
+// It returns the new entry of the deployment and its position in the deploy queue.
+// It returns a requestError if "req" is rejected.
+func (h DeployHandler) start(ctx context.Context, req deployRequest) (history.Entry, int, error) {
+	d, err := h.prepare(ctx, req)
+	if err != nil {
+		return history.Entry{}, 0, err
+	}
+	if d.entry.Forced {
+		glog.Warningf("AUDIT: %s forced deployment %s into locked environment %s-%s", req.User, d.entry.ID, d.proj.Name, d.env.Name)
+	}
+	if d.env.RequiresApproval {
+		return h.requestApproval(d.c, d.env, d.entry)
+	}
+	return h.enqueueEntry(d.c, d.proj, d.env, d.entry)
+}
+
+// preparedDeploy is a validated deploy request.
+type preparedDeploy struct {
+	c     config.Config
+	proj  config.Project
+	env   config.Environment
+	ctrl  revision.Control
+	entry history.Entry
+}
+
+// prepare validates "req" and builds a new entry of the deployment without recording it.
+// It returns a requestError if "req" is rejected.
+func (h DeployHandler) prepare(ctx context.Context, req deployRequest) (preparedDeploy, error) {
+	c, err := config.Load(h.ecl)
+	if err != nil {
+		glog.Errorf("Failed to fetch latest configuration: %v", err)
+		return preparedDeploy{}, err
+	}
+	proj, err := config.ProjectFromName(c.Projects, req.Project)
+	if err != nil {
+		return preparedDeploy{}, requestError{http.StatusNotFound, "no such project"}
+	}
+	env, err := config.EnvironmentFromName(c.Projects, req.Project, req.Environment)
+	if err != nil {
+		return preparedDeploy{}, requestError{http.StatusNotFound, "no such project/environment"}
+	}
+
+	if status, err := checkDeployable(h.ac, c, proj, *env, req.User, req.Force, time.Now()); err != nil {
+		glog.Warningf("Rejected deployment into %s-%s by %s: %v", proj.Name, env.Name, req.User, err)
+		return preparedDeploy{}, requestError{status, err.Error()}
+	}
+	return h.build(ctx, c, proj, *env, req)
+}
+
+// build builds a new entry of the deployment "req" into "env" of "proj" without checking whether it is allowed.
+func (h DeployHandler) build(ctx context.Context, c config.Config, proj config.Project, env config.Environment, req deployRequest) (preparedDeploy, error) {
+	deploy, src := req.Range, req.SourceRange
+	if req.RollbackOf != "" {
+		orig, err := h.store.Get(req.RollbackOf)
+		if err == history.ErrNotFound || (err == nil && (orig.Project != proj.Name || orig.Environment != env.Name)) {
+			return preparedDeploy{}, requestError{http.StatusNotFound, "no such deployment to roll back to"}
+		}
 		if err != nil {
-			glog.Errorf("Failed to notify start-deployment event of %s (%s): %v", proj.Name, env.Name, err)
+			glog.Errorf("Failed to get deploy %s: %v", req.RollbackOf, err)
+			return preparedDeploy{}, err
+		}
+		if orig.State != history.StateSucceeded {
+			return preparedDeploy{}, requestError{http.StatusConflict, "cannot roll back to an unsuccessful deployment"}
+		}
+		deploy.To = orig.Range.To
+		src.To = ""
+		if orig.SourceRange != nil {
+			src.To = orig.SourceRange.To
 		}
 	}
 
-	deployTime := time.Now()
-	success := true
-	command := deployCommand(env)
-	cmd := exec.Command(command[0], command[1:]...)
-	stdout, err := cmd.StdoutPipe()
+	ctrl, err := h.controls(c.DeployUser, proj)
 	if err != nil {
-		glog.Errorf("Could not get stdout of command: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		glog.Errorf("Failed to build revision control of %s: %v", proj.Name, err)
+		return preparedDeploy{}, err
+	}
+	entry := newEntry(ctx, ctrl, proj, env, deploy, src, req.User, time.Now())
+	entry.RollbackOf = req.RollbackOf
+	entry.ScheduleID = req.ScheduleID
+	entry.PromotedFrom = req.PromotedFrom
+	entry.Forced = req.Force && env.Locked()
+	return preparedDeploy{c: c, proj: proj, env: env, ctrl: ctrl, entry: entry}, nil
+}
+
+// enqueueEntry enqueues "entry" and returns it with its state and its position in the deploy queue.
+func (h DeployHandler) enqueueEntry(c config.Config, proj config.Project, env config.Environment, entry history.Entry) (history.Entry, int, error) {
+	pos, err := h.enqueue(c, proj, env, entry, false)
+	if err == queue.ErrFull {
+		msg := fmt.Sprintf("another deployment into %s-%s is in progress", proj.Name, env.Name)
+		return history.Entry{}, 0, requestError{http.StatusConflict, msg}
 	}
-	stderr, err := cmd.StderrPipe()
 	if err != nil {
-		glog.Errorf("Could not get stderr of command: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		glog.Errorf("Failed to enqueue a deployment: %v", err)
+		return history.Entry{}, 0, err
+	}
+	entry.State = history.StatePending
+	if pos == 0 {
+		entry.State = history.StateRunning
 	}
+	return entry, pos, nil
+}
+
+// statusLocked is the HTTP status code "423 Locked" defined in RFC 4918.
+const statusLocked = 423
+
+// checkDeployable returns an error with an HTTP status code if "user" must not deploy into "env" of "proj" at "t".
+// Admins can deploy into a locked environment if "force" is true.
+// Admins can also deploy in freeze windows.
+func checkDeployable(ac acl.AccessControl, c config.Config, proj config.Project, env config.Environment, user string, force bool, t time.Time) (int, error) {
 	repo := proj.SourceRepo()
-	glog.Infof("Starting deployment of %s-%s (%s/%s) from %s to %s; requested by %s", proj.Name, env.Name, repo.RepoOwner, repo.RepoName, deploy.From, deploy.To, user)
-	if err = cmd.Start(); err != nil {
-		glog.Errorf("Could not run deployment command: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	if !ac.Deployable(repo.RepoOwner, repo.RepoName, user) {
+		return http.StatusForbidden, fmt.Errorf("%s does not have permission to deploy %s", user, proj.Name)
 	}
+	if force && !c.IsAdmin(user) {
+		return http.StatusForbidden, fmt.Errorf("only admins can force deployments")
+	}
+	if env.Locked() && !force {
+		if env.Lock != nil {
+			return statusLocked, fmt.Errorf("%s-%s is %s", proj.Name, env.Name, env.Lock)
+		}
+		return statusLocked, fmt.Errorf("%s-%s is locked", proj.Name, env.Name)
+	}
+	if freezes := c.ActiveFreezes(proj, env, t); len(freezes) > 0 {
+		if !c.IsAdmin(user) {
+			return statusLocked, fmt.Errorf("deployments into %s-%s are frozen: %s", proj.Name, env.Name, freezes[0])
+		}
+		glog.Warningf("AUDIT: admin %s is deploying into %s-%s during freeze %s", user, proj.Name, env.Name, freezes[0])
+	}
+	return http.StatusOK, nil
+}
 
-	var wg sync.WaitGroup
-	wg.Add(2)
-	go h.sendOutput(&wg, bufio.NewScanner(stdout), proj.Name, env.Name, deployTime)
-	go h.sendOutput(&wg, bufio.NewScanner(stderr), proj.Name, env.Name, deployTime)
-	wg.Wait()
+// queueKey returns the key of the deploy queue of the environment.
+func queueKey(proj, env string) string {
+	return fmt.Sprintf("%s-%s", proj, env)
+}
 
-	err = cmd.Wait()
-	if err != nil {
-		success = false
-		glog.Errorf("Deployment of %s failed: %v", proj.Name, err)
+// enqueue records "entry" as a pending deployment and adds it into the deploy queue of the environment.
+// If "first" is true, the deployment is added to the head of the queue regardless of its limit.
+// It returns the position of the deployment in the queue.
+func (h DeployHandler) enqueue(c config.Config, proj config.Project, env config.Environment, entry history.Entry, first bool) (int, error) {
+	entry.State = history.StatePending
+	// The job must not start before the entry is stored.
+	ready := make(chan struct{})
+	var stored bool
+	job := queue.Job{
+		ID: entry.ID,
+		// The deployment can be cancelled as running once it leaves the queue.
+		Start: func() { h.running.add(entry.ID) },
+		Run: func() {
+			<-ready
+			if !stored {
+				h.running.remove(entry.ID)
+				return
+			}
+			h.deploy(context.Background(), c, proj, env, entry)
+		},
+	}
+	key := queueKey(proj.Name, env.Name)
+	var (
+		pos int
+		err error
+	)
+	if first {
+		pos = h.queue.EnqueueFirst(key, job)
+	} else if pos, err = h.queue.Enqueue(key, job); err != nil {
+		return 0, err
+	}
+	if entry.Approval != nil {
+		// The entry has already been recorded when the approval was requested.
+		err = h.store.Update(entry)
 	} else {
+		_, err = h.store.Append(entry)
+	}
+	stored = err == nil
+	close(ready)
+	return pos, err
+}
+
+// deploy runs the deployment of "entry", which must have been registered in h.running.
+// It unregisters "entry" after its health check.
+func (h DeployHandler) deploy(ctx context.Context, c config.Config, proj config.Project, env config.Environment, entry history.Entry) {
+	user, deploy := entry.User, entry.Range
+	entry.State = history.StateRunning
+	if err := h.store.Update(entry); err != nil {
+		glog.Errorf("Failed to update the entry %s: %v", entry.ID, err)
+	}
+	if err := h.outputs.open(entry, outputLimit(proj)); err != nil {
+		glog.Errorf("Failed to open output of %s: %v", entry.ID, err)
+	}
+	broadcastEvent(h.hub, entry, "started", user)
+
+	if c.Notify != "" {
+		err := startNotify(c.Notify, entry)
+		if err != nil {
+			glog.Errorf("Failed to notify start-deployment event of %s (%s): %v", proj.Name, env.Name, err)
+		}
+	}
+
+	if timeout := config.DeployTimeout(proj, env); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	state, err := h.run(ctx, &entry, env)
+	if err != nil {
+		glog.Errorf("Could not run deployment command: %v", err)
+	}
+	if state != history.StateSucceeded && ctx.Err() == context.DeadlineExceeded {
+		glog.Errorf("Deployment %s of %s-%s timed out", entry.ID, proj.Name, env.Name)
+		state, entry.Reason = history.StateFailed, history.ReasonTimeout
+	}
+	if state == history.StateSucceeded && env.HealthCheck != nil && !h.running.cancelled(entry.ID) {
+		hctx, stop := h.running.watch(context.Background(), entry.ID)
+		entry.Health = h.checkHealth(hctx, c, env, entry)
+		stop()
+		// A cancelled health check neither fails the deployment nor rolls it back.
+		if !entry.Health.Passed && !h.running.cancelled(entry.ID) {
+			state, entry.Reason = history.StateFailed, history.ReasonHealthCheckFailed
+			if env.HealthCheck.Rollback {
+				h.autoRollback(c, proj, env, &entry)
+			}
+		}
+	}
+	if by := h.running.remove(entry.ID); by != "" {
+		state, entry.CancelledBy = history.StateCancelled, by
+	}
+	entry.Finish(state, time.Now())
+	success := state == history.StateSucceeded
+	if success {
 		glog.Infof("Successfully deployed %s", proj.Name)
 	}
 	if c.Notify != "" {
-		err = endNotify(c.Notify, proj.Name, env.Name, success)
+		err = endNotify(c.Notify, entry)
 		if err != nil {
 			glog.Errorf("Failed to notify start-deployment event of %s (%s): %v", proj.Name, env.Name, err)
 		}
 	}
 
+	repo := proj.SourceRepo()
 	if (c.Pivotal.Token != "") && success {
 		err := config.PostToPivotal(c.Pivotal, env.Name, repo.RepoOwner, repo.RepoName, string(deploy.From), string(deploy.To))
 		if err != nil {
@@ -146,67 +403,188 @@ func (h DeployHandler) deploy(ctx context.Context, w http.ResponseWriter, c conf
 		}
 	}
 
-	err = h.insertEntry(ctx, proj, env, deploy, src, user, success, deployTime)
+	if err := h.store.Update(entry); err != nil {
+		glog.Errorf("Failed to update the entry %s: %v", entry.ID, err)
+	}
+	h.outputs.close(entry.ID)
+	broadcastEvent(h.hub, entry, string(entry.State), user)
+}
+
+// run runs the deploy command of "env" between its hooks and returns the final state of the deployment.
+// If "env" configures a rollout, the command runs for each batch of hosts and the progress is recorded in "entry".
+// The command is terminated when "ctx" is done.
+// It returns an error if it fails to start the command.
+func (h DeployHandler) run(ctx context.Context, entry *history.Entry, env config.Environment) (history.State, error) {
+	if h.running.cancelled(entry.ID) {
+		return history.StateCancelled, nil
+	}
+	if !h.runHooks(ctx, entry, env, preDeploy, env.PreDeploy) {
+		return history.StateFailed, nil
+	}
+	if len(env.PreDeploy) > 0 || len(env.PostDeploy) > 0 {
+		h.writeLine(*entry, sectionMarker("deploy", ""))
+	}
+	state, err := h.runDeploy(ctx, entry, env)
+	if state != history.StateSucceeded {
+		return state, err
+	}
+	if !h.runHooks(ctx, entry, env, postDeploy, env.PostDeploy) {
+		return history.StateFailed, nil
+	}
+	return state, nil
+}
+
+// runDeploy runs the deploy command of "env" for the deployment "entry".
+func (h DeployHandler) runDeploy(ctx context.Context, entry *history.Entry, env config.Environment) (history.State, error) {
+	if env.Rollout != nil {
+		return h.rollout(ctx, entry, env)
+	}
+	argv, err := deployCommand(env, *entry)
 	if err != nil {
-		glog.Errorf("Failed to insert an entry: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		glog.Errorf("Invalid deploy command of %s-%s: %v", entry.Project, entry.Environment, err)
+		return history.StateFailed, err
 	}
+	glog.Infof("Starting deployment %s of %s-%s from %s to %s; requested by %s", entry.ID, entry.Project, entry.Environment, entry.Range.From, entry.Range.To, entry.User)
+	return h.execute(ctx, *entry, env, argv)
 }
 
-func (h DeployHandler) sendOutput(wg *sync.WaitGroup, scanner *bufio.Scanner, p, e string, deployTime time.Time) {
-	defer wg.Done()
-	for scanner.Scan() {
-		t := scanner.Text()
-		msg := struct {
-			Project     string
-			Environment string
-			StdoutLine  string
-		}{p, e, stripANSICodes(strings.TrimSpace(t))}
-		cmdOutput, err := json.Marshal(msg)
-		if err != nil {
-			glog.Errorf("Failed to marshal output into JSON: %v", err)
+// execute runs "argv" for the deployment "entry" into the hosts of "env" and streams its output.
+// It returns history.StateSucceeded iff the command successfully exits.
+// The command is terminated when "ctx" is done.
+func (h DeployHandler) execute(ctx context.Context, entry history.Entry, env config.Environment, argv []string) (history.State, error) {
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Env = append(os.Environ(), deployEnv(env, entry)...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		glog.Errorf("Could not get stdout of command: %v", err)
+		return history.StateFailed, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		glog.Errorf("Could not get stderr of command: %v", err)
+		return history.StateFailed, err
+	}
+	proc, err := process.Start(cmd)
+	if err != nil {
+		return history.StateFailed, err
+	}
+	h.running.attach(entry.ID, proc)
+	exited := make(chan struct{})
+	defer close(exited)
+	go func() {
+		select {
+		case <-ctx.Done():
+			glog.Warningf("Terminating deployment %s: %v", entry.ID, ctx.Err())
+			proc.Terminate(h.running.grace)
+		case <-exited:
 		}
-		h.hub.Broadcast(string(cmdOutput))
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go h.sendOutput(&wg, stdout, entry, output.Stdout)
+	go h.sendOutput(&wg, stderr, entry, output.Stderr)
+	wg.Wait()
+
+	if err := proc.Wait(); err != nil {
+		glog.Errorf("Deployment %s of %s failed: %q exited with %v", entry.ID, entry.Project, argv[0], err)
+		return history.StateFailed, nil
+	}
+	return history.StateSucceeded, nil
+}
 
-		go appendDeployOutput(fmt.Sprintf("%s-%s", p, e), t, deployTime)
+func (h DeployHandler) sendOutput(wg *sync.WaitGroup, r io.Reader, entry history.Entry, s output.Stream) {
+	defer wg.Done()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		h.writeOutput(entry, s, scanner.Text())
 	}
 	if err := scanner.Err(); err != nil {
 		glog.Errorf("Failed to scan deploy output: %v", err)
-		return
+		// Keeps reading so that the command does not block on the full pipe.
+		io.Copy(ioutil.Discard, r)
 	}
 }
 
-func stripANSICodes(t string) string {
-	ansi := regexp.MustCompile(`\x1B\[[0-9;]{1,4}[mK]`)
-	return ansi.ReplaceAllString(t, "")
+// writeLine sends a message of Goship about the deployment "entry" to its subscribers and appends it to the output log.
+func (h DeployHandler) writeLine(entry history.Entry, line string) {
+	h.writeOutput(entry, output.System, line)
 }
 
-func appendDeployOutput(env string, output string, timestamp time.Time) {
-	logDir := path.Join(*dataPath, env)
-	path := path.Join(logDir, timestamp.String()+".log")
+// writeOutput sends a line which was written to "s" in the deployment "entry" to its subscribers and appends it to the output log.
+// Lines after the output reaches its limit are discarded, and the truncation marker is sent instead of the first of them.
+func (h DeployHandler) writeOutput(entry history.Entry, s output.Stream, line string) {
+	switch err := h.outputs.writeLine(entry, s, line); err {
+	case nil:
+	case output.ErrTruncated:
+		return
+	case errOutputClosed:
+		glog.Warningf("Discarded a line of output of %s written after it was closed", entry.ID)
+		return
+	case output.ErrLimitReached:
+		glog.Warningf("Truncated output of %s", entry.ID)
+		s, line = output.System, output.TruncationMarker(h.outputs.limit(entry.ID))
+	default:
+		glog.Errorf("Failed to write output of %s: %v", entry.ID, err)
+	}
 
-	if _, err := os.Stat(logDir); err != nil {
-		if os.IsNotExist(err) {
-			err := os.Mkdir(logDir, 0755)
-			if err != nil {
-				fmt.Printf("ERROR: %s", err)
-			}
-		}
+	msg := struct {
+		Project     string
+		Environment string
+		DeployID    string
+		Stream      output.Stream
+		StdoutLine  string
+	}{entry.Project, entry.Environment, entry.ID, s, stripANSICodes(strings.TrimSpace(line))}
+	cmdOutput, err := json.Marshal(msg)
+	if err != nil {
+		glog.Errorf("Failed to marshal output into JSON: %v", err)
 	}
+	h.hub.Publish(deployTopic(entry), string(cmdOutput))
+}
 
-	out, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+// broadcastEvent notifies subscribers of a change of the state of the deployment "e".
+// The messages of "e" are no longer replayed to new subscribers once "e" has finished.
+func broadcastEvent(hub *notification.Hub, e history.Entry, event, user string) {
+	msg := struct {
+		Project     string
+		Environment string
+		DeployID    string
+		Event       string
+		User        string
+	}{e.Project, e.Environment, e.ID, event, user}
+	buf, err := json.Marshal(msg)
 	if err != nil {
-		fmt.Printf("ERROR: %s", err)
+		glog.Errorf("Failed to marshal event into JSON: %v", err)
+		return
+	}
+	hub.Publish(deployTopic(e), string(buf))
+	if e.State.Finished() {
+		hub.Finish(e.ID)
 	}
+}
 
-	defer out.Close()
+// deployTopic returns the topic of messages about the deployment "e".
+func deployTopic(e history.Entry) notification.Topic {
+	return notification.Topic{Project: e.Project, Environment: e.Environment, DeployID: e.ID}
+}
 
-	io.WriteString(out, output+"\n")
+func stripANSICodes(t string) string {
+	ansi := regexp.MustCompile(`\x1B\[[0-9;]{1,4}[mK]`)
+	return ansi.ReplaceAllString(t, "")
 }
 
-func startNotify(n, user, p, env string) error {
-	msg := fmt.Sprintf("%s is deploying %s to *%s*.", user, p, env)
+func startNotify(n string, e history.Entry) error {
+	msg := fmt.Sprintf("%s is deploying %s to *%s*.", e.User, e.Project, e.Environment)
+	switch {
+	case e.Forced:
+		msg = fmt.Sprintf("%s is force-deploying %s to locked *%s*.", e.User, e.Project, e.Environment)
+	case e.RollbackOf != "":
+		msg = fmt.Sprintf("%s is rolling back %s on *%s* to %s.", e.User, e.Project, e.Environment, e.Range.To)
+	case e.PromotedFrom != "":
+		msg = fmt.Sprintf("%s is promoting %s from *%s* to *%s*.", e.User, e.Project, e.PromotedFrom, e.Environment)
+	case e.Approval != nil && e.Approval.Approved():
+		msg = fmt.Sprintf("%s is deploying %s to *%s* (approved by %s).", e.User, e.Project, e.Environment, e.Approval.ApprovedBy)
+	}
 	err := notify(n, msg)
 	if err != nil {
 		return err
@@ -223,10 +601,23 @@ func notify(n, msg string) error {
 	return nil
 }
 
-func endNotify(n, p, env string, success bool) error {
-	msg := fmt.Sprintf("%s successfully deployed to *%s*.", p, env)
-	if !success {
-		msg = fmt.Sprintf("%s deployment to *%s* failed.", p, env)
+func endNotify(n string, e history.Entry) error {
+	var msg string
+	switch e.State {
+	case history.StateSucceeded:
+		msg = fmt.Sprintf("%s successfully deployed to *%s*.", e.Project, e.Environment)
+	case history.StateCancelled:
+		msg = fmt.Sprintf("%s deployment to *%s* was cancelled by %s.", e.Project, e.Environment, e.CancelledBy)
+	default:
+		msg = fmt.Sprintf("%s deployment to *%s* failed.", e.Project, e.Environment)
+		if e.Reason != "" {
+			msg = fmt.Sprintf("%s deployment to *%s* failed (%s).", e.Project, e.Environment, e.Reason)
+		}
+		if e.RolledBackBy != "" {
+			msg += " Rolling back to the previous revision."
+		} else if e.RollbackError != "" {
+			msg += " Rollback failed: " + e.RollbackError
+		}
 	}
 	err := notify(n, msg)
 	if err != nil {
@@ -235,30 +626,75 @@ func endNotify(n, p, env string, success bool) error {
 	return nil
 }
 
-// deployCommand returns the deployment command for a given
-// environment as a string slice that has been split on spaces.
-func deployCommand(e config.Environment) []string {
-	// TODO(yugui) better handling of shell escape
-	return strings.Split(e.Deploy, " ")
+// deployCommand returns argv of the deploy command of "env" for the deployment "entry".
+// Template actions in the command are expanded with the attributes of "entry".
+func deployCommand(env config.Environment, entry history.Entry) ([]string, error) {
+	args := env.DeployArgs
+	if len(args) == 0 {
+		var err error
+		if args, err = command.Split(env.Deploy); err != nil {
+			return nil, err
+		}
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("no deploy command configured for %s-%s", entry.Project, entry.Environment)
+	}
+	return renderCommand(args, env, entry)
 }
 
-func (h DeployHandler) insertEntry(ctx context.Context, proj config.Project, env config.Environment, deploy, src RevRange, user string, success bool, time time.Time) error {
-	basename := fmt.Sprintf("%s-%s", proj.Name, env.Name)
-	path := path.Join(*dataPath, basename+".json")
-	err := prepareDataFiles(path)
-	if err != nil {
-		return err
-	}
+// renderCommand expands template actions in "args" with the attributes of "entry" and the hosts of "env".
+func renderCommand(args []string, env config.Environment, entry history.Entry) ([]string, error) {
+	return command.Render(args, command.Vars{
+		Project:      entry.Project,
+		Env:          entry.Environment,
+		FromRevision: string(entry.Range.From),
+		ToRevision:   string(entry.Range.To),
+		User:         entry.User,
+		Hosts:        command.Hosts(env.Hosts),
+	})
+}
 
-	e, err := readEntries(basename)
-	if err != nil {
-		return err
+// deployEnv returns environment variables of the deploy command of "env" for the deployment "entry".
+// The variables configured in "env" are followed by GOSHIP_* variables which describe "entry".
+func deployEnv(env config.Environment, entry history.Entry) []string {
+	var keys []string
+	for k := range env.Env {
+		keys = append(keys, k)
 	}
+	sort.Strings(keys)
+	var vars []string
+	for _, k := range keys {
+		vars = append(vars, fmt.Sprintf("%s=%s", k, env.Env[k]))
+	}
+	var src history.RevRange
+	if entry.SourceRange != nil {
+		src = *entry.SourceRange
+	}
+	for _, v := range []struct {
+		name, value string
+	}{
+		{"GOSHIP_DEPLOY_ID", entry.ID},
+		{"GOSHIP_PROJECT", entry.Project},
+		{"GOSHIP_ENV", entry.Environment},
+		{"GOSHIP_FROM_REVISION", string(entry.Range.From)},
+		{"GOSHIP_TO_REVISION", string(entry.Range.To)},
+		{"GOSHIP_FROM_SOURCE_REVISION", string(src.From)},
+		{"GOSHIP_TO_SOURCE_REVISION", string(src.To)},
+		{"GOSHIP_USER", entry.User},
+		{"GOSHIP_HOSTS", strings.Join(env.Hosts, ",")},
+	} {
+		vars = append(vars, fmt.Sprintf("%s=%s", v.name, v.value))
+	}
+	return vars
+}
 
+// newEntry returns a new entry of deploy history.
+func newEntry(ctx context.Context, ctrl revision.SourceControl, proj config.Project, env config.Environment, deploy, src history.RevRange, user string, t time.Time) history.Entry {
 	repo := proj.SourceRepo()
 	var msg string
 	if src.To != "" {
-		msg, err = h.ctrl.SourceRevMessage(ctx, proj, src.To)
+		var err error
+		msg, err = ctrl.SourceRevMessage(ctx, proj, src.To)
 		if err != nil {
 			glog.Errorf("Failed to get commit %s (%s/%s): %v", src.To, repo.RepoOwner, repo.RepoName, err)
 			msg = ""
@@ -266,44 +702,20 @@ func (h DeployHandler) insertEntry(ctx context.Context, proj config.Project, env
 	}
 	var diffURL string
 	if src.From != "" && src.To != "" {
-		diffURL = h.ctrl.SourceDiffURL(proj, src.From, src.To)
+		diffURL = ctrl.SourceDiffURL(proj, src.From, src.To)
 	}
-	d := DeployLogEntry{
+	e := history.Entry{
+		ID:            history.NewID(t),
+		Project:       proj.Name,
+		Environment:   env.Name,
 		Range:         deploy,
 		DiffURL:       diffURL,
 		ToRevisionMsg: msg,
 		User:          user,
-		Time:          time,
-		Success:       success,
-	}
-	e = append(e, d)
-	err = writeJSON(e, path)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-func prepareDataFiles(path string) error {
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		_, err := os.Create(path)
-		if err != nil {
-			return err
-		}
-		err = writeJSON([]DeployLogEntry{}, path)
-		if err != nil {
-			return err
-		}
+		Time:          t,
 	}
-
-	return nil
-}
-
-func writeJSON(d []DeployLogEntry, file string) error {
-	b, err := json.Marshal(d)
-	if err != nil {
-		return err
+	if src.From != "" || src.To != "" {
+		e.SourceRange = &src
 	}
-
-	return ioutil.WriteFile(file, b, 0755)
+	return e
 }
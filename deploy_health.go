@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gengo/goship/lib/config"
+	"github.com/gengo/goship/lib/health"
+	"github.com/gengo/goship/lib/history"
+	"github.com/gengo/goship/lib/ssh"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// checkHealth runs the health check of "env" after the deployment "entry" and reports the progress in its output.
+// The check stops when "ctx" is done.
+func (h DeployHandler) checkHealth(ctx context.Context, c config.Config, env config.Environment, entry history.Entry) *health.Result {
+	var cmd health.Commander
+	if env.HealthCheck.Command != "" {
+		s, err := ssh.WithPrivateKeyFile(c.DeployUser, *keyPath)
+		if err != nil {
+			glog.Errorf("Failed to load the SSH key: %v", err)
+			return &health.Result{Error: err.Error(), Time: time.Now()}
+		}
+		cmd = s
+	}
+	h.writeLine(entry, "Checking health of the environment")
+	res := health.Run(ctx, *env.HealthCheck, env.Hosts, cmd)
+	if res.Passed {
+		h.writeLine(entry, fmt.Sprintf("Health check passed after %d attempt(s)", res.Attempts))
+	} else {
+		glog.Errorf("Health check of %s-%s failed after deployment %s: %s", entry.Project, entry.Environment, entry.ID, res.Error)
+		h.writeLine(entry, fmt.Sprintf("Health check failed after %d attempt(s): %s", res.Attempts, res.Error))
+	}
+	return &res
+}
+
+// autoRollback starts a deployment which rolls back "env" to the latest successful deployment after the deployment "entry".
+// The rollback runs next to "entry" regardless of the limit of the deploy queue, and neither freeze windows nor approvals apply.
+// It records the ID of the new deployment in "entry", or why the rollback could not start.
+// Rollbacks are not rolled back again to avoid loops.
+func (h DeployHandler) autoRollback(c config.Config, proj config.Project, env config.Environment, entry *history.Entry) {
+	if entry.RollbackOf != "" {
+		glog.Warningf("Not rolling back deployment %s which is itself a rollback", entry.ID)
+		return
+	}
+	fail := func(err error) {
+		entry.RollbackError = err.Error()
+		h.writeLine(*entry, fmt.Sprintf("Failed to roll back: %v", err))
+	}
+	prev, err := currentDeploy(h.store, entry.Project, entry.Environment)
+	if err != nil {
+		glog.Errorf("No deployment of %s-%s to roll back to: %v", entry.Project, entry.Environment, err)
+		fail(fmt.Errorf("no deployment to roll back to: %v", err))
+		return
+	}
+	req := deployRequest{
+		Project:     entry.Project,
+		Environment: entry.Environment,
+		Range:       history.RevRange{From: entry.Range.To, To: prev.Range.To},
+		User:        entry.User,
+		Force:       entry.Forced,
+		RollbackOf:  prev.ID,
+	}
+	if entry.SourceRange != nil {
+		req.SourceRange.From = entry.SourceRange.To
+	}
+	d, err := h.build(context.Background(), c, proj, env, req)
+	if err == nil {
+		_, err = h.enqueue(c, proj, env, d.entry, true)
+	}
+	if err != nil {
+		glog.Errorf("Failed to roll back %s-%s to %s: %v", entry.Project, entry.Environment, prev.ID, err)
+		fail(fmt.Errorf("failed to roll back to %s: %v", prev.ID, err))
+		return
+	}
+	rb := d.entry
+	glog.Infof("Rolling back %s-%s to %s by %s after failed health check of %s", entry.Project, entry.Environment, prev.ID, rb.ID, entry.ID)
+	h.writeLine(*entry, fmt.Sprintf("Rolling back to %s (%s) by %s", prev.ID, prev.Range.To, rb.ID))
+	entry.RolledBackBy = rb.ID
+}
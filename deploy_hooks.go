@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/gengo/goship/lib/command"
+	"github.com/gengo/goship/lib/config"
+	"github.com/gengo/goship/lib/history"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// hookPhase is when hooks run.
+type hookPhase string
+
+const (
+	preDeploy  = hookPhase("pre_deploy")
+	postDeploy = hookPhase("post_deploy")
+)
+
+// runHooks runs "hooks" in "phase" of the deployment "entry" in order.
+// Failures of hooks are handled according to their policies.
+// It returns false if the deployment must not continue.
+func (h DeployHandler) runHooks(ctx context.Context, entry *history.Entry, env config.Environment, phase hookPhase, hooks []config.Hook) bool {
+	for _, hook := range hooks {
+		if ctx.Err() != nil || h.running.cancelled(entry.ID) {
+			return false
+		}
+		h.writeLine(*entry, sectionMarker(string(phase), hook.String()))
+		state, err := h.runHook(ctx, *entry, env, hook)
+		if state == history.StateSucceeded {
+			continue
+		}
+		if ctx.Err() != nil || h.running.cancelled(entry.ID) {
+			return false
+		}
+		if err == nil {
+			err = fmt.Errorf("command exited with failure")
+		}
+
+		switch hook.Policy() {
+		case config.HookIgnore:
+			glog.Infof("Ignoring failure of %s hook %q of deployment %s: %v", phase, hook, entry.ID, err)
+		case config.HookWarn:
+			msg := fmt.Sprintf("%s hook %q failed", phase, hook)
+			glog.Warningf("%s in deployment %s: %v", msg, entry.ID, err)
+			h.writeLine(*entry, "WARNING: "+msg)
+			entry.Warnings = append(entry.Warnings, msg)
+		default:
+			glog.Errorf("%s hook %q of deployment %s failed: %v", phase, hook, entry.ID, err)
+			h.writeLine(*entry, fmt.Sprintf("%s hook %q failed; aborting", phase, hook))
+			entry.Reason = history.ReasonPreDeployFailed
+			if phase == postDeploy {
+				entry.Reason = history.ReasonPostDeployFailed
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// runHook runs the command of "hook" for the deployment "entry".
+func (h DeployHandler) runHook(ctx context.Context, entry history.Entry, env config.Environment, hook config.Hook) (history.State, error) {
+	args, err := command.Split(hook.Command)
+	if err != nil {
+		return history.StateFailed, err
+	}
+	if len(args) == 0 {
+		return history.StateFailed, fmt.Errorf("empty command")
+	}
+	argv, err := renderCommand(args, env, entry)
+	if err != nil {
+		return history.StateFailed, err
+	}
+	return h.execute(ctx, entry, env, argv)
+}
+
+// sectionMarker returns a line which marks the beginning of a section in deploy outputs.
+func sectionMarker(section, name string) string {
+	if name == "" {
+		return fmt.Sprintf("===== %s =====", section)
+	}
+	return fmt.Sprintf("===== %s: %s =====", section, name)
+}
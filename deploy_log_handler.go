@@ -1,38 +1,52 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"html/template"
-	"io/ioutil"
 	"math"
 	"net/http"
-	"path"
-	"sort"
 	"time"
 
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/gengo/goship/lib/acl"
 	"github.com/gengo/goship/lib/auth"
 	"github.com/gengo/goship/lib/config"
-	"github.com/gengo/goship/lib/revision"
+	"github.com/gengo/goship/lib/history"
+	"github.com/gengo/goship/lib/schedule"
 	helpers "github.com/gengo/goship/lib/view-helpers"
 	"github.com/golang/glog"
 )
 
 // DeployLogHandler shows data about the environment including the deploy log.
+// It shows only the specified deployment if "deployID" is not empty.
 type DeployLogHandler struct {
+	ac     acl.AccessControl
+	ecl    *etcd.Client
 	assets helpers.Assets
+	store  history.DeployStore
 }
 
-func (h DeployLogHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, fullEnv string, environment config.Environment, projectName string) {
+func (h DeployLogHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, fullEnv string, environment config.Environment, proj config.Project, deployID string) {
 	u, err := auth.CurrentUser(r)
 	if err != nil {
 		glog.Errorf("Failed to get current user: %v", err)
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
-	d, err := readEntries(fullEnv)
-	if err != nil {
-		glog.Errorf("Failed to read entries: %v", err)
+	var d []history.Entry
+	if deployID != "" {
+		e, err := h.store.Get(deployID)
+		if err != nil {
+			glog.Errorf("Failed to read entry %s: %v", deployID, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		d = append(d, e)
+	} else {
+		d, err = h.store.List(proj.Name, environment.Name)
+		if err != nil {
+			glog.Errorf("Failed to read entries: %v", err)
+		}
 	}
 	t, err := template.New("deploy_log.html").ParseFiles("templates/deploy_log.html", "templates/base.html")
 	if err != nil {
@@ -43,21 +57,69 @@ func (h DeployLogHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, full
 	for i := range d {
 		d[i].FormattedTime = formatTime(d[i].Time)
 	}
-	sort.Sort(ByTime(d))
+	current, err := currentDeploy(h.store, proj.Name, environment.Name)
+	if err != nil {
+		glog.Errorf("Failed to find the current deployment of %s: %v", fullEnv, err)
+	}
+	schedules, err := envSchedules(h.ecl, proj.Name, environment.Name)
+	if err != nil {
+		glog.Errorf("Failed to list schedules of %s: %v", fullEnv, err)
+	}
+	repo := proj.SourceRepo()
+	deployable := h.ac.Deployable(repo.RepoOwner, repo.RepoName, u.Name)
+	// Rollback is available under the same conditions as the deploy button in the home page.
+	rollbackable := !environment.Locked() && deployable
 	js, css := h.assets.Templates()
 
 	params := map[string]interface{}{
-		"Javascript":  js,
-		"Stylesheet":  css,
-		"Deployments": d,
-		"User":        u,
-		"Env":         fullEnv,
-		"Environment": environment,
-		"ProjectName": projectName,
+		"Javascript":   js,
+		"Stylesheet":   css,
+		"Deployments":  d,
+		"User":         u,
+		"Env":          fullEnv,
+		"Environment":  environment,
+		"Project":      proj,
+		"ProjectName":  proj.Name,
+		"DeployID":     deployID,
+		"Current":      current,
+		"Rollbackable": rollbackable,
+		"Deployable":   deployable,
+		"Schedules":    schedules,
+		"Now":          time.Now(),
 	}
 	helpers.RespondWithTemplate(w, "text/html", t, "base", params)
 }
 
+// currentDeploy returns the latest successful deployment into the environment.
+// It returns history.ErrNotFound if there is no such deployment.
+func currentDeploy(store history.DeployStore, proj, env string) (history.Entry, error) {
+	entries, err := store.List(proj, env)
+	if err != nil {
+		return history.Entry{}, err
+	}
+	for _, e := range entries {
+		if e.State == history.StateSucceeded {
+			return e, nil
+		}
+	}
+	return history.Entry{}, history.ErrNotFound
+}
+
+// envSchedules returns pending scheduled deployments into the environment.
+func envSchedules(client config.ETCDInterface, proj, env string) ([]schedule.Schedule, error) {
+	all, err := schedule.List(client)
+	if err != nil {
+		return nil, err
+	}
+	var schedules []schedule.Schedule
+	for _, s := range all {
+		if s.Project == proj && s.Environment == env {
+			schedules = append(schedules, s)
+		}
+	}
+	return schedules, nil
+}
+
 func formatTime(t time.Time) string {
 	s := time.Since(t)
 	switch {
@@ -84,42 +146,3 @@ func formatTime(t time.Time) string {
 		return t.Format(layout)
 	}
 }
-
-func readEntries(env string) ([]DeployLogEntry, error) {
-	var d []DeployLogEntry
-	b, err := ioutil.ReadFile(path.Join(*dataPath, env+".json"))
-	if err != nil {
-		return d, err
-	}
-	if len(b) == 0 {
-		glog.Errorf("No deploy logs found for: %s", env)
-		return []DeployLogEntry{}, nil
-	}
-	err = json.Unmarshal(b, &d)
-	if err != nil {
-		return d, err
-	}
-
-	return d, nil
-}
-
-type RevRange struct {
-	From revision.Revision `json:"from"`
-	To   revision.Revision `json:"to"`
-}
-
-type DeployLogEntry struct {
-	Range         RevRange `json:"range"`
-	DiffURL       string
-	ToRevisionMsg string
-	User          string
-	Success       bool
-	Time          time.Time
-	FormattedTime string `json:",omitempty"`
-}
-
-type ByTime []DeployLogEntry
-
-func (d ByTime) Len() int           { return len(d) }
-func (d ByTime) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
-func (d ByTime) Less(i, j int) bool { return d[i].Time.After(d[j].Time) }
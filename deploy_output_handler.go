@@ -1,19 +1,228 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"os"
 	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gengo/goship/lib/auth"
+	"github.com/gengo/goship/lib/config"
+	"github.com/gengo/goship/lib/history"
+	"github.com/gengo/goship/lib/output"
+	"github.com/golang/glog"
 )
 
-func DeployOutputHandler(w http.ResponseWriter, r *http.Request, env string, formattedTime string) {
-	log := path.Join(*dataPath, env, formattedTime+".log")
+// DeployOutputHandler serves the output of a deploy command.
+// i.e. http://127.0.0.1:8000/output/<deploy ID>?format=html
+//
+// The format is one of "text" (default), "json" (JSON lines) and "html".
+// Users can read only outputs of projects which they can read.
+type DeployOutputHandler struct {
+	dh DeployHandler
+}
+
+func (h DeployOutputHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/output/")
+	if id == "" || strings.Contains(id, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	u, err := auth.CurrentUser(r)
+	if err != nil {
+		glog.Errorf("Failed to get current user: %v", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	e, err := APIHandler{dh: h.dh}.loadDeploy(u, id)
+	if err != nil {
+		if re, ok := err.(requestError); ok {
+			http.Error(w, re.msg, re.status)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	b, err := ioutil.ReadFile(log)
+	l, err := readDeployLog(e)
+	if os.IsNotExist(err) {
+		http.Error(w, fmt.Sprintf("no output of %s; it may have been removed by the retention policy", id), http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	switch format := r.FormValue("format"); format {
+	case "", "text":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		err = output.WriteText(w, l)
+	case "json":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		err = output.WriteJSON(w, l)
+	case "html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, "<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>Output of %s</title><style>%s</style></head><body>\n", id, output.Stylesheet)
+		if err = output.WriteHTML(w, l); err == nil {
+			fmt.Fprint(w, "\n</body></html>\n")
+		}
+	default:
+		http.Error(w, fmt.Sprintf("unknown format %q", format), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		glog.Errorf("Failed to write output of %s: %v", id, err)
+	}
+}
+
+// deployOutputPath returns the path to the output file of the deployment "e".
+func deployOutputPath(e history.Entry) string {
+	return filepath.Join(*dataPath, e.Project+"-"+e.Environment, e.ID+".out")
+}
 
-	w.Write(b)
+// deployOutputFiles returns the paths to the files which can keep the output of the deployment "e" in the order of preference.
+// Each path is followed by that of its compressed file.
+func deployOutputFiles(e history.Entry) []string {
+	// Outputs recorded by older versions of Goship are plain text.
+	// Those of deployments before deploy IDs were introduced are named after the time of the deployment.
+	dir := path.Join(*dataPath, e.Project+"-"+e.Environment)
+	names := []string{deployOutputPath(e)}
+	for _, name := range []string{e.ID, e.Time.String(), e.Time.Local().String()} {
+		names = append(names, path.Join(dir, name+".log"))
+	}
+
+	var files []string
+	for _, name := range names {
+		files = append(files, name, name+output.CompressedExt)
+	}
+	return files
+}
+
+// readDeployLog reads the output of the deploy command of "e".
+// It returns an error which satisfies os.IsNotExist if there is no output of "e".
+func readDeployLog(e history.Entry) (output.Log, error) {
+	var err error
+	for _, name := range deployOutputFiles(e) {
+		var r io.ReadCloser
+		r, err = output.Open(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return output.Log{}, err
+		}
+		defer r.Close()
+		if filepath.Ext(strings.TrimSuffix(name, output.CompressedExt)) == ".out" {
+			return output.Read(r)
+		}
+
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return output.Log{}, err
+		}
+		l := output.Log{Start: e.Time}
+		for _, line := range strings.SplitAfter(string(b), "\n") {
+			if line != "" {
+				l.Lines = append(l.Lines, output.Line{Stream: output.Stdout, Text: strings.TrimSuffix(line, "\n")})
+			}
+		}
+		return l, nil
+	}
+	return output.Log{}, err
+}
+
+// readDeployOutput reads the output of the deploy command of "e" as plain text.
+func readDeployOutput(e history.Entry) ([]byte, error) {
+	l, err := readDeployLog(e)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := output.WriteText(&buf, l); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// deployOutputs keeps the output writers of running deployments.
+type deployOutputs struct {
+	mu      sync.Mutex
+	writers map[string]*output.Writer
+}
+
+// newDeployOutputs returns a new deployOutputs.
+func newDeployOutputs() *deployOutputs {
+	return &deployOutputs{writers: make(map[string]*output.Writer)}
+}
+
+// outputLimit returns the maximum size of the outputs of deployments in "proj".
+func outputLimit(proj config.Project) int64 {
+	if r := proj.Retention; r != nil && r.MaxOutputSize > 0 {
+		return r.MaxOutputSize
+	}
+	return *maxOutputSize
+}
+
+// open opens the output file of the deployment "e" and limits its size to "limit" bytes.
+func (o *deployOutputs) open(e history.Entry, limit int64) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	w, ok := o.writers[e.ID]
+	if !ok {
+		var err error
+		if w, err = output.Create(deployOutputPath(e), time.Now()); err != nil {
+			return err
+		}
+		o.writers[e.ID] = w
+	}
+	w.SetLimit(limit)
+	return nil
+}
+
+// limit returns the maximum size of the output of the deployment "id" in bytes.
+func (o *deployOutputs) limit(id string) int64 {
+	o.mu.Lock()
+	w, ok := o.writers[id]
+	o.mu.Unlock()
+	if !ok {
+		return 0
+	}
+	return w.Limit()
+}
+
+// errOutputClosed means that a line was discarded because the output of the deployment is not open.
+var errOutputClosed = errors.New("output is not open")
+
+// writeLine appends "text" written to "s" to the output of the deployment "e".
+// It returns errOutputClosed unless the output of "e" has been opened by open and not closed yet.
+func (o *deployOutputs) writeLine(e history.Entry, s output.Stream, text string) error {
+	o.mu.Lock()
+	w, ok := o.writers[e.ID]
+	o.mu.Unlock()
+	if !ok {
+		return errOutputClosed
+	}
+	return w.WriteLine(s, text)
+}
+
+// close closes the output file of the deployment "id" if it is open.
+func (o *deployOutputs) close(id string) {
+	o.mu.Lock()
+	w, ok := o.writers[id]
+	delete(o.writers, id)
+	o.mu.Unlock()
+	if !ok {
+		return
+	}
+	if err := w.Close(); err != nil {
+		glog.Errorf("Failed to close output of %s: %v", id, err)
+	}
 }
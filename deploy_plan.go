@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gengo/goship/lib/command"
+	"github.com/gengo/goship/lib/config"
+	"github.com/gengo/goship/lib/history"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// dryRunID is the deploy ID in dry-run plans. The real ID is assigned when the deployment is requested.
+const dryRunID = "DRY-RUN"
+
+// deployPlan describes what a deployment would do. It is built without running anything.
+type deployPlan struct {
+	Project     string            `json:"project"`
+	Environment string            `json:"environment"`
+	Range       history.RevRange  `json:"range"`
+	SourceRange *history.RevRange `json:"source_range,omitempty"`
+	// RevisionURL is an URL to a human-readable resource which describes Range.To.
+	RevisionURL string `json:"revision_url,omitempty"`
+	DiffURL     string `json:"diff_url,omitempty"`
+	// ToRevisionMsg is the commit message of the source revision to deploy.
+	ToRevisionMsg string `json:"to_revision_msg,omitempty"`
+	// Command is argv of the deploy command.
+	// It is the command for the first batch if the environment configures a rollout.
+	Command []string `json:"command"`
+	// Env is the environment variables which Goship passes to the deploy command
+	// in addition to its own environment.
+	Env []string `json:"env"`
+	// Hosts are the deploy targets.
+	Hosts []string `json:"hosts"`
+	// Batches are the batches of hosts if the environment configures a rollout.
+	Batches [][]string `json:"batches,omitempty"`
+	// Hooks are the commands which run before and after the deploy command.
+	Hooks []plannedHook `json:"hooks,omitempty"`
+	// PivotalStories are the IDs of Pivotal Tracker stories which would be commented on.
+	PivotalStories []int `json:"pivotal_stories,omitempty"`
+	// RequiresApproval is true if the deployment would need approval by another user.
+	RequiresApproval bool `json:"requires_approval,omitempty"`
+	// Forced is true if the deployment would be forced into the locked environment.
+	Forced bool `json:"forced,omitempty"`
+	// Warnings describe parts of the plan which could not be resolved.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// plannedHook is a hook in a deployPlan.
+type plannedHook struct {
+	Phase     hookPhase         `json:"phase"`
+	Name      string            `json:"name"`
+	Command   []string          `json:"command"`
+	OnFailure config.HookPolicy `json:"on_failure"`
+}
+
+// plan validates "req" in the same way as start and returns the plan of the deployment.
+// Nothing is recorded or executed.
+func (h DeployHandler) plan(ctx context.Context, req deployRequest) (deployPlan, error) {
+	d, err := h.prepare(ctx, req)
+	if err != nil {
+		return deployPlan{}, err
+	}
+	return buildPlan(d), nil
+}
+
+// buildPlan returns the plan of the prepared deployment "d".
+func buildPlan(d preparedDeploy) deployPlan {
+	entry, env := d.entry, d.env
+	entry.ID = dryRunID
+
+	p := deployPlan{
+		Project:          entry.Project,
+		Environment:      entry.Environment,
+		Range:            entry.Range,
+		SourceRange:      entry.SourceRange,
+		RevisionURL:      d.ctrl.RevisionURL(d.proj, entry.Range.To),
+		DiffURL:          entry.DiffURL,
+		ToRevisionMsg:    entry.ToRevisionMsg,
+		Hosts:            env.Hosts,
+		RequiresApproval: env.RequiresApproval,
+		Forced:           entry.Forced,
+	}
+	cmdEnv := env
+	if env.Rollout != nil {
+		p.Batches = env.Rollout.Batches(env.Hosts)
+		if len(p.Batches) > 0 {
+			cmdEnv.Hosts = p.Batches[0]
+		}
+	}
+	var err error
+	if p.Command, err = deployCommand(cmdEnv, entry); err != nil {
+		p.Warnings = append(p.Warnings, fmt.Sprintf("invalid deploy command: %v", err))
+	}
+	p.Env = deployEnv(cmdEnv, entry)
+
+	for _, hooks := range []struct {
+		phase hookPhase
+		hooks []config.Hook
+	}{
+		{preDeploy, env.PreDeploy},
+		{postDeploy, env.PostDeploy},
+	} {
+		for _, hook := range hooks.hooks {
+			ph := plannedHook{Phase: hooks.phase, Name: hook.String(), OnFailure: hook.Policy()}
+			if args, err := command.Split(hook.Command); err != nil {
+				p.Warnings = append(p.Warnings, fmt.Sprintf("invalid %s hook %q: %v", hooks.phase, hook, err))
+			} else if ph.Command, err = renderCommand(args, cmdEnv, entry); err != nil {
+				p.Warnings = append(p.Warnings, fmt.Sprintf("invalid %s hook %q: %v", hooks.phase, hook, err))
+			}
+			p.Hooks = append(p.Hooks, ph)
+		}
+	}
+
+	if c := d.c; c.Pivotal != nil && c.Pivotal.Token != "" {
+		repo := d.proj.SourceRepo()
+		ids, err := config.GetPivotalIDFromCommits(repo.RepoOwner, repo.RepoName, string(entry.Range.From), string(entry.Range.To))
+		if err != nil {
+			glog.Errorf("Failed to get pivotal stories of %s..%s: %v", entry.Range.From, entry.Range.To, err)
+			p.Warnings = append(p.Warnings, fmt.Sprintf("failed to get pivotal stories: %v", err))
+		}
+		p.PivotalStories = ids
+	}
+	return p
+}
+
+// servePlan responds with the plan of the deployment "req" in JSON.
+func (h DeployHandler) servePlan(ctx context.Context, w http.ResponseWriter, req deployRequest) {
+	p, err := h.plan(ctx, req)
+	if re, ok := err.(requestError); ok {
+		http.Error(w, re.msg, re.status)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	buf, err := json.Marshal(p)
+	if err != nil {
+		glog.Errorf("Failed to marshal response: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/gengo/goship/lib/acl"
+	"github.com/gengo/goship/lib/auth"
+	"github.com/gengo/goship/lib/config"
+	"github.com/gengo/goship/lib/history"
+	"github.com/gengo/goship/lib/queue"
+	"github.com/golang/glog"
+)
+
+// DeployQueueHandler shows the deploy queue of an environment in JSON.
+// i.e. http://127.0.0.1:8000/deploy_queue?project=admin&environment=staging
+type DeployQueueHandler struct {
+	ac    acl.AccessControl
+	ecl   *etcd.Client
+	store history.DeployStore
+	queue *queue.Queue
+}
+
+// queuedDeploy is a deployment in a deploy queue.
+type queuedDeploy struct {
+	history.Entry
+	// Position is the position in the queue. The running deployment is at 0.
+	Position int `json:"position"`
+}
+
+func (h DeployQueueHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c, err := config.Load(h.ecl)
+	if err != nil {
+		glog.Errorf("Failed to fetch latest configuration: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	u, err := auth.CurrentUser(r)
+	if err != nil {
+		glog.Errorf("Failed to fetch current user: %v", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	projName, envName := r.FormValue("project"), r.FormValue("environment")
+	proj, err := config.ProjectFromName(c.Projects, projName)
+	if err != nil {
+		http.Error(w, "no such project", http.StatusNotFound)
+		return
+	}
+	repo := proj.SourceRepo()
+	if !h.ac.Readable(repo.RepoOwner, repo.RepoName, u.Name) {
+		http.Error(w, "permission denied", http.StatusForbidden)
+		return
+	}
+	if _, err := config.EnvironmentFromName(c.Projects, projName, envName); err != nil {
+		http.Error(w, "no such project/environment", http.StatusNotFound)
+		return
+	}
+
+	st := h.queue.Status(queueKey(projName, envName))
+	ids := st.Waiting
+	if st.Running != "" {
+		ids = append([]string{st.Running}, ids...)
+	}
+	deploys := []queuedDeploy{}
+	for _, id := range ids {
+		e, err := h.store.Get(id)
+		if err != nil {
+			glog.Errorf("Failed to get deploy %s: %v", id, err)
+			continue
+		}
+		deploys = append(deploys, queuedDeploy{Entry: e, Position: st.Position(id)})
+	}
+
+	buf, err := json.Marshal(deploys)
+	if err != nil {
+		glog.Errorf("Failed to marshal response: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/gengo/goship/lib/command"
+	"github.com/gengo/goship/lib/config"
+	"github.com/gengo/goship/lib/history"
+	"github.com/gengo/goship/lib/notification"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// rollout deploys the hosts of "env" in batches of env.Rollout.BatchSize hosts.
+// After each batch, it runs the verification command if any.
+// It stops at the first batch which fails and leaves the rest of the hosts pending.
+func (h DeployHandler) rollout(ctx context.Context, entry *history.Entry, env config.Environment) (history.State, error) {
+	entry.Hosts = make([]history.HostState, len(env.Hosts))
+	for i, host := range env.Hosts {
+		entry.Hosts[i] = history.HostState{Host: host, State: history.StatePending}
+	}
+	batches := env.Rollout.Batches(env.Hosts)
+	if len(batches) == 0 {
+		return history.StateFailed, fmt.Errorf("no hosts to roll out %s-%s to", entry.Project, entry.Environment)
+	}
+	var offset int
+	for i, batch := range batches {
+		if ctx.Err() != nil || h.running.cancelled(entry.ID) {
+			return history.StateFailed, nil
+		}
+		hosts := entry.Hosts[offset : offset+len(batch)]
+		offset += len(batch)
+
+		glog.Infof("Deploying batch %d/%d of deployment %s of %s-%s: %s", i+1, len(batches), entry.ID, entry.Project, entry.Environment, strings.Join(batch, ","))
+		h.setHostStates(*entry, hosts, history.StateRunning)
+		benv := env
+		benv.Hosts = batch
+		state, reason, err := h.runBatch(ctx, *entry, benv)
+		h.setHostStates(*entry, hosts, state)
+		if state != history.StateSucceeded {
+			if ctx.Err() == nil && !h.running.cancelled(entry.ID) {
+				entry.Reason = reason
+			}
+			glog.Errorf("Batch %d/%d of deployment %s failed; stopping the rollout", i+1, len(batches), entry.ID)
+			return state, err
+		}
+	}
+	return history.StateSucceeded, nil
+}
+
+// runBatch runs the deploy command and then the verification command for the hosts of "env".
+// It returns the reason of the failure if the batch fails.
+func (h DeployHandler) runBatch(ctx context.Context, entry history.Entry, env config.Environment) (history.State, string, error) {
+	argv, err := deployCommand(env, entry)
+	if err != nil {
+		glog.Errorf("Invalid deploy command of %s-%s: %v", entry.Project, entry.Environment, err)
+		return history.StateFailed, history.ReasonBatchFailed, err
+	}
+	if state, err := h.execute(ctx, entry, env, argv); state != history.StateSucceeded {
+		return state, history.ReasonBatchFailed, err
+	}
+	argv, err = verifyCommand(env, entry)
+	if err != nil {
+		glog.Errorf("Invalid verification command of %s-%s: %v", entry.Project, entry.Environment, err)
+		return history.StateFailed, history.ReasonVerificationFailed, err
+	}
+	if argv == nil {
+		return history.StateSucceeded, "", nil
+	}
+	if state, err := h.execute(ctx, entry, env, argv); state != history.StateSucceeded {
+		return state, history.ReasonVerificationFailed, err
+	}
+	return history.StateSucceeded, "", nil
+}
+
+// setHostStates sets "state" to "hosts" in the deployment "entry", records the progress and broadcasts it.
+// "hosts" must be a part of entry.Hosts.
+func (h DeployHandler) setHostStates(entry history.Entry, hosts []history.HostState, state history.State) {
+	for i := range hosts {
+		hosts[i].State = state
+		broadcastHostState(h.hub, entry, hosts[i])
+	}
+	if err := h.store.Update(entry); err != nil {
+		glog.Errorf("Failed to update the entry %s: %v", entry.ID, err)
+	}
+}
+
+// verifyCommand returns argv of the verification command of the rollout of "env".
+// It returns nil if "env" has no verification command.
+func verifyCommand(env config.Environment, entry history.Entry) ([]string, error) {
+	if env.Rollout == nil || env.Rollout.Verify == "" {
+		return nil, nil
+	}
+	args, err := command.Split(env.Rollout.Verify)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, nil
+	}
+	return renderCommand(args, env, entry)
+}
+
+// broadcastHostState notifies subscribers of the progress of a host in the deployment "e".
+func broadcastHostState(hub *notification.Hub, e history.Entry, st history.HostState) {
+	msg := struct {
+		Project     string
+		Environment string
+		DeployID    string
+		Event       string
+		Host        string
+		State       history.State
+	}{e.Project, e.Environment, e.ID, "host", st.Host, st.State}
+	buf, err := json.Marshal(msg)
+	if err != nil {
+		glog.Errorf("Failed to marshal event into JSON: %v", err)
+		return
+	}
+	hub.Publish(deployTopic(e), string(buf))
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gengo/goship/lib/auth"
+	"github.com/golang/glog"
+)
+
+// EventsHandler streams the same messages as PushHandler as server-sent events.
+// i.e. http://127.0.0.1:8000/events?deploy=<deploy ID>
+// or http://127.0.0.1:8000/events?project=<project>&environment=<environment>
+//
+// Clients resume the stream with the header Last-Event-ID after reconnecting.
+type EventsHandler struct {
+	dh DeployHandler
+}
+
+func (h EventsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u, err := auth.CurrentUser(r)
+	if err != nil {
+		glog.Errorf("Failed to get current user: %v", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	f, err := pushFilter(h.dh, r, u)
+	if err != nil {
+		if re, ok := err.(requestError); ok {
+			http.Error(w, re.msg, re.status)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.dh.hub.ServeSSE(w, r, f)
+}
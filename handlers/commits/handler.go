@@ -7,35 +7,33 @@ import (
 	"net/http"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/coreos/go-etcd/etcd"
-	docker "github.com/fsouza/go-dockerclient"
 	"github.com/gengo/goship/lib/acl"
 	"github.com/gengo/goship/lib/auth"
 	"github.com/gengo/goship/lib/config"
-	githublib "github.com/gengo/goship/lib/github"
-	gcrrev "github.com/gengo/goship/lib/revision/gcr"
-	githubrev "github.com/gengo/goship/lib/revision/github"
-	"github.com/gengo/goship/lib/ssh"
+	"github.com/gengo/goship/lib/revision"
 	"github.com/golang/glog"
 	"golang.org/x/net/context"
 )
 
 var (
-	projectUnaccessible = errors.New("permission denied")
+	// ErrProjectUnaccessible is returned if the user cannot read the project.
+	ErrProjectUnaccessible = errors.New("permission denied")
+	// ErrNoSuchProject is returned if the project is not configured.
+	ErrNoSuchProject = errors.New("no such project")
 )
 
 type handler struct {
-	ac         acl.AccessControl
-	ecl        *etcd.Client
-	gcl        githublib.Client
-	dcl        *docker.Client
-	sshKeyPath string
+	ac       acl.AccessControl
+	ecl      *etcd.Client
+	controls revision.ControlFactory
 }
 
 // New returns a new http.Handler which serves latest revisions in deploy targets and the revision control system.
-func New(ac acl.AccessControl, ecl *etcd.Client, gcl githublib.Client, dcl *docker.Client, sshKeyPath string) http.Handler {
-	return handler{ac: ac, ecl: ecl, gcl: gcl, dcl: dcl, sshKeyPath: sshKeyPath}
+func New(ac acl.AccessControl, ecl *etcd.Client, controls revision.ControlFactory) http.Handler {
+	return handler{ac: ac, ecl: ecl, controls: controls}
 }
 
 func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -57,11 +55,15 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	envs, err := h.fetchStatuses(ctx, projName, u)
-	if err == projectUnaccessible {
+	if err == ErrProjectUnaccessible {
 		glog.Errorf("project %s is not accessible for %s", projName, u.Name)
 		http.Error(w, err.Error(), http.StatusForbidden)
 		return
 	}
+	if err == ErrNoSuchProject {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -81,24 +83,35 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (h handler) fetchStatuses(ctx context.Context, projName string, u auth.User) ([]environment, error) {
-	p, deployUser, err := h.loadProject(projName, u)
+// FetchStatuses returns the latest deployment status of the project "projName" in each environment on behalf of "u".
+// It returns ErrNoSuchProject or ErrProjectUnaccessible if "u" cannot read the project.
+func FetchStatuses(ctx context.Context, ac acl.AccessControl, ecl *etcd.Client, controls revision.ControlFactory, projName string, u auth.User) ([]Environment, error) {
+	return handler{ac: ac, ecl: ecl, controls: controls}.fetchStatuses(ctx, projName, u)
+}
+
+func (h handler) fetchStatuses(ctx context.Context, projName string, u auth.User) ([]Environment, error) {
+	cfg, p, err := h.loadProject(projName, u)
 	if err != nil {
 		return nil, err
 	}
-	envs, err := h.retrieveCommits(ctx, p, deployUser)
+	envs, err := h.retrieveCommits(ctx, p, cfg.DeployUser)
 	if err != nil {
 		glog.Errorf("Failed to retrieve commits: %v", err)
 		return nil, err
 	}
 
+	now := time.Now()
 	for i := range envs {
 		env := &envs[i]
+		env.Freezes = cfg.ActiveFreezes(p, p.Environments[i], now)
 		locked, comments := func() (bool, []string) {
 			var comments []string
 			if c := env.Comment; c != "" {
 				comments = append(comments, c)
 			}
+			if env.Lock != nil {
+				return true, append(comments, env.Lock.String())
+			}
 			if env.Locked {
 				return true, append(comments, "repo is locked.")
 			}
@@ -106,6 +119,12 @@ func (h handler) fetchStatuses(ctx context.Context, projName string, u auth.User
 			if !h.ac.Deployable(repo.RepoOwner, repo.RepoName, u.Name) {
 				return true, append(comments, "you do not have permission to deploy")
 			}
+			for _, w := range env.Freezes {
+				comments = append(comments, fmt.Sprintf("frozen: %s", w))
+			}
+			if len(env.Freezes) > 0 && !cfg.IsAdmin(u.Name) {
+				return true, comments
+			}
 			return false, comments
 		}()
 		env.Locked = locked
@@ -115,54 +134,47 @@ func (h handler) fetchStatuses(ctx context.Context, projName string, u auth.User
 	return envs, nil
 }
 
-func (h handler) loadProject(projName string, u auth.User) (p config.Project, deployUser string, err error) {
-	c, err := config.Load(h.ecl)
+func (h handler) loadProject(projName string, u auth.User) (c config.Config, p config.Project, err error) {
+	c, err = config.Load(h.ecl)
 	if err != nil {
 		glog.Errorf("Parsing etc: %v", err)
-		return config.Project{}, "", err
+		return config.Config{}, config.Project{}, err
 	}
 	p, err = config.ProjectFromName(c.Projects, projName)
 	if err != nil {
 		glog.Errorf("Failed to get project from name: %v", err)
-		return config.Project{}, "", err
+		return config.Config{}, config.Project{}, ErrNoSuchProject
 	}
 	repo := p.SourceRepo()
 	if !h.ac.Readable(repo.RepoOwner, repo.RepoName, u.Name) {
-		return config.Project{}, "", projectUnaccessible
+		return config.Config{}, config.Project{}, ErrProjectUnaccessible
 	}
-	return p, c.DeployUser, nil
+	return c, p, nil
 
 }
 
-func (h handler) retrieveCommits(ctx context.Context, proj config.Project, deployUser string) ([]environment, error) {
-	s, err := ssh.WithPrivateKeyFile(deployUser, h.sshKeyPath)
+func (h handler) retrieveCommits(ctx context.Context, proj config.Project, deployUser string) ([]Environment, error) {
+	c, err := h.controls(deployUser, proj)
 	if err != nil {
 		return nil, err
 	}
 
-	c := githubrev.New(h.gcl, s)
-	switch t := proj.RepoType; t {
-	case config.RepoTypeGithub:
-	case config.RepoTypeDocker:
-		c = gcrrev.New(c, h.dcl, s)
-	default:
-		return nil, fmt.Errorf("unknown repository type %q", t)
-	}
-
 	var wg sync.WaitGroup
-	envs := make([]environment, len(proj.Environments))
+	envs := make([]Environment, len(proj.Environments))
 	for i, e := range proj.Environments {
-		envs[i] = environment{
+		envs[i] = Environment{
 			Name:        e.Name,
-			Locked:      e.IsLocked,
-			Deployments: make([]deployStatus, len(e.Hosts)),
+			Locked:      e.Locked(),
+			Lock:        e.Lock,
+			Deployments: make([]DeployStatus, len(e.Hosts)),
 		}
 		env := &envs[i]
 
 		for j, host := range e.Hosts {
 			wg.Add(1)
-			go func(st *deployStatus, host string, e config.Environment) {
+			go func(st *DeployStatus, host string, e config.Environment) {
 				defer wg.Done()
+				st.HostName = host
 				rev, srcRev, err := c.LatestDeployed(ctx, host, proj, e)
 				if err != nil {
 					st.Revision = ""
@@ -175,7 +187,7 @@ func (h handler) retrieveCommits(ctx context.Context, proj config.Project, deplo
 			}(&env.Deployments[j], host, e)
 		}
 		wg.Add(1)
-		go func(env *environment, e config.Environment) {
+		go func(env *Environment, e config.Environment) {
 			defer wg.Done()
 			rev, srcRev, err := c.Latest(ctx, proj, e)
 			if err != nil {
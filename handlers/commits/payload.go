@@ -1,19 +1,25 @@
 package commits
 
 import (
+	"github.com/gengo/goship/lib/config"
+	"github.com/gengo/goship/lib/freeze"
 	"github.com/gengo/goship/lib/revision"
 )
 
-// environment describes the latest deployment status of a project in an environment.
-type environment struct {
+// Environment describes the latest deployment status of a project in an environment.
+type Environment struct {
 	// Name is the name of the environment
 	Name string `json:"name"`
 	sourceStatus
 	Comment string `json:"comment"`
 	// Locked is true iff the project is not ready for deployment.
 	Locked bool `json:"isLocked"`
+	// Lock is the current lock of the environment if any.
+	Lock *config.Lock `json:"lock,omitempty"`
+	// Freezes is a list of active freeze windows of the environment.
+	Freezes []freeze.Window `json:"freezes,omitempty"`
 	// Deployments are per-host status of deployments
-	Deployments []deployStatus `json:"deployments"`
+	Deployments []DeployStatus `json:"deployments"`
 }
 
 // sourceStatus describes a latest deployable revision of a project
@@ -27,8 +33,8 @@ type sourceStatus struct {
 	SourceCodeRevision revision.Revision `json:"sourceCodeRevision"`
 }
 
-// deployStatus describes a latest deployed revision of a project in a host
-type deployStatus struct {
+// DeployStatus describes a latest deployed revision of a project in a host
+type DeployStatus struct {
 	// HostName is the name of the host
 	HostName string `json:"hostname"`
 	// Revision is the unique identifier of the revision
@@ -5,6 +5,7 @@ import (
 	"html/template"
 	"net/http"
 	"net/url"
+	"strings"
 
 	"github.com/gengo/goship/lib/auth"
 	helpers "github.com/gengo/goship/lib/view-helpers"
@@ -12,27 +13,27 @@ import (
 )
 
 // New return an http handler which renders deploy page.
-// "pushAddr" is an absolute URL to the websocket endpoint of push notification.
+// "eventsPath" is the path to the server-sent event endpoint of push notification, e.g. "/events".
+// It is resolved against the URL of the page in browsers so that it works behind reverse proxies and TLS.
 //
-// pushAddr is defined for backward compatibility
-// TODO(yugui) is it really a right way to solve that?  Is it safe for reverse-proxy or some bind addresses?
-func New(assets helpers.Assets, pushAddr string) (http.Handler, error) {
-	addr, err := url.Parse(pushAddr)
+// The page shows the plan of the deployment before it starts.
+// If "confirm" is true, the deployment starts only after the user confirms the plan.
+// If the page is requested with "deploy_id", it shows the output of the deployment instead of starting a new one.
+func New(assets helpers.Assets, eventsPath string, confirm bool) (http.Handler, error) {
+	u, err := url.Parse(eventsPath)
 	if err != nil {
 		return nil, err
 	}
-	if !addr.IsAbs() {
-		return nil, fmt.Errorf("not an absolute URL: %s", pushAddr)
+	if u.IsAbs() || u.Host != "" || !strings.HasPrefix(u.Path, "/") {
+		return nil, fmt.Errorf("not an absolute path: %s", eventsPath)
 	}
-	if addr.Scheme != "ws" {
-		return nil, fmt.Errorf("not a websocket URL: %s", pushAddr)
-	}
-	return deployPage{assets: assets, pushAddr: addr}, nil
+	return deployPage{assets: assets, eventsPath: u.Path, confirm: confirm}, nil
 }
 
 type deployPage struct {
-	assets   helpers.Assets
-	pushAddr *url.URL
+	assets     helpers.Assets
+	eventsPath string
+	confirm    bool
 }
 
 func (h deployPage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -49,6 +50,8 @@ func (h deployPage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	repoOwner := r.FormValue("repo_owner")
 	repoName := r.FormValue("repo_name")
 	timestamp := r.FormValue("timestamp")
+	rollbackOf := r.FormValue("rollback_of")
+	deployID := r.FormValue("deploy_id")
 	t, err := template.New("deploy.html").ParseFiles("templates/deploy.html", "templates/base.html")
 	if err != nil {
 		glog.Errorf("Failed to parse templates: %v", err)
@@ -63,12 +66,15 @@ func (h deployPage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		"Project":      p,
 		"Env":          env,
 		"User":         user,
-		"PushAddress":  h.pushAddr,
+		"EventsPath":   h.eventsPath,
 		"RepoOwner":    repoOwner,
 		"RepoName":     repoName,
 		"ToRevision":   toRevision,
 		"FromRevision": fromRevision,
 		"Timestamp":    timestamp,
+		"RollbackOf":   rollbackOf,
+		"Confirm":      h.confirm,
+		"DeployID":     deployID,
 	}
 	helpers.RespondWithTemplate(w, "text/html", t, "base", params)
 }
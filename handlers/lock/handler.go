@@ -1,41 +1,138 @@
 package lock
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/coreos/go-etcd/etcd"
+	"github.com/gengo/goship/lib/auth"
 	"github.com/gengo/goship/lib/config"
+	"github.com/gengo/goship/lib/notification"
 	"github.com/golang/glog"
 )
 
-// http://127.0.0.1:8000/lock?environment=staging&project=admin
-func NewLock(ecl *etcd.Client) http.Handler {
+// NewLock returns an http.Handler which locks an environment.
+// i.e. http://127.0.0.1:8000/lock?environment=staging&project=admin&reason=maintenance&expires_in=2h
+//
+// GET requests return the current lock of the environment in JSON.
+// Changes of the lock are published to "hub".
+func NewLock(ecl *etcd.Client, hub *notification.Hub) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		handler(ecl, w, r, true)
+		handler(ecl, hub, w, r, true)
 	})
 }
 
-func NewUnlock(ecl *etcd.Client) http.Handler {
+// NewUnlock returns an http.Handler which unlocks an environment.
+// Only the owner of the lock or admins can unlock the environment.
+//
+// GET requests return the current lock of the environment in JSON.
+// Changes of the lock are published to "hub".
+func NewUnlock(ecl *etcd.Client, hub *notification.Hub) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		handler(ecl, w, r, false)
+		handler(ecl, hub, w, r, false)
 	})
 }
 
+// Publish notifies subscribers of "hub" that "user" locked the environment "env" of the project "proj" with "l".
+// "l" is nil if the environment was unlocked.
+func Publish(hub *notification.Hub, proj, env, user string, l *config.Lock) {
+	event := "locked"
+	if l == nil {
+		event = "unlocked"
+	}
+	msg := struct {
+		Project     string
+		Environment string
+		Event       string
+		User        string
+		Lock        *config.Lock
+	}{proj, env, event, user, l}
+	buf, err := json.Marshal(msg)
+	if err != nil {
+		glog.Errorf("Failed to marshal event into JSON: %v", err)
+		return
+	}
+	hub.Publish(notification.Topic{Project: proj, Environment: env}, string(buf))
+}
+
 // handler allows you to lock or unlock an environment
-func handler(ecl *etcd.Client, w http.ResponseWriter, r *http.Request, lock bool) {
+func handler(ecl *etcd.Client, hub *notification.Hub, w http.ResponseWriter, r *http.Request, lock bool) {
 	p := r.FormValue("project")
 	env := r.FormValue("environment")
 
-	lockStr := "false"
-	if lock {
-		lockStr = "true"
+	u, err := auth.CurrentUser(r)
+	if err != nil {
+		glog.Errorf("Failed to get current user: %v", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	c, err := config.Load(ecl)
+	if err != nil {
+		glog.Errorf("Failed to fetch latest configuration: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	err := config.LockEnvironment(ecl, p, env, lockStr)
+	e, err := config.EnvironmentFromName(c.Projects, p, env)
 	if err != nil {
+		http.Error(w, "no such project/environment", http.StatusNotFound)
+		return
+	}
+
+	if r.Method != "POST" {
+		buf, err := json.Marshal(e.Lock)
+		if err != nil {
+			glog.Errorf("Failed to marshal lock: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(buf)
+		return
+	}
+
+	var l *config.Lock
+	if lock {
+		l = &config.Lock{
+			Owner:  u.Name,
+			Reason: r.FormValue("reason"),
+			Time:   time.Now(),
+		}
+		if s := r.FormValue("expires_in"); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil || d <= 0 {
+				http.Error(w, fmt.Sprintf("invalid expires_in %q", s), http.StatusBadRequest)
+				return
+			}
+			l.Expiry = l.Time.Add(d)
+		}
+		err = config.AcquireLock(ecl, p, env, *l)
+	} else {
+		err = config.ReleaseLock(ecl, p, env, u.Name, c.IsAdmin(u.Name))
+	}
+	switch err {
+	case nil:
+	case config.ErrLocked:
+		msg := err.Error()
+		if e.Lock != nil {
+			msg = fmt.Sprintf("%s-%s is %s", p, env, e.Lock)
+		}
+		http.Error(w, msg, http.StatusConflict)
+		return
+	case config.ErrNotLockOwner:
+		http.Error(w, fmt.Sprintf("%s; %s-%s is %s", err, p, env, e.Lock), http.StatusForbidden)
+		return
+	case config.ErrNotLocked, config.ErrLockChanged:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	default:
 		glog.Errorf("Failed to lock/unlock project=%s env=%s: %v", p, env, err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	glog.Infof("%s-%s was locked=%v by %s", p, env, lock, u.Name)
+	Publish(hub, p, env, u.Name, l)
 
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
@@ -1,15 +1,18 @@
 package main
 
 import (
+	"fmt"
 	"html/template"
 	"net/http"
 	"os"
 	"sort"
+	"time"
 
 	"github.com/coreos/go-etcd/etcd"
 	"github.com/gengo/goship/lib/acl"
 	"github.com/gengo/goship/lib/auth"
 	"github.com/gengo/goship/lib/config"
+	"github.com/gengo/goship/lib/freeze"
 	helpers "github.com/gengo/goship/lib/view-helpers"
 	"github.com/gengo/goship/plugins/plugin"
 	"github.com/golang/glog"
@@ -65,16 +68,26 @@ func (h HomeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		pt = c.Pivotal.Token
 	}
 
+	// freezes maps "project-env" to a list of active freeze windows.
+	now := time.Now()
+	freezes := make(map[string][]freeze.Window)
+	for _, p := range projs {
+		for _, e := range p.Environments {
+			freezes[fmt.Sprintf("%s-%s", p.Name, e.Name)] = c.ActiveFreezes(p, e, now)
+		}
+	}
+
 	params := map[string]interface{}{
-		"Javascript":        js,
-		"Stylesheet":        css,
-		"Projects":          projs,
-		"PluginColumns":     columns,
-		"User":              u,
-		"Page":              "home",
-		"ConfirmDeployFlag": *confirmDeployFlag,
-		"GithubToken":       gt,
-		"PivotalToken":      pt,
+		"Javascript":    js,
+		"Stylesheet":    css,
+		"Projects":      projs,
+		"PluginColumns": columns,
+		"User":          u,
+		"Page":          "home",
+		"GithubToken":   gt,
+		"PivotalToken":  pt,
+		"GlobalFreezes": freeze.Active(c.Freezes, now),
+		"Freezes":       freezes,
 	}
 	helpers.RespondWithTemplate(w, "text/html", t, "base", params)
 }
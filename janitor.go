@@ -0,0 +1,148 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gengo/goship/lib/config"
+	"github.com/gengo/goship/lib/history"
+	"github.com/gengo/goship/lib/output"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// janitorReport is the result of a run of the janitor.
+type janitorReport struct {
+	// Removed is the number of deployments whose outputs were removed.
+	Removed int
+	// Compressed is the number of output files which were compressed.
+	Compressed int
+	// Freed is the number of bytes freed in the data directory.
+	Freed int64
+}
+
+// runJanitor enforces the retention policies of projects on outputs of deployments every "interval" until "ctx" is done.
+func runJanitor(ctx context.Context, client config.ETCDInterface, store history.DeployStore, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		c, err := config.Load(client)
+		if err != nil {
+			glog.Errorf("Failed to load config for the janitor: %v", err)
+		} else {
+			r, err := cleanOutputs(c, store, time.Now())
+			if err != nil {
+				glog.Errorf("Failed to clean outputs of deployments: %v", err)
+			}
+			glog.Infof("Janitor removed outputs of %d deployments and compressed %d outputs; freed %d bytes", r.Removed, r.Compressed, r.Freed)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// cleanOutputs removes outputs of finished deployments which the retention policies of their projects do not keep,
+// and compresses the rest of them after the compression delay of the policies if it is set.
+// Deployments which have not finished do not count toward KeepDeploys.
+// It continues with other deployments on errors and returns the first error.
+func cleanOutputs(c config.Config, store history.DeployStore, now time.Time) (janitorReport, error) {
+	var (
+		r        janitorReport
+		firstErr error
+	)
+	record := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	for _, proj := range c.Projects {
+		compressAfter := proj.Retention.CompressionDelay()
+		for _, env := range proj.Environments {
+			entries, err := store.List(proj.Name, env.Name)
+			if err != nil {
+				record(err)
+				continue
+			}
+			var finished int
+			for _, e := range entries {
+				if !e.State.Finished() {
+					continue
+				}
+				n := finished
+				finished++
+				if !proj.Retention.Kept(n, e.Time, now) {
+					freed, err := removeDeployOutput(e)
+					if err != nil {
+						record(err)
+					}
+					if freed > 0 {
+						r.Removed++
+						r.Freed += freed
+					}
+					continue
+				}
+				end := e.EndTime
+				if end.IsZero() {
+					end = e.Time
+				}
+				if compressAfter == 0 || now.Sub(end) < compressAfter {
+					continue
+				}
+				n, freed, err := compressDeployOutput(e)
+				if err != nil {
+					record(err)
+				}
+				r.Compressed += n
+				r.Freed += freed
+			}
+		}
+	}
+	return r, firstErr
+}
+
+// removeDeployOutput removes the output files of the deployment "e" and returns the number of bytes freed.
+func removeDeployOutput(e history.Entry) (int64, error) {
+	var freed int64
+	for _, name := range deployOutputFiles(e) {
+		fi, err := os.Stat(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return freed, err
+		}
+		if err := os.Remove(name); err != nil {
+			return freed, err
+		}
+		freed += fi.Size()
+	}
+	return freed, nil
+}
+
+// compressDeployOutput compresses the uncompressed output files of the deployment "e".
+// It returns the number of files compressed and the number of bytes freed.
+func compressDeployOutput(e history.Entry) (int, int64, error) {
+	var (
+		n     int
+		freed int64
+	)
+	for _, name := range deployOutputFiles(e) {
+		if strings.HasSuffix(name, output.CompressedExt) {
+			continue
+		}
+		f, err := output.Compress(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return n, freed, err
+		}
+		n++
+		freed += f
+	}
+	return n, freed, nil
+}
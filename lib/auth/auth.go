@@ -5,7 +5,11 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/gengo/goship/lib/config"
+	"github.com/gengo/goship/lib/token"
 	"github.com/golang/glog"
 	"github.com/gorilla/sessions"
 	"github.com/stretchr/gomniauth"
@@ -25,6 +29,14 @@ var (
 	githubCallbackBase string
 
 	store *sessions.CookieStore
+
+	// tokens is the etcd client which stores API tokens. API tokens are rejected if it is nil.
+	tokens config.ETCDInterface
+)
+
+const (
+	// bearerPrefix is the prefix of Authorization headers with API tokens.
+	bearerPrefix = "Bearer "
 )
 
 // Initialize collects server-side credential from environment variables and prepare for authentication with Github OAuth.
@@ -69,17 +81,53 @@ func Enabled() bool {
 	return enabled
 }
 
+// EnableTokens enables authentication with API tokens stored in "client".
+func EnableTokens(client config.ETCDInterface) {
+	tokens = client
+}
+
 // User is the user who the current request is on behalf of.
 type User struct {
 	// Name is the name of the user
 	Name string
 	// Avatar is the URL to the avatar of the user
 	Avatar string
+	// Token is the API token which the request was authenticated with.
+	// It is nil if the user logged in with a browser.
+	Token *token.Token
+}
+
+// Allowed returns true if the user is allowed to do "s" in the project "proj".
+// It is always true unless the user was authenticated with an API token.
+// Access control of the user applies in addition to it.
+func (u User) Allowed(proj string, s token.Scope) bool {
+	return u.Token == nil || u.Token.Allows(proj, s)
+}
+
+// bearerToken returns the secret of the API token in "r" if any.
+func bearerToken(r *http.Request) (string, bool) {
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, bearerPrefix) {
+		return "", false
+	}
+	return strings.TrimSpace(strings.TrimPrefix(h, bearerPrefix)), true
 }
 
 // CurrentUser returns the current login user of the request.
-// It returns the default user if client authentication is disabled in the current context.
+// If the request has an API token in its Authorization header, it returns the user of the token.
+// Otherwise, it returns the default user if client authentication is disabled in the current context.
 func CurrentUser(r *http.Request) (User, error) {
+	if secret, ok := bearerToken(r); ok {
+		if tokens == nil {
+			return User{}, errors.New("API tokens are not enabled")
+		}
+		t, err := token.Lookup(tokens, secret, time.Now())
+		if err != nil {
+			glog.Errorf("Failed to look up API token: %v", err)
+			return User{}, err
+		}
+		return User{Name: t.User, Token: &t}, nil
+	}
 	if !enabled {
 		return defaultUser, nil
 	}
@@ -16,9 +16,14 @@ const (
 )
 
 // Authenticate decorates "h" with github OAuth authentication.
+// Requests with API tokens are rejected because scopes of tokens are checked only by the API.
 func Authenticate(h http.Handler) http.Handler {
 	callback := fmt.Sprintf("%s/auth/github/login", githubCallbackBase)
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := bearerToken(r); ok {
+			http.Error(w, "API tokens are accepted only by the API", http.StatusUnauthorized)
+			return
+		}
 		_, err := CurrentUser(r)
 		if err != nil {
 			glog.Warningf("Failed to fetch the current user: %v", err)
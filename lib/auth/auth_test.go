@@ -1,10 +1,14 @@
 package auth
 
 import (
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/gengo/goship/lib/token"
 	"github.com/gorilla/sessions"
 )
 
@@ -45,3 +49,83 @@ func TestCurrentUser(t *testing.T) {
 		t.Errorf("user.Avatar = %q; want %q", got, want)
 	}
 }
+
+// fakeEtcdClient is an in-memory emulation of etcd which supports only Get and Create.
+type fakeEtcdClient map[string]string
+
+func (cl fakeEtcdClient) Get(key string, sort, recursive bool) (*etcd.Response, error) {
+	if v, ok := cl[key]; ok {
+		return &etcd.Response{Action: "get", Node: &etcd.Node{Key: key, Value: v}}, nil
+	}
+	return nil, &etcd.EtcdError{ErrorCode: 100, Message: "Key not found", Cause: key}
+}
+
+func (cl fakeEtcdClient) Create(key, value string, ttl uint64) (*etcd.Response, error) {
+	cl[key] = value
+	return &etcd.Response{Action: "create", Node: &etcd.Node{Key: key, Value: value}}, nil
+}
+
+func (cl fakeEtcdClient) Set(key, value string, ttl uint64) (*etcd.Response, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (cl fakeEtcdClient) CompareAndSwap(key, value string, ttl uint64, prevValue string, prevIndex uint64) (*etcd.Response, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (cl fakeEtcdClient) CompareAndDelete(key, prevValue string, prevIndex uint64) (*etcd.Response, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func TestCurrentUserWithToken(t *testing.T) {
+	Initialize(User{Name: "T-600"}, []byte("12345"))
+	cl := make(fakeEtcdClient)
+	EnableTokens(cl)
+	defer EnableTokens(nil)
+
+	secret, tok, err := token.Create(cl, token.Token{
+		Name:      "ci",
+		User:      "T-1000",
+		Projects:  []string{"skynet"},
+		Scopes:    []token.Scope{token.ScopeDeploy},
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		t.Fatalf("token.Create(cl, tok) failed with %v; want success", err)
+	}
+
+	req, err := http.NewRequest("GET", "http://host.example/api/v1/projects", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(%q, %q, nil) failed with %v; want success", "GET", "http://host.example/api/v1/projects", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+secret)
+	user, err := CurrentUser(req)
+	if err != nil {
+		t.Fatalf("CurrentUser(req) failed with %v; want success", err)
+	}
+	if got, want := user.Name, "T-1000"; got != want {
+		t.Errorf("user.Name = %q; want %q", got, want)
+	}
+	if user.Token == nil || user.Token.ID != tok.ID {
+		t.Errorf("user.Token = %#v; want %#v", user.Token, tok)
+	}
+	if !user.Allowed("skynet", token.ScopeDeploy) {
+		t.Errorf("user.Allowed(%q, %q) = false; want true", "skynet", token.ScopeDeploy)
+	}
+	if user.Allowed("skynet", token.ScopeLock) {
+		t.Errorf("user.Allowed(%q, %q) = true; want false", "skynet", token.ScopeLock)
+	}
+
+	req.Header.Set("Authorization", "Bearer goship_unknown")
+	if user, err := CurrentUser(req); err == nil {
+		t.Errorf("CurrentUser(req) = %#v; want failure", user)
+	}
+
+	// Browser handlers do not accept tokens.
+	req.Header.Set("Authorization", "Bearer "+secret)
+	w := httptest.NewRecorder()
+	Authenticate(http.NotFoundHandler()).ServeHTTP(w, req)
+	if got, want := w.Code, http.StatusUnauthorized; got != want {
+		t.Errorf("w.Code = %d; want %d", got, want)
+	}
+}
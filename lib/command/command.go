@@ -0,0 +1,111 @@
+// Package command builds argv of deploy commands from configurations.
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// Vars is a set of variables which deploy commands can refer to in template actions, e.g. {{.Project}}.
+type Vars struct {
+	Project      string
+	Env          string
+	FromRevision string
+	ToRevision   string
+	User         string
+	Hosts        Hosts
+}
+
+// Hosts is a list of hosts. It is rendered as a comma-separated list.
+type Hosts []string
+
+func (h Hosts) String() string {
+	return strings.Join(h, ",")
+}
+
+// Split splits "s" into words in the same way as POSIX shells do.
+// It supports single quotes, double quotes and backslash escapes, but no expansions.
+// Template actions like {{.Project}} are kept in a word even if they contain spaces.
+func Split(s string) ([]string, error) {
+	var (
+		words  []string
+		word   bytes.Buffer
+		inWord bool
+		quote  byte
+	)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+				continue
+			}
+			word.WriteByte(c)
+		case c == '{' && strings.HasPrefix(s[i:], "{{"):
+			end := strings.Index(s[i:], "}}")
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed template action in %q", s)
+			}
+			word.WriteString(s[i : i+end+2])
+			inWord = true
+			i += end + 1
+		case c == '\\':
+			if i+1 >= len(s) {
+				return nil, fmt.Errorf("trailing backslash in %q", s)
+			}
+			i++
+			if quote == '"' && !strings.ContainsRune("$`\"\\\n", rune(s[i])) {
+				word.WriteByte(c)
+			}
+			if s[i] != '\n' {
+				word.WriteByte(s[i])
+			}
+			inWord = true
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+				continue
+			}
+			word.WriteByte(c)
+		case c == '\'' || c == '"':
+			quote = c
+			inWord = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unclosed quote %c in %q", quote, s)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// Render expands template actions in each of "args" with "vars".
+func Render(args []string, vars Vars) ([]string, error) {
+	var argv []string
+	for _, a := range args {
+		tmpl, err := template.New("arg").Option("missingkey=error").Parse(a)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, vars); err != nil {
+			return nil, err
+		}
+		argv = append(argv, buf.String())
+	}
+	return argv, nil
+}
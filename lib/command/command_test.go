@@ -0,0 +1,85 @@
+package command
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplit(t *testing.T) {
+	for _, spec := range []struct {
+		s    string
+		want []string
+	}{
+		{s: "", want: nil},
+		{s: "deploy", want: []string{"deploy"}},
+		{s: "  deploy   -p=proj  -e=env ", want: []string{"deploy", "-p=proj", "-e=env"}},
+		{s: `deploy -m 'hello world'`, want: []string{"deploy", "-m", "hello world"}},
+		{s: `deploy -m "hello \"world\""`, want: []string{"deploy", "-m", `hello "world"`}},
+		{s: `deploy -m "a\b"`, want: []string{"deploy", "-m", `a\b`}},
+		{s: `deploy hello\ world ''`, want: []string{"deploy", "hello world", ""}},
+		{s: `deploy 'it'\''s'`, want: []string{"deploy", "it's"}},
+		{s: "deploy -p={{ .Project }} {{.Hosts}}", want: []string{"deploy", "-p={{ .Project }}", "{{.Hosts}}"}},
+	} {
+		got, err := Split(spec.s)
+		if err != nil {
+			t.Errorf("Split(%q) failed with %v; want success", spec.s, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, spec.want) {
+			t.Errorf("Split(%q) = %q; want %q", spec.s, got, spec.want)
+		}
+	}
+}
+
+func TestSplitError(t *testing.T) {
+	for _, s := range []string{
+		`deploy 'unclosed`,
+		`deploy "unclosed`,
+		`deploy \`,
+		`deploy {{.Project`,
+	} {
+		if got, err := Split(s); err == nil {
+			t.Errorf("Split(%q) = %q; want failure", s, got)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	vars := Vars{
+		Project:      "proj",
+		Env:          "prod",
+		FromRevision: "abc",
+		ToRevision:   "def",
+		User:         "alice",
+		Hosts:        Hosts{"host1", "host2"},
+	}
+	args := []string{
+		"deploy",
+		"-p={{.Project}}",
+		"-e={{.Env}}",
+		"{{.FromRevision}}..{{.ToRevision}}",
+		"--user={{.User}}",
+		"--hosts={{.Hosts}}",
+		"{{range .Hosts}}[{{.}}]{{end}}",
+	}
+	got, err := Render(args, vars)
+	if err != nil {
+		t.Fatalf("Render(%q, %#v) failed with %v; want success", args, vars, err)
+	}
+	want := []string{
+		"deploy",
+		"-p=proj",
+		"-e=prod",
+		"abc..def",
+		"--user=alice",
+		"--hosts=host1,host2",
+		"[host1][host2]",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Render(%q, %#v) = %q; want %q", args, vars, got, want)
+	}
+
+	if got, err := Render([]string{"{{.Unknown}}"}, vars); err == nil {
+		t.Errorf("Render(%q, %#v) = %q; want failure", "{{.Unknown}}", vars, got)
+	}
+}
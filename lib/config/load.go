@@ -6,6 +6,7 @@ import (
 	"path"
 
 	"github.com/coreos/go-etcd/etcd"
+	"github.com/gengo/goship/lib/freeze"
 	"github.com/golang/glog"
 )
 
@@ -20,9 +21,23 @@ func Load(client ETCDInterface) (Config, error) {
 		glog.Errorf("Failed to unmarshal %s: %v", resp.Node.Value, err)
 		return Config{}, err
 	}
+	if err := validateFreezes(cfg.Freezes); err != nil {
+		return Config{}, err
+	}
 	if err := loadProjects(client, &cfg, "/goship"); err != nil {
 		return Config{}, err
 	}
+	locks, err := loadLocks(client)
+	if err != nil {
+		return Config{}, err
+	}
+	for i := range cfg.Projects {
+		p := &cfg.Projects[i]
+		for j := range p.Environments {
+			env := &p.Environments[j]
+			env.Lock = locks[path.Join(p.Name, env.Name)]
+		}
+	}
 	glog.V(2).Infof("Loaded config: %#v", cfg)
 	return cfg, nil
 }
@@ -79,11 +94,22 @@ func loadProject(node *etcd.Node) (Project, error) {
 	if proj.K8sSelector == "" {
 		proj.K8sSelector = name
 	}
+	if err := validateFreezes(proj.Freezes); err != nil {
+		return Project{}, err
+	}
+	if r := proj.Retention; r != nil {
+		if err := r.Validate(); err != nil {
+			return Project{}, err
+		}
+	}
 
 	proj.Name = name
 	if err := loadEnvironments(envs, &proj); err != nil {
 		return Project{}, err
 	}
+	if err := validatePipeline(proj); err != nil {
+		return Project{}, err
+	}
 	return proj, nil
 }
 
@@ -114,5 +140,53 @@ func loadEnvironment(node *etcd.Node) (Environment, error) {
 	if env.K8sNamespace == "" {
 		env.K8sNamespace = "default"
 	}
+	if err := validateFreezes(env.Freezes); err != nil {
+		return Environment{}, err
+	}
+	if r := env.Rollout; r != nil {
+		if r.BatchSize <= 0 {
+			return Environment{}, fmt.Errorf("batch_size of %s must be positive", env.Name)
+		}
+		if len(env.Hosts) == 0 {
+			return Environment{}, fmt.Errorf("rollout of %s requires hosts", env.Name)
+		}
+	}
+	for _, hooks := range [][]Hook{env.PreDeploy, env.PostDeploy} {
+		for _, h := range hooks {
+			if err := h.Validate(); err != nil {
+				return Environment{}, err
+			}
+		}
+	}
+	if c := env.HealthCheck; c != nil {
+		if err := c.Validate(); err != nil {
+			return Environment{}, err
+		}
+	}
 	return env, nil
 }
+
+// validatePipeline returns an error if the pipeline of "proj" refers to unknown environments or has duplicate stages.
+func validatePipeline(proj Project) error {
+	seen := make(map[string]bool)
+	for _, name := range proj.Pipeline {
+		if seen[name] {
+			return fmt.Errorf("duplicate stage %q in the pipeline of %s", name, proj.Name)
+		}
+		seen[name] = true
+		if _, err := EnvironmentFromName([]Project{proj}, proj.Name, name); err != nil {
+			return fmt.Errorf("unknown stage %q in the pipeline of %s", name, proj.Name)
+		}
+	}
+	return nil
+}
+
+// validateFreezes parses "windows" in place and returns an error if any of them is malformed.
+func validateFreezes(windows []freeze.Window) error {
+	for i := range windows {
+		if err := windows[i].Compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
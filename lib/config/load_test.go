@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/coreos/go-etcd/etcd"
 	"github.com/gengo/goship/lib/config"
@@ -39,7 +40,10 @@ func TestLoad(t *testing.T) {
 									{
 										"repo_name": "example",
 										"repo_owner": "gengo",
-										"travis_token": "example_token"
+										"travis_token": "example_token",
+										"deploy_timeout": "1h",
+										"pipeline": [ "example-environment" ],
+										"soak_time": "2h"
 									}
 								`,
 							},
@@ -53,7 +57,8 @@ func TestLoad(t *testing.T) {
 											{
 												"deploy": "deploy-command",
 												"repo_path": "/path/to/prod",
-												"hosts": [ "host1", "host2", "host3" ]
+												"hosts": [ "host1", "host2", "host3" ],
+												"deploy_timeout": "30m"
 											}
 										`,
 									},
@@ -63,6 +68,22 @@ func TestLoad(t *testing.T) {
 					},
 				},
 			},
+			"/goship/locks": &etcd.Node{
+				Key: "/goship/locks",
+				Dir: true,
+				Nodes: etcd.Nodes{
+					{
+						Key: "/goship/locks/example-project",
+						Dir: true,
+						Nodes: etcd.Nodes{
+							{
+								Key:   "/goship/locks/example-project/example-environment",
+								Value: `{"owner": "alice", "reason": "maintenance", "time": "2015-01-01T00:00:00Z"}`,
+							},
+						},
+					},
+				},
+			},
 		},
 	}
 	got, err := config.Load(ecl)
@@ -88,15 +109,24 @@ func TestLoad(t *testing.T) {
 				K8sSelector: "example-project",
 				Environments: []config.Environment{
 					{
-						Name:         "example-environment",
-						Deploy:       "deploy-command",
-						RepoPath:     "/path/to/prod",
-						Branch:       "master",
-						Hosts:        []string{"host1", "host2", "host3"},
-						K8sNamespace: "default",
+						Name:          "example-environment",
+						Deploy:        "deploy-command",
+						RepoPath:      "/path/to/prod",
+						Branch:        "master",
+						Hosts:         []string{"host1", "host2", "host3"},
+						K8sNamespace:  "default",
+						DeployTimeout: config.Duration(30 * time.Minute),
+						Lock: &config.Lock{
+							Owner:  "alice",
+							Reason: "maintenance",
+							Time:   time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC),
+						},
 					},
 				},
-				TravisToken: "example_token",
+				TravisToken:   "example_token",
+				DeployTimeout: config.Duration(time.Hour),
+				Pipeline:      []string{"example-environment"},
+				SoakTime:      config.Duration(2 * time.Hour),
 			},
 		},
 	}
@@ -128,7 +158,7 @@ func (cl mockEtcdClient) Set(key, value string, ttl uint64) (*etcd.Response, err
 func (cl mockEtcdClient) Get(key string, sort bool, recursive bool) (*etcd.Response, error) {
 	node, ok := cl.getExpectation[key]
 	if !ok {
-		return nil, fmt.Errorf("unexpected key %q", key)
+		return nil, &etcd.EtcdError{ErrorCode: 100, Message: "Key not found", Cause: key}
 	}
 	return &etcd.Response{
 		Action:    "Get",
@@ -138,3 +168,15 @@ func (cl mockEtcdClient) Get(key string, sort bool, recursive bool) (*etcd.Respo
 		RaftTerm:  1,
 	}, nil
 }
+
+func (cl mockEtcdClient) Create(key, value string, ttl uint64) (*etcd.Response, error) {
+	return nil, fmt.Errorf("unexpected key %q", key)
+}
+
+func (cl mockEtcdClient) CompareAndSwap(key, value string, ttl uint64, prevValue string, prevIndex uint64) (*etcd.Response, error) {
+	return nil, fmt.Errorf("unexpected key %q", key)
+}
+
+func (cl mockEtcdClient) CompareAndDelete(key, prevValue string, prevIndex uint64) (*etcd.Response, error) {
+	return nil, fmt.Errorf("unexpected key %q", key)
+}
@@ -1,27 +1,258 @@
 package config
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"path"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/golang/glog"
 )
 
-// SetComment will set the  comment field on an environment
-func SetComment(client ETCDInterface, projectName, projectEnv, comment string) (err error) {
-	projectString := fmt.Sprintf("/goship/projects/%s/environments/%s/comment", projectName, projectEnv)
-	// guard against empty values ( simple validation)
+const (
+	// locksDir is the etcd directory which stores locks of environments.
+	locksDir = "/goship/locks"
+
+	// error codes of etcd.
+	// c.f. https://github.com/coreos/etcd/blob/master/Documentation/errorcode.md
+	etcdErrKeyNotFound = 100
+	etcdErrTestFailed  = 101
+	etcdErrNodeExist   = 105
+)
+
+var (
+	// ErrLocked is returned when somebody else holds the lock of the environment.
+	ErrLocked = errors.New("environment is locked by another user")
+	// ErrNotLocked is returned when releasing a lock which nobody holds.
+	ErrNotLocked = errors.New("environment is not locked")
+	// ErrNotLockOwner is returned when a user other than the owner or admins releases a lock.
+	ErrNotLockOwner = errors.New("only the owner of the lock or admins can release it")
+	// ErrLockChanged is returned when the lock has been concurrently changed by another user.
+	ErrLockChanged = errors.New("lock has been changed by another user")
+)
+
+// Lock is a lock of an environment which prevents deployments into the environment.
+type Lock struct {
+	// Owner is the name of the user who took the lock.
+	Owner string `json:"owner"`
+	// Reason describes why the environment is locked.
+	Reason string `json:"reason,omitempty"`
+	// Time is the time when the lock was taken.
+	Time time.Time `json:"time"`
+	// Expiry is the time when the lock is automatically released.
+	// It is zero if the lock does not expire.
+	Expiry time.Time `json:"expiry,omitempty"`
+}
+
+// Expired returns true if "l" has expired at "t".
+func (l Lock) Expired(t time.Time) bool {
+	return !l.Expiry.IsZero() && !t.Before(l.Expiry)
+}
+
+// String returns a human-readable description of "l".
+func (l Lock) String() string {
+	s := fmt.Sprintf("locked by %s since %s", l.Owner, l.Time.Format(time.RFC3339))
+	if !l.Expiry.IsZero() {
+		s += fmt.Sprintf(" until %s", l.Expiry.Format(time.RFC3339))
+	}
+	if l.Reason != "" {
+		s += ": " + l.Reason
+	}
+	return s
+}
+
+// ttl returns a TTL of the etcd node of "l" stored at "now" in seconds, or 0 if "l" does not expire.
+func (l Lock) ttl(now time.Time) (uint64, error) {
+	if l.Expiry.IsZero() {
+		return 0, nil
+	}
+	d := l.Expiry.Sub(now)
+	if d <= 0 {
+		return 0, fmt.Errorf("lock has already expired")
+	}
+	return uint64(math.Ceil(d.Seconds())), nil
+}
+
+func lockKey(projectName, projectEnv string) string {
+	return path.Join(locksDir, projectName, projectEnv)
+}
+
+func isEtcdError(err error, code int) bool {
+	switch err := err.(type) {
+	case *etcd.EtcdError:
+		return err.ErrorCode == code
+	case etcd.EtcdError:
+		return err.ErrorCode == code
+	}
+	return false
+}
+
+// GetLock returns the lock of the environment.
+// It returns nil if the environment is not locked.
+func GetLock(client ETCDInterface, projectName, projectEnv string) (*Lock, error) {
+	l, _, err := getLock(client, projectName, projectEnv)
+	return l, err
+}
+
+// getLock returns the lock of the environment and its raw value in etcd.
+func getLock(client ETCDInterface, projectName, projectEnv string) (*Lock, string, error) {
+	resp, err := client.Get(lockKey(projectName, projectEnv), false, false)
+	if isEtcdError(err, etcdErrKeyNotFound) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	var l Lock
+	if err := json.Unmarshal([]byte(resp.Node.Value), &l); err != nil {
+		glog.Errorf("Failed to unmarshal %s: %v", resp.Node.Value, err)
+		return nil, "", err
+	}
+	if l.Expired(time.Now()) {
+		// etcd has not removed the node yet.
+		return nil, resp.Node.Value, nil
+	}
+	return &l, resp.Node.Value, nil
+}
+
+// AcquireLock locks the environment with "l".
+// The owner of the current lock can update the lock.
+// It returns ErrLocked if another user holds the lock.
+func AcquireLock(client ETCDInterface, projectName, projectEnv string, l Lock) error {
+	if projectName == "" || projectEnv == "" || l.Owner == "" {
+		return fmt.Errorf("Missing parameters")
+	}
+	ttl, err := l.ttl(time.Now())
+	if err != nil {
+		return err
+	}
+	buf, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	key := lockKey(projectName, projectEnv)
+
+	cur, prev, err := getLock(client, projectName, projectEnv)
+	if err != nil {
+		return err
+	}
+	switch {
+	case prev == "":
+		_, err = client.Create(key, string(buf), ttl)
+	case cur == nil || cur.Owner == l.Owner:
+		_, err = client.CompareAndSwap(key, string(buf), ttl, prev, 0)
+	default:
+		return ErrLocked
+	}
+	if isEtcdError(err, etcdErrNodeExist) || isEtcdError(err, etcdErrTestFailed) {
+		return ErrLocked
+	}
+	return err
+}
+
+// ReleaseLock unlocks the environment on behalf of "user".
+// Admins can release locks of other users.
+// It also clears "is_locked" in the configuration of the environment, which has no owner.
+func ReleaseLock(client ETCDInterface, projectName, projectEnv, user string, admin bool) error {
 	if projectName == "" || projectEnv == "" {
 		return fmt.Errorf("Missing parameters")
 	}
-	_, err = client.Set(projectString, comment, 0)
+	cur, prev, err := getLock(client, projectName, projectEnv)
+	if err != nil {
+		return err
+	}
+	if cur != nil && cur.Owner != user && !admin {
+		return ErrNotLockOwner
+	}
+	legacy, err := clearLegacyLock(client, projectName, projectEnv)
+	if err != nil {
+		return err
+	}
+	if cur == nil {
+		if legacy {
+			return nil
+		}
+		return ErrNotLocked
+	}
+	_, err = client.CompareAndDelete(lockKey(projectName, projectEnv), prev, 0)
+	if isEtcdError(err, etcdErrTestFailed) || isEtcdError(err, etcdErrKeyNotFound) {
+		return ErrLockChanged
+	}
 	return err
 }
 
-// LockEnvironment Locks or unlock an environment for deploy
-func LockEnvironment(client ETCDInterface, projectName, projectEnv, lock string) (err error) {
-	projectString := fmt.Sprintf("/goship/projects/%s/environments/%s/locked", projectName, projectEnv)
+// clearLegacyLock clears "is_locked" in the configuration of the environment.
+// It returns true if the environment was locked by it.
+func clearLegacyLock(client ETCDInterface, projectName, projectEnv string) (bool, error) {
+	key := fmt.Sprintf("/goship/projects/%s/environments/%s", projectName, projectEnv)
+	resp, err := client.Get(key, false, false)
+	if isEtcdError(err, etcdErrKeyNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	// Keeps unknown fields of the configuration as they are.
+	var env map[string]interface{}
+	if err := json.Unmarshal([]byte(resp.Node.Value), &env); err != nil {
+		glog.Errorf("Failed to unmarshal %s: %v", resp.Node.Value, err)
+		return false, err
+	}
+	if locked, _ := env["is_locked"].(bool); !locked {
+		return false, nil
+	}
+	delete(env, "is_locked")
+	buf, err := json.Marshal(env)
+	if err != nil {
+		return false, err
+	}
+	_, err = client.CompareAndSwap(key, string(buf), 0, resp.Node.Value, 0)
+	if isEtcdError(err, etcdErrTestFailed) || isEtcdError(err, etcdErrKeyNotFound) {
+		return false, ErrLockChanged
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// loadLocks returns unexpired locks of all environments keyed by "<project>/<env>".
+func loadLocks(client ETCDInterface) (map[string]*Lock, error) {
+	resp, err := client.Get(locksDir, false, true)
+	if isEtcdError(err, etcdErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	locks := make(map[string]*Lock)
+	for _, proj := range resp.Node.Nodes {
+		for _, env := range proj.Nodes {
+			var l Lock
+			if err := json.Unmarshal([]byte(env.Value), &l); err != nil {
+				glog.Errorf("Skipping broken lock %s: %v", env.Key, err)
+				continue
+			}
+			if l.Expired(now) {
+				continue
+			}
+			locks[path.Join(path.Base(proj.Key), path.Base(env.Key))] = &l
+		}
+	}
+	return locks, nil
+}
+
+// SetComment will set the  comment field on an environment
+func SetComment(client ETCDInterface, projectName, projectEnv, comment string) (err error) {
+	projectString := fmt.Sprintf("/goship/projects/%s/environments/%s/comment", projectName, projectEnv)
 	// guard against empty values ( simple validation)
 	if projectName == "" || projectEnv == "" {
 		return fmt.Errorf("Missing parameters")
 	}
-	_, err = client.Set(projectString, lock, 0)
+	_, err = client.Set(projectString, comment, 0)
 	return err
 }
@@ -1,8 +1,12 @@
 package config_test
 
 import (
+	"encoding/json"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/coreos/go-etcd/etcd"
 	"github.com/gengo/goship/lib/config"
 )
 
@@ -17,24 +21,188 @@ func TestSetComment(t *testing.T) {
 	}
 }
 
-func TestLockingEnvironment(t *testing.T) {
-	const key = "/goship/projects/test_project/environments/test_environment/locked"
-	ecl := mockEtcdClient{
-		setExpectation: map[string]string{key: "true"},
+// fakeEtcdClient is an in-memory emulation of etcd which supports atomic operations.
+type fakeEtcdClient map[string]string
+
+func (cl fakeEtcdClient) Get(key string, sort, recursive bool) (*etcd.Response, error) {
+	v, ok := cl[key]
+	if !ok {
+		return nil, &etcd.EtcdError{ErrorCode: 100, Message: "Key not found", Cause: key}
+	}
+	return &etcd.Response{Action: "get", Node: &etcd.Node{Key: key, Value: v}}, nil
+}
+
+func (cl fakeEtcdClient) Set(key, value string, ttl uint64) (*etcd.Response, error) {
+	cl[key] = value
+	return &etcd.Response{Action: "set", Node: &etcd.Node{Key: key, Value: value}}, nil
+}
+
+func (cl fakeEtcdClient) Create(key, value string, ttl uint64) (*etcd.Response, error) {
+	if _, ok := cl[key]; ok {
+		return nil, &etcd.EtcdError{ErrorCode: 105, Message: "Key already exists", Cause: key}
+	}
+	return cl.Set(key, value, ttl)
+}
+
+func (cl fakeEtcdClient) CompareAndSwap(key, value string, ttl uint64, prevValue string, prevIndex uint64) (*etcd.Response, error) {
+	if v, ok := cl[key]; !ok || v != prevValue {
+		return nil, &etcd.EtcdError{ErrorCode: 101, Message: "Compare failed", Cause: key}
+	}
+	return cl.Set(key, value, ttl)
+}
+
+func (cl fakeEtcdClient) CompareAndDelete(key, prevValue string, prevIndex uint64) (*etcd.Response, error) {
+	if v, ok := cl[key]; !ok || v != prevValue {
+		return nil, &etcd.EtcdError{ErrorCode: 101, Message: "Compare failed", Cause: key}
+	}
+	delete(cl, key)
+	return &etcd.Response{Action: "compareAndDelete", Node: &etcd.Node{Key: key}}, nil
+}
+
+func TestAcquireLock(t *testing.T) {
+	ecl := make(fakeEtcdClient)
+	now := time.Now()
+	alice := config.Lock{Owner: "alice", Reason: "maintenance", Time: now}
+	if err := config.AcquireLock(ecl, "proj", "prod", alice); err != nil {
+		t.Fatalf("config.AcquireLock(ecl, %q, %q, %#v) failed with %v; want success", "proj", "prod", alice, err)
+	}
+	bob := config.Lock{Owner: "bob", Time: now}
+	if err := config.AcquireLock(ecl, "proj", "prod", bob); err != config.ErrLocked {
+		t.Errorf("config.AcquireLock(ecl, %q, %q, %#v) failed with %v; want %v", "proj", "prod", bob, err, config.ErrLocked)
+	}
+	if err := config.AcquireLock(ecl, "proj", "staging", bob); err != nil {
+		t.Errorf("config.AcquireLock(ecl, %q, %q, %#v) failed with %v; want success", "proj", "staging", bob, err)
 	}
-	err := config.LockEnvironment(ecl, "test_project", "test_environment", "true")
+
+	// The owner can update the lock.
+	alice.Reason = "extended maintenance"
+	alice.Expiry = now.Add(time.Hour)
+	if err := config.AcquireLock(ecl, "proj", "prod", alice); err != nil {
+		t.Errorf("config.AcquireLock(ecl, %q, %q, %#v) failed with %v; want success", "proj", "prod", alice, err)
+	}
+	l, err := config.GetLock(ecl, "proj", "prod")
 	if err != nil {
-		t.Fatalf("Can't lock %s", err)
+		t.Fatalf("config.GetLock(ecl, %q, %q) failed with %v; want success", "proj", "prod", err)
+	}
+	if l == nil || l.Owner != "alice" || l.Reason != alice.Reason || !l.Expiry.Equal(alice.Expiry) {
+		t.Errorf("config.GetLock(ecl, %q, %q) = %#v; want %#v", "proj", "prod", l, alice)
+	}
+}
+
+// ttlRecorder is a fakeEtcdClient which records TTLs of nodes.
+type ttlRecorder struct {
+	fakeEtcdClient
+	ttls map[string]uint64
+}
+
+func (cl ttlRecorder) Create(key, value string, ttl uint64) (*etcd.Response, error) {
+	cl.ttls[key] = ttl
+	return cl.fakeEtcdClient.Create(key, value, ttl)
+}
+
+func (cl ttlRecorder) CompareAndSwap(key, value string, ttl uint64, prevValue string, prevIndex uint64) (*etcd.Response, error) {
+	cl.ttls[key] = ttl
+	return cl.fakeEtcdClient.CompareAndSwap(key, value, ttl, prevValue, prevIndex)
+}
+
+func TestLockingEnvironment(t *testing.T) {
+	ecl := ttlRecorder{fakeEtcdClient: make(fakeEtcdClient), ttls: make(map[string]uint64)}
+	const key = "/goship/locks/test_project/test_environment"
+	now := time.Now()
+	// The lock was taken a day ago and is saved again.
+	l := config.Lock{Owner: "alice", Time: now.Add(-24 * time.Hour), Expiry: now.Add(time.Hour)}
+	if err := config.AcquireLock(ecl, "test_project", "test_environment", l); err != nil {
+		t.Fatalf("config.AcquireLock(ecl, %q, %q, %#v) failed with %v; want success", "test_project", "test_environment", l, err)
+	}
+	if got := ecl.ttls[key]; got < 3500 || got > 3600 {
+		t.Errorf("TTL of %s = %d; want about 3600", key, got)
+	}
+
+	expired := config.Lock{Owner: "alice", Time: now.Add(-2 * time.Hour), Expiry: now.Add(-time.Hour)}
+	if err := config.AcquireLock(ecl, "test_project", "test_environment", expired); err == nil {
+		t.Errorf("config.AcquireLock(ecl, %q, %q, %#v) succeeded; want failure", "test_project", "test_environment", expired)
 	}
 }
 
 func TestUnlockingEnvironment(t *testing.T) {
-	const key = "/goship/projects/test_project/environments/test_environment/locked"
-	ecl := mockEtcdClient{
-		setExpectation: map[string]string{key: "false"},
+	ecl := make(fakeEtcdClient)
+	const key = "/goship/projects/test_project/environments/test_environment"
+	ecl[key] = `{"deploy": "deploy-command", "is_locked": true}`
+
+	// Environments locked by is_locked can be unlocked.
+	if err := config.ReleaseLock(ecl, "test_project", "test_environment", "bob", false); err != nil {
+		t.Fatalf("config.ReleaseLock(ecl, %q, %q, %q, false) failed with %v; want success", "test_project", "test_environment", "bob", err)
+	}
+	var env config.Environment
+	if err := json.Unmarshal([]byte(ecl[key]), &env); err != nil {
+		t.Fatalf("json.Unmarshal(%q, &env) failed with %v; want success", ecl[key], err)
+	}
+	if env.IsLocked || env.Deploy != "deploy-command" {
+		t.Errorf("env = %#v; want unlocked with the deploy command kept", env)
+	}
+	if err := config.ReleaseLock(ecl, "test_project", "test_environment", "bob", false); err != config.ErrNotLocked {
+		t.Errorf("config.ReleaseLock(ecl, %q, %q, %q, false) failed with %v; want %v", "test_project", "test_environment", "bob", err, config.ErrNotLocked)
+	}
+
+	// Both locks are released at once.
+	ecl[key] = `{"deploy": "deploy-command", "is_locked": true}`
+	alice := config.Lock{Owner: "alice", Time: time.Now()}
+	if err := config.AcquireLock(ecl, "test_project", "test_environment", alice); err != nil {
+		t.Fatalf("config.AcquireLock(ecl, %q, %q, %#v) failed with %v; want success", "test_project", "test_environment", alice, err)
+	}
+	if err := config.ReleaseLock(ecl, "test_project", "test_environment", "bob", false); err != config.ErrNotLockOwner {
+		t.Errorf("config.ReleaseLock(ecl, %q, %q, %q, false) failed with %v; want %v", "test_project", "test_environment", "bob", err, config.ErrNotLockOwner)
+	}
+	if err := config.ReleaseLock(ecl, "test_project", "test_environment", "alice", false); err != nil {
+		t.Errorf("config.ReleaseLock(ecl, %q, %q, %q, false) failed with %v; want success", "test_project", "test_environment", "alice", err)
+	}
+	if l, err := config.GetLock(ecl, "test_project", "test_environment"); err != nil || l != nil {
+		t.Errorf("config.GetLock(ecl, %q, %q) = %#v, %v; want nil, <nil>", "test_project", "test_environment", l, err)
 	}
-	err := config.LockEnvironment(ecl, "test_project", "test_environment", "false")
+	if v := ecl[key]; strings.Contains(v, "is_locked") {
+		t.Errorf("configuration of the environment = %q; want is_locked cleared", v)
+	}
+}
+
+func TestAcquireExpiredLock(t *testing.T) {
+	ecl := make(fakeEtcdClient)
+	now := time.Now()
+	// etcd may keep an expired lock for a while.
+	alice := config.Lock{Owner: "alice", Time: now.Add(-2 * time.Hour), Expiry: now.Add(-time.Hour)}
+	buf, err := json.Marshal(alice)
 	if err != nil {
-		t.Fatalf("Can't unlock %s", err)
+		t.Fatalf("json.Marshal(%#v) failed with %v; want success", alice, err)
+	}
+	ecl["/goship/locks/proj/prod"] = string(buf)
+	if l, err := config.GetLock(ecl, "proj", "prod"); err != nil || l != nil {
+		t.Errorf("config.GetLock(ecl, %q, %q) = %#v, %v; want nil, <nil>", "proj", "prod", l, err)
+	}
+	bob := config.Lock{Owner: "bob", Time: now}
+	if err := config.AcquireLock(ecl, "proj", "prod", bob); err != nil {
+		t.Errorf("config.AcquireLock(ecl, %q, %q, %#v) failed with %v; want success", "proj", "prod", bob, err)
+	}
+}
+
+func TestReleaseLock(t *testing.T) {
+	ecl := make(fakeEtcdClient)
+	alice := config.Lock{Owner: "alice", Time: time.Now()}
+	if err := config.AcquireLock(ecl, "proj", "prod", alice); err != nil {
+		t.Fatalf("config.AcquireLock(ecl, %q, %q, %#v) failed with %v; want success", "proj", "prod", alice, err)
+	}
+	if err := config.ReleaseLock(ecl, "proj", "prod", "bob", false); err != config.ErrNotLockOwner {
+		t.Errorf("config.ReleaseLock(ecl, %q, %q, %q, false) failed with %v; want %v", "proj", "prod", "bob", err, config.ErrNotLockOwner)
+	}
+	if err := config.ReleaseLock(ecl, "proj", "prod", "alice", false); err != nil {
+		t.Errorf("config.ReleaseLock(ecl, %q, %q, %q, false) failed with %v; want success", "proj", "prod", "alice", err)
+	}
+	if err := config.ReleaseLock(ecl, "proj", "prod", "alice", false); err != config.ErrNotLocked {
+		t.Errorf("config.ReleaseLock(ecl, %q, %q, %q, false) failed with %v; want %v", "proj", "prod", "alice", err, config.ErrNotLocked)
+	}
+
+	if err := config.AcquireLock(ecl, "proj", "prod", alice); err != nil {
+		t.Fatalf("config.AcquireLock(ecl, %q, %q, %#v) failed with %v; want success", "proj", "prod", alice, err)
+	}
+	if err := config.ReleaseLock(ecl, "proj", "prod", "admin", true); err != nil {
+		t.Errorf("config.ReleaseLock(ecl, %q, %q, %q, true) failed with %v; want success", "proj", "prod", "admin", err)
 	}
 }
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"regexp"
@@ -8,6 +9,7 @@ import (
 	"time"
 
 	"github.com/coreos/go-etcd/etcd"
+	"github.com/gengo/goship/lib/freeze"
 	"github.com/gengo/goship/lib/pivotal"
 	"github.com/golang/glog"
 	"github.com/google/go-github/github"
@@ -24,6 +26,29 @@ type Config struct {
 	DeployUser string                `json:"deploy_user" yaml:"deploy_user"`
 	Notify     string                `json:"notify" yaml:"notify"`
 	Pivotal    *PivotalConfiguration `json:"pivotal,omitempty" yaml:"pivotal,omitempty"`
+	// Admins is a list of names of users who can override restrictions on deployments.
+	Admins []string `json:"admins,omitempty" yaml:"admins,omitempty"`
+	// Freezes is a list of freeze windows of all projects.
+	Freezes []freeze.Window `json:"freezes,omitempty" yaml:"freezes,omitempty"`
+}
+
+// ActiveFreezes returns freeze windows of "env" in "proj" which are active at "t".
+func (c Config) ActiveFreezes(proj Project, env Environment, t time.Time) []freeze.Window {
+	var windows []freeze.Window
+	windows = append(windows, c.Freezes...)
+	windows = append(windows, proj.Freezes...)
+	windows = append(windows, env.Freezes...)
+	return freeze.Active(windows, t)
+}
+
+// IsAdmin returns true if "user" is an admin.
+func (c Config) IsAdmin(user string) bool {
+	for _, a := range c.Admins {
+		if a == user {
+			return true
+		}
+	}
+	return false
 }
 
 // Project stores information about a GitHub project, such as its GitHub URL and repo name, and a list of extra columns (PluginColumns)
@@ -39,6 +64,29 @@ type Project struct {
 	// Source is an additional revision control system.
 	// It is effective only if RepoType does not serve source codes.
 	Source *Repo `json:"source,omitempty" yaml:"source,omitempty"`
+	// DeployTimeout is the default deadline of deploy commands of the environments in the project.
+	DeployTimeout Duration `json:"deploy_timeout,omitempty" yaml:"deploy_timeout,omitempty"`
+	// Freezes is a list of freeze windows of the environments in the project.
+	Freezes []freeze.Window `json:"freezes,omitempty" yaml:"freezes,omitempty"`
+	// Pipeline is an ordered list of names of environments, e.g. staging, preprod and production.
+	// A revision running in a stage can be promoted to the next stage.
+	Pipeline []string `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
+	// SoakTime is how long a revision must have been successfully running in a stage
+	// before it is promoted to the next stage. No soak time is required if it is 0.
+	SoakTime Duration `json:"soak_time,omitempty" yaml:"soak_time,omitempty"`
+	// Retention configures how long outputs of deployments in the project are kept.
+	Retention *Retention `json:"retention,omitempty" yaml:"retention,omitempty"`
+}
+
+// PreviousStage returns the name of the stage before "env" in the pipeline of "p".
+// It returns an empty string if "env" is not in the pipeline or is the first stage.
+func (p Project) PreviousStage(env string) string {
+	for i, name := range p.Pipeline {
+		if name == env && i > 0 {
+			return p.Pipeline[i-1]
+		}
+	}
+	return ""
 }
 
 func (p Project) SourceRepo() Repo {
@@ -91,6 +139,245 @@ type Environment struct {
 	Comment      string   `json:"comment" yaml:"comment"`
 	IsLocked     bool     `json:"is_locked,omitempty" yaml:"is_locked,omitempty"`
 	K8sNamespace string   `json:"k8s_namespace" yaml:"k8s_namespace"`
+	// DeployArgs is argv of the deploy command. It is used instead of Deploy if not empty.
+	DeployArgs []string `json:"deploy_args,omitempty" yaml:"deploy_args,omitempty"`
+	// Env is a set of extra environment variables of the deploy command.
+	Env map[string]string `json:"env,omitempty" yaml:"env,omitempty"`
+	// DeployTimeout is the deadline of the deploy command. It overrides the one of the project.
+	DeployTimeout Duration `json:"deploy_timeout,omitempty" yaml:"deploy_timeout,omitempty"`
+	// Freezes is a list of freeze windows of the environment.
+	Freezes []freeze.Window `json:"freezes,omitempty" yaml:"freezes,omitempty"`
+	// PreDeploy is a list of hooks which run before the deploy command.
+	PreDeploy []Hook `json:"pre_deploy,omitempty" yaml:"pre_deploy,omitempty"`
+	// PostDeploy is a list of hooks which run after the deploy command succeeds.
+	PostDeploy []Hook `json:"post_deploy,omitempty" yaml:"post_deploy,omitempty"`
+	// Rollout configures rolling deployments. The deploy command runs once for all the hosts if it is nil.
+	Rollout *Rollout `json:"rollout,omitempty" yaml:"rollout,omitempty"`
+	// HealthCheck is an optional check of the environment after deployments.
+	HealthCheck *HealthCheck `json:"health_check,omitempty" yaml:"health_check,omitempty"`
+	// RequiresApproval is true if deployments into the environment must be approved by another user.
+	RequiresApproval bool `json:"requires_approval,omitempty" yaml:"requires_approval,omitempty"`
+	// ApprovalExpiry is how long approval requests are valid. It defaults to DefaultApprovalExpiry.
+	ApprovalExpiry Duration `json:"approval_expiry,omitempty" yaml:"approval_expiry,omitempty"`
+	// Lock is the current lock of the environment. It is nil if nobody holds the lock.
+	// It is stored separately from the configuration.
+	Lock *Lock `json:"-" yaml:"-"`
+}
+
+// Locked returns true if deployments into "e" are prohibited either by IsLocked or by Lock.
+func (e Environment) Locked() bool {
+	return e.IsLocked || e.Lock != nil
+}
+
+// HookPolicy is what to do when a hook fails.
+type HookPolicy string
+
+const (
+	// HookAbort fails the deployment. It is the default.
+	HookAbort = HookPolicy("abort")
+	// HookWarn records a warning in the deployment and continues.
+	HookWarn = HookPolicy("warn")
+	// HookIgnore continues the deployment as if the hook succeeded.
+	HookIgnore = HookPolicy("ignore")
+)
+
+// Hook is a command which runs before or after the deploy command, e.g. database migrations.
+type Hook struct {
+	// Name describes the hook. Defaults to Command.
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+	// Command is the command of the hook. It is expanded in the same way as the deploy command.
+	Command string `json:"command" yaml:"command"`
+	// OnFailure is the policy on failure of the hook. Defaults to HookAbort.
+	OnFailure HookPolicy `json:"on_failure,omitempty" yaml:"on_failure,omitempty"`
+}
+
+// String returns the name of the hook.
+func (h Hook) String() string {
+	if h.Name != "" {
+		return h.Name
+	}
+	return h.Command
+}
+
+// Policy returns the policy on failure of the hook.
+func (h Hook) Policy() HookPolicy {
+	if h.OnFailure == "" {
+		return HookAbort
+	}
+	return h.OnFailure
+}
+
+// Validate returns an error if "h" is not a valid hook.
+func (h Hook) Validate() error {
+	if h.Command == "" {
+		return fmt.Errorf("no command in hook %q", h.Name)
+	}
+	switch h.Policy() {
+	case HookAbort, HookWarn, HookIgnore:
+		return nil
+	}
+	return fmt.Errorf("unknown on_failure %q of hook %q", h.OnFailure, h)
+}
+
+// Rollout configures rolling deployments, which run the deploy command for each batch of hosts.
+type Rollout struct {
+	// BatchSize is the number of hosts deployed at once.
+	BatchSize int `json:"batch_size" yaml:"batch_size"`
+	// Verify is an optional command which runs after each batch. The rollout stops if it fails.
+	// It is expanded in the same way as the deploy command, and {{.Hosts}} refers to the hosts in the batch.
+	Verify string `json:"verify,omitempty" yaml:"verify,omitempty"`
+}
+
+// Batches splits "hosts" into batches of r.BatchSize hosts.
+func (r Rollout) Batches(hosts []string) [][]string {
+	size := r.BatchSize
+	if size <= 0 {
+		size = 1
+	}
+	var batches [][]string
+	for len(hosts) > 0 {
+		n := size
+		if n > len(hosts) {
+			n = len(hosts)
+		}
+		batches = append(batches, hosts[:n])
+		hosts = hosts[n:]
+	}
+	return batches
+}
+
+// HealthCheck is a health check of an environment after deployments. health.Run runs it.
+// Either URL or Command must be set.
+type HealthCheck struct {
+	// URL is an HTTP URL which is expected to respond with Status to GET requests.
+	// If it contains "{{.Host}}", it is checked for each host with the placeholder replaced with the name of the host.
+	URL string `json:"url,omitempty" yaml:"url,omitempty"`
+	// Status is the expected HTTP status code. Defaults to 200.
+	Status int `json:"status,omitempty" yaml:"status,omitempty"`
+	// Command is a command which runs over SSH on each host. It passes if the command exits with 0.
+	Command string `json:"command,omitempty" yaml:"command,omitempty"`
+	// Timeout is how long the check is retried after the deployment, e.g. "5m". Defaults to health.DefaultTimeout if it is zero.
+	Timeout Duration `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	// Interval is the interval between attempts, e.g. "10s". Defaults to health.DefaultInterval if it is zero.
+	Interval Duration `json:"interval,omitempty" yaml:"interval,omitempty"`
+	// Rollback is true if the environment should be rolled back to the previous revision when the check fails.
+	Rollback bool `json:"rollback,omitempty" yaml:"rollback,omitempty"`
+}
+
+// Validate returns an error if "c" is not a valid health check.
+func (c HealthCheck) Validate() error {
+	if (c.URL == "") == (c.Command == "") {
+		return fmt.Errorf("either url or command must be specified in a health check")
+	}
+	if c.Timeout < 0 || c.Interval < 0 {
+		return fmt.Errorf("timeout and interval of a health check must not be negative")
+	}
+	return nil
+}
+
+// DeployTimeout returns the deadline of deploy commands of "env" in "proj".
+// It returns 0 if there is no deadline.
+func DeployTimeout(proj Project, env Environment) time.Duration {
+	if env.DeployTimeout > 0 {
+		return time.Duration(env.DeployTimeout)
+	}
+	return time.Duration(proj.DeployTimeout)
+}
+
+// DefaultApprovalExpiry is the default validity of approval requests of deployments.
+const DefaultApprovalExpiry = time.Hour
+
+// ApprovalExpiry returns how long approval requests of deployments into "env" are valid.
+func ApprovalExpiry(env Environment) time.Duration {
+	if env.ApprovalExpiry > 0 {
+		return time.Duration(env.ApprovalExpiry)
+	}
+	return DefaultApprovalExpiry
+}
+
+// Retention configures how outputs of deployments are kept in the data directory.
+//
+// The output of a finished deployment is removed unless it is kept by KeepDeploys or KeepFor.
+// All outputs are kept if neither is set.
+type Retention struct {
+	// KeepDeploys is the number of the latest deployments in each environment whose outputs are kept.
+	KeepDeploys int `json:"keep_deploys,omitempty" yaml:"keep_deploys,omitempty"`
+	// KeepFor is how long outputs are kept after deployments, e.g. "720h".
+	KeepFor Duration `json:"keep_for,omitempty" yaml:"keep_for,omitempty"`
+	// CompressAfter is how long after deployments finish their outputs are compressed.
+	// Outputs are not compressed if it is not set.
+	CompressAfter Duration `json:"compress_after,omitempty" yaml:"compress_after,omitempty"`
+	// MaxOutputSize is the maximum size of the output of a deployment in bytes.
+	// The rest of the output is discarded. Defaults to the limit given to Goship.
+	MaxOutputSize int64 `json:"max_output_size,omitempty" yaml:"max_output_size,omitempty"`
+}
+
+// Validate returns an error if "r" is not a valid retention policy.
+func (r Retention) Validate() error {
+	if r.KeepDeploys < 0 || r.KeepFor < 0 || r.CompressAfter < 0 || r.MaxOutputSize < 0 {
+		return fmt.Errorf("retention must not be negative")
+	}
+	return nil
+}
+
+// Kept returns true if "r" keeps the output of the "n"th latest deployment (0-origin) of an environment which started at "t".
+func (r *Retention) Kept(n int, t, now time.Time) bool {
+	if r == nil || (r.KeepDeploys == 0 && r.KeepFor == 0) {
+		return true
+	}
+	if r.KeepDeploys > 0 && n < r.KeepDeploys {
+		return true
+	}
+	return r.KeepFor > 0 && now.Sub(t) < time.Duration(r.KeepFor)
+}
+
+// CompressionDelay returns how long after deployments finish "r" compresses their outputs.
+// It returns 0 if "r" does not compress outputs.
+func (r *Retention) CompressionDelay() time.Duration {
+	if r == nil {
+		return 0
+	}
+	return time.Duration(r.CompressAfter)
+}
+
+// Duration is a time.Duration which is encoded as a string like "1h30m" in configurations.
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(buf []byte) error {
+	var s string
+	if err := json.Unmarshal(buf, &s); err != nil {
+		return err
+	}
+	return d.parse(s)
+}
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return d.String(), nil
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	return d.parse(s)
+}
+
+func (d *Duration) parse(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
 }
 
 // Repo identifies a revision repository
@@ -212,4 +499,7 @@ func EnvironmentFromName(projects []Project, projectName, environmentName string
 type ETCDInterface interface {
 	Get(string, bool, bool) (*etcd.Response, error)
 	Set(string, string, uint64) (*etcd.Response, error)
+	Create(string, string, uint64) (*etcd.Response, error)
+	CompareAndSwap(string, string, uint64, string, uint64) (*etcd.Response, error)
+	CompareAndDelete(string, string, uint64) (*etcd.Response, error)
 }
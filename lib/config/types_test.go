@@ -1,8 +1,10 @@
 package config_test
 
 import (
+	"encoding/json"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/gengo/goship/lib/config"
 )
@@ -41,3 +43,214 @@ func TestGetEnvironmentFromName(t *testing.T) {
 		t.Errorf("config.EnvironmentFromName error case did not error")
 	}
 }
+
+func TestPreviousStage(t *testing.T) {
+	p := config.Project{Pipeline: []string{"staging", "preprod", "production"}}
+	for _, spec := range []struct {
+		env  string
+		want string
+	}{
+		{env: "staging", want: ""},
+		{env: "preprod", want: "staging"},
+		{env: "production", want: "preprod"},
+		{env: "qa", want: ""},
+	} {
+		if got, want := p.PreviousStage(spec.env), spec.want; got != want {
+			t.Errorf("p.PreviousStage(%q) = %q; want %q", spec.env, got, want)
+		}
+	}
+}
+
+func TestHookValidate(t *testing.T) {
+	for _, h := range []config.Hook{
+		{Command: "rake db:migrate"},
+		{Name: "purge", Command: "purge-cache", OnFailure: config.HookWarn},
+		{Command: "notify", OnFailure: config.HookIgnore},
+	} {
+		if err := h.Validate(); err != nil {
+			t.Errorf("%#v.Validate() failed with %v; want success", h, err)
+		}
+	}
+	for _, h := range []config.Hook{
+		{Name: "empty"},
+		{Command: "rake db:migrate", OnFailure: "retry"},
+	} {
+		if err := h.Validate(); err == nil {
+			t.Errorf("%#v.Validate() succeeded; want failure", h)
+		}
+	}
+}
+
+func TestRolloutBatches(t *testing.T) {
+	hosts := []string{"host1", "host2", "host3", "host4", "host5"}
+	for _, spec := range []struct {
+		size int
+		want [][]string
+	}{
+		{
+			size: 1,
+			want: [][]string{{"host1"}, {"host2"}, {"host3"}, {"host4"}, {"host5"}},
+		},
+		{
+			size: 2,
+			want: [][]string{{"host1", "host2"}, {"host3", "host4"}, {"host5"}},
+		},
+		{
+			size: 10,
+			want: [][]string{hosts},
+		},
+	} {
+		r := config.Rollout{BatchSize: spec.size}
+		if got, want := r.Batches(hosts), spec.want; !reflect.DeepEqual(got, want) {
+			t.Errorf("r.Batches(%q) = %q; want %q with batch size %d", hosts, got, want, spec.size)
+		}
+	}
+}
+
+func TestHealthCheckValidate(t *testing.T) {
+	for _, c := range []config.HealthCheck{
+		{URL: "http://example.com/health"},
+		{Command: "service foo status", Timeout: config.Duration(time.Minute), Interval: config.Duration(5 * time.Second)},
+	} {
+		if err := c.Validate(); err != nil {
+			t.Errorf("%#v.Validate() failed with %v; want success", c, err)
+		}
+	}
+	for _, c := range []config.HealthCheck{
+		{},
+		{URL: "http://example.com/health", Command: "service foo status"},
+		{URL: "http://example.com/health", Timeout: config.Duration(-time.Minute)},
+		{URL: "http://example.com/health", Interval: config.Duration(-time.Second)},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("%#v.Validate() succeeded; want failure", c)
+		}
+	}
+}
+
+func TestDeployTimeout(t *testing.T) {
+	for _, spec := range []struct {
+		proj config.Project
+		env  config.Environment
+		want time.Duration
+	}{
+		{},
+		{
+			proj: config.Project{DeployTimeout: config.Duration(time.Hour)},
+			want: time.Hour,
+		},
+		{
+			proj: config.Project{DeployTimeout: config.Duration(time.Hour)},
+			env:  config.Environment{DeployTimeout: config.Duration(10 * time.Minute)},
+			want: 10 * time.Minute,
+		},
+	} {
+		if got, want := config.DeployTimeout(spec.proj, spec.env), spec.want; got != want {
+			t.Errorf("config.DeployTimeout(%#v, %#v) = %v; want %v", spec.proj, spec.env, got, want)
+		}
+	}
+}
+
+func TestApprovalExpiry(t *testing.T) {
+	for _, spec := range []struct {
+		env  config.Environment
+		want time.Duration
+	}{
+		{want: config.DefaultApprovalExpiry},
+		{
+			env:  config.Environment{ApprovalExpiry: config.Duration(30 * time.Minute)},
+			want: 30 * time.Minute,
+		},
+	} {
+		if got, want := config.ApprovalExpiry(spec.env), spec.want; got != want {
+			t.Errorf("config.ApprovalExpiry(%#v) = %v; want %v", spec.env, got, want)
+		}
+	}
+}
+
+func TestRetentionKept(t *testing.T) {
+	now := time.Date(2016, 1, 10, 0, 0, 0, 0, time.UTC)
+	for _, spec := range []struct {
+		r    *config.Retention
+		n    int
+		age  time.Duration
+		want bool
+	}{
+		{n: 100, age: 1000 * time.Hour, want: true},
+		{r: &config.Retention{CompressAfter: config.Duration(time.Hour)}, n: 100, age: 1000 * time.Hour, want: true},
+		{r: &config.Retention{KeepDeploys: 3}, n: 2, age: 1000 * time.Hour, want: true},
+		{r: &config.Retention{KeepDeploys: 3}, n: 3, want: false},
+		{r: &config.Retention{KeepFor: config.Duration(24 * time.Hour)}, n: 100, age: time.Hour, want: true},
+		{r: &config.Retention{KeepFor: config.Duration(24 * time.Hour)}, age: 25 * time.Hour, want: false},
+		{r: &config.Retention{KeepDeploys: 3, KeepFor: config.Duration(24 * time.Hour)}, n: 5, age: time.Hour, want: true},
+		{r: &config.Retention{KeepDeploys: 3, KeepFor: config.Duration(24 * time.Hour)}, n: 5, age: 25 * time.Hour, want: false},
+	} {
+		if got, want := spec.r.Kept(spec.n, now.Add(-spec.age), now), spec.want; got != want {
+			t.Errorf("%#v.Kept(%d, %v, %v) = %v; want %v", spec.r, spec.n, now.Add(-spec.age), now, got, want)
+		}
+	}
+}
+
+func TestRetentionCompressionDelay(t *testing.T) {
+	for _, spec := range []struct {
+		r    *config.Retention
+		want time.Duration
+	}{
+		{want: 0},
+		{r: &config.Retention{KeepDeploys: 3}, want: 0},
+		{r: &config.Retention{CompressAfter: config.Duration(time.Hour)}, want: time.Hour},
+	} {
+		if got := spec.r.CompressionDelay(); got != spec.want {
+			t.Errorf("%#v.CompressionDelay() = %v; want %v", spec.r, got, spec.want)
+		}
+	}
+}
+
+func TestRetentionValidate(t *testing.T) {
+	for _, r := range []config.Retention{
+		{KeepDeploys: -1},
+		{KeepFor: config.Duration(-time.Hour)},
+		{CompressAfter: config.Duration(-time.Hour)},
+		{MaxOutputSize: -1},
+	} {
+		if err := r.Validate(); err == nil {
+			t.Errorf("%#v.Validate() succeeded; want failure", r)
+		}
+	}
+	r := config.Retention{KeepDeploys: 10, KeepFor: config.Duration(time.Hour), MaxOutputSize: 1 << 20}
+	if err := r.Validate(); err != nil {
+		t.Errorf("%#v.Validate() failed with %v; want success", r, err)
+	}
+}
+
+func TestDurationJSON(t *testing.T) {
+	var env config.Environment
+	buf := `{"deploy_timeout": "1h30m"}`
+	if err := json.Unmarshal([]byte(buf), &env); err != nil {
+		t.Fatalf("json.Unmarshal(%q, &env) failed with %v; want success", buf, err)
+	}
+	if got, want := env.DeployTimeout, config.Duration(90*time.Minute); got != want {
+		t.Errorf("env.DeployTimeout = %v; want %v", got, want)
+	}
+
+	if err := json.Unmarshal([]byte(`{"deploy_timeout": "forever"}`), &env); err == nil {
+		t.Errorf("json.Unmarshal succeeded with an invalid duration; want failure")
+	}
+}
+
+func TestIsAdmin(t *testing.T) {
+	c := config.Config{Admins: []string{"alice", "bob"}}
+	for _, spec := range []struct {
+		user string
+		want bool
+	}{
+		{user: "alice", want: true},
+		{user: "bob", want: true},
+		{user: "carol", want: false},
+		{user: "", want: false},
+	} {
+		if got, want := c.IsAdmin(spec.user), spec.want; got != want {
+			t.Errorf("c.IsAdmin(%q) = %v; want %v", spec.user, got, want)
+		}
+	}
+}
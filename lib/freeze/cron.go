@@ -0,0 +1,133 @@
+package freeze
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cron is a parsed cron-like expression "minute hour day-of-month month day-of-week".
+type cron struct {
+	minute, hour, dom, month, dow []bool
+	// domAny and dowAny are true if the fields are "*".
+	domAny, dowAny bool
+}
+
+// parseCron parses a cron-like expression with five fields.
+// Each field accepts "*", numbers, ranges "a-b", steps "*/n" or "a-b/n" and comma-separated lists of them.
+// Day-of-week is 0 (Sunday) to 6 (Saturday), and 7 also means Sunday.
+func parseCron(expr string) (*cron, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression must have 5 fields: %q", expr)
+	}
+	var (
+		c   cron
+		err error
+	)
+	for _, f := range []struct {
+		field    string
+		min, max int
+		dest     *[]bool
+	}{
+		{fields[0], 0, 59, &c.minute},
+		{fields[1], 0, 23, &c.hour},
+		{fields[2], 1, 31, &c.dom},
+		{fields[3], 1, 12, &c.month},
+		{fields[4], 0, 7, &c.dow},
+	} {
+		if *f.dest, err = parseField(f.field, f.min, f.max); err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %v", expr, err)
+		}
+	}
+	if c.dow[7] {
+		c.dow[0] = true
+	}
+	c.domAny, c.dowAny = fields[2] == "*", fields[4] == "*"
+	return &c, nil
+}
+
+// parseField parses a field of a cron expression whose values range from "min" to "max".
+func parseField(field string, min, max int) ([]bool, error) {
+	set := make([]bool, max+1)
+	for _, item := range strings.Split(field, ",") {
+		rng, step := item, 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(item[i+1:]); err != nil || step <= 0 {
+				return nil, fmt.Errorf("invalid step in %q", item)
+			}
+			rng = item[:i]
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			var err error
+			bounds := strings.SplitN(rng, "-", 2)
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("invalid value in %q", item)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("invalid value in %q", item)
+				}
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("%q out of range %d-%d", item, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+// last returns the latest time in minutes which matches "c" in the range ("since", "t"].
+// It returns false if there is no such time.
+// It looks for the time day by day so that it does not check every minute of long ranges.
+func (c *cron) last(since, t time.Time) (time.Time, bool) {
+	loc := t.Location()
+	y, m, d := t.Date()
+	hour, minute := t.Hour(), t.Minute()
+	for time.Date(y, m, d, 23, 59, 0, 0, loc).After(since) {
+		if c.matchDay(time.Date(y, m, d, 0, 0, 0, 0, loc)) {
+			for h := hour; h >= 0; h-- {
+				// Only the first hour is limited by the minute of "t".
+				top := 59
+				if h == hour {
+					top = minute
+				}
+				if !c.hour[h] {
+					continue
+				}
+				for mi := top; mi >= 0; mi-- {
+					if !c.minute[mi] {
+						continue
+					}
+					if start := time.Date(y, m, d, h, mi, 0, 0, loc); start.After(since) {
+						return start, true
+					}
+					return time.Time{}, false
+				}
+			}
+		}
+		y, m, d = time.Date(y, m, d-1, 0, 0, 0, 0, loc).Date()
+		hour, minute = 23, 59
+	}
+	return time.Time{}, false
+}
+
+// matchDay returns true if the date of "t" matches "c".
+func (c *cron) matchDay(t time.Time) bool {
+	if !c.month[int(t.Month())] {
+		return false
+	}
+	dom, dow := c.dom[t.Day()], c.dow[int(t.Weekday())]
+	// Same as the standard cron, either of day-of-month or day-of-week can match if both are restricted.
+	if !c.domAny && !c.dowAny {
+		return dom || dow
+	}
+	return dom && dow
+}
@@ -0,0 +1,142 @@
+// Package freeze decides if deployments are frozen by scheduled freeze windows.
+package freeze
+
+import (
+	"fmt"
+	"time"
+)
+
+// TimeLayout is the layout of absolute times of windows.
+const TimeLayout = "2006-01-02 15:04"
+
+// Window is a period when deployments are prohibited.
+//
+// A window is either recurring or absolute.
+// A recurring window starts at every time matching Cron and lasts for Duration.
+// An absolute window lasts from Start until End.
+type Window struct {
+	// Name describes the window, e.g. "weekend".
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+	// Cron is a cron-like expression "minute hour day-of-month month day-of-week" of the start of recurring windows.
+	// e.g. "0 18 * * 5" starts a window at 18:00 on every Friday.
+	Cron string `json:"cron,omitempty" yaml:"cron,omitempty"`
+	// Duration is the length of recurring windows, e.g. "62h".
+	Duration string `json:"duration,omitempty" yaml:"duration,omitempty"`
+	// Start and End are the beginning and the end of an absolute window in TimeLayout.
+	Start string `json:"start,omitempty" yaml:"start,omitempty"`
+	End   string `json:"end,omitempty" yaml:"end,omitempty"`
+	// TimeZone is the name of the time zone of Cron, Start and End, e.g. "Asia/Tokyo". Defaults to UTC.
+	TimeZone string `json:"time_zone,omitempty" yaml:"time_zone,omitempty"`
+
+	// parsed is the window parsed by Compile.
+	parsed *schedule
+}
+
+// schedule is a parsed Window.
+type schedule struct {
+	cron       *cron
+	duration   time.Duration
+	start, end time.Time
+	loc        *time.Location
+}
+
+func (w Window) parse() (*schedule, error) {
+	s := schedule{loc: time.UTC}
+	if w.TimeZone != "" {
+		loc, err := time.LoadLocation(w.TimeZone)
+		if err != nil {
+			return nil, err
+		}
+		s.loc = loc
+	}
+	switch {
+	case w.Cron != "" && (w.Start != "" || w.End != ""):
+		return nil, fmt.Errorf("freeze window %q has both cron and start/end", w.Name)
+	case w.Cron != "":
+		var err error
+		if s.cron, err = parseCron(w.Cron); err != nil {
+			return nil, err
+		}
+		if s.duration, err = time.ParseDuration(w.Duration); err != nil {
+			return nil, fmt.Errorf("invalid duration of freeze window %q: %v", w.Name, err)
+		}
+		if s.duration <= 0 {
+			return nil, fmt.Errorf("non-positive duration of freeze window %q", w.Name)
+		}
+	case w.Start != "" && w.End != "":
+		var err error
+		if s.start, err = time.ParseInLocation(TimeLayout, w.Start, s.loc); err != nil {
+			return nil, err
+		}
+		if s.end, err = time.ParseInLocation(TimeLayout, w.End, s.loc); err != nil {
+			return nil, err
+		}
+		if !s.start.Before(s.end) {
+			return nil, fmt.Errorf("freeze window %q ends before it starts", w.Name)
+		}
+	default:
+		return nil, fmt.Errorf("freeze window %q has neither cron nor start/end", w.Name)
+	}
+	return &s, nil
+}
+
+// Validate returns an error if "w" is malformed.
+func (w Window) Validate() error {
+	_, err := w.parse()
+	return err
+}
+
+// Compile parses "w" so that Active does not parse it on every call.
+// It returns an error if "w" is malformed.
+func (w *Window) Compile() error {
+	s, err := w.parse()
+	if err != nil {
+		return err
+	}
+	w.parsed = s
+	return nil
+}
+
+// Active returns true if "t" is in "w".
+// Malformed windows are always active so that they fail safe.
+func (w Window) Active(t time.Time) bool {
+	s := w.parsed
+	if s == nil {
+		var err error
+		if s, err = w.parse(); err != nil {
+			return true
+		}
+	}
+	if s.cron == nil {
+		return !t.Before(s.start) && t.Before(s.end)
+	}
+	t = t.In(s.loc)
+	_, ok := s.cron.last(t.Add(-s.duration), t)
+	return ok
+}
+
+func (w Window) String() string {
+	name := w.Name
+	if name == "" {
+		name = "freeze"
+	}
+	tz := w.TimeZone
+	if tz == "" {
+		tz = "UTC"
+	}
+	if w.Cron != "" {
+		return fmt.Sprintf("%s (%q for %s, %s)", name, w.Cron, w.Duration, tz)
+	}
+	return fmt.Sprintf("%s (%s - %s, %s)", name, w.Start, w.End, tz)
+}
+
+// Active returns windows in "windows" which are active at "t".
+func Active(windows []Window, t time.Time) []Window {
+	var active []Window
+	for _, w := range windows {
+		if w.Active(t) {
+			active = append(active, w)
+		}
+	}
+	return active
+}
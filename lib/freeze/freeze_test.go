@@ -0,0 +1,132 @@
+package freeze
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	for _, expr := range []string{
+		"* * * * *",
+		"0 18 * * 5",
+		"*/15 9-17 1,15 * 1-5",
+		"0 0 25 12 *",
+		"30 0-23/2 * 1-6/2 7",
+	} {
+		if _, err := parseCron(expr); err != nil {
+			t.Errorf("parseCron(%q) failed with %v; want success", expr, err)
+		}
+	}
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+	} {
+		if c, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) = %#v; want failure", expr, c)
+		}
+	}
+}
+
+func TestWindowActive(t *testing.T) {
+	jst, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skipf("time zone database is not available: %v", err)
+	}
+	weekend := Window{Name: "weekend", Cron: "0 18 * * 5", Duration: "62h", TimeZone: "Asia/Tokyo"}
+	holidays := Window{Name: "holidays", Start: "2015-12-28 00:00", End: "2016-01-04 09:00"}
+	lateStart := Window{Name: "late start", Cron: "30 18 * * 5", Duration: "62h"}
+	business := Window{Name: "business", Cron: "*/15 9-17 * * 1-5", Duration: "15m"}
+	halfYear := Window{Name: "half year", Cron: "0 0 1 1 *", Duration: "4380h"}
+	for _, spec := range []struct {
+		w    Window
+		t    time.Time
+		want bool
+	}{
+		// 2015-10-16 is Friday.
+		{w: weekend, t: time.Date(2015, 10, 16, 17, 59, 0, 0, jst), want: false},
+		{w: weekend, t: time.Date(2015, 10, 16, 18, 0, 0, 0, jst), want: true},
+		{w: weekend, t: time.Date(2015, 10, 18, 12, 0, 0, 0, jst), want: true},
+		{w: weekend, t: time.Date(2015, 10, 19, 7, 59, 0, 0, jst), want: true},
+		{w: weekend, t: time.Date(2015, 10, 19, 8, 0, 0, 0, jst), want: false},
+		// 18:00 JST on Friday is 09:00 UTC.
+		{w: weekend, t: time.Date(2015, 10, 16, 9, 30, 0, 0, time.UTC), want: true},
+		{w: weekend, t: time.Date(2015, 10, 21, 12, 0, 0, 0, jst), want: false},
+
+		{w: holidays, t: time.Date(2015, 12, 27, 23, 59, 0, 0, time.UTC), want: false},
+		{w: holidays, t: time.Date(2015, 12, 28, 0, 0, 0, 0, time.UTC), want: true},
+		{w: holidays, t: time.Date(2016, 1, 4, 8, 59, 0, 0, time.UTC), want: true},
+		{w: holidays, t: time.Date(2016, 1, 4, 9, 0, 0, 0, time.UTC), want: false},
+
+		// The minute of the start is later than the minute of "t" in a later hour.
+		{w: lateStart, t: time.Date(2015, 10, 16, 18, 29, 0, 0, time.UTC), want: false},
+		{w: lateStart, t: time.Date(2015, 10, 16, 20, 10, 0, 0, time.UTC), want: true},
+		{w: lateStart, t: time.Date(2015, 10, 19, 8, 29, 0, 0, time.UTC), want: true},
+		{w: lateStart, t: time.Date(2015, 10, 19, 8, 30, 0, 0, time.UTC), want: false},
+
+		{w: business, t: time.Date(2015, 10, 16, 17, 50, 0, 0, time.UTC), want: true},
+		{w: business, t: time.Date(2015, 10, 16, 18, 5, 0, 0, time.UTC), want: false},
+		{w: business, t: time.Date(2015, 10, 17, 9, 10, 0, 0, time.UTC), want: false},
+		{w: business, t: time.Date(2015, 10, 19, 9, 0, 0, 0, time.UTC), want: true},
+
+		// The window started at 2015-01-01 00:00 lasts until 2015-07-02 12:00.
+		{w: halfYear, t: time.Date(2015, 7, 2, 11, 59, 0, 0, time.UTC), want: true},
+		{w: halfYear, t: time.Date(2015, 7, 2, 12, 0, 0, 0, time.UTC), want: false},
+		{w: halfYear, t: time.Date(2015, 12, 31, 23, 59, 0, 0, time.UTC), want: false},
+	} {
+		if got, want := spec.w.Active(spec.t), spec.want; got != want {
+			t.Errorf("%v.Active(%v) = %v; want %v", spec.w, spec.t, got, want)
+		}
+		w := spec.w
+		if err := w.Compile(); err != nil {
+			t.Errorf("%v.Compile() failed with %v; want success", spec.w, err)
+			continue
+		}
+		if got, want := w.Active(spec.t), spec.want; got != want {
+			t.Errorf("compiled %v.Active(%v) = %v; want %v", spec.w, spec.t, got, want)
+		}
+	}
+}
+
+func TestWindowValidate(t *testing.T) {
+	for _, w := range []Window{
+		{},
+		{Cron: "0 18 * * 5"},
+		{Cron: "0 18 * * 5", Duration: "-1h"},
+		{Cron: "0 18 * * 5", Duration: "1h", Start: "2015-12-28 00:00", End: "2016-01-04 09:00"},
+		{Start: "2015-12-28 00:00"},
+		{Start: "2016-01-04 09:00", End: "2015-12-28 00:00"},
+		{Start: "2015/12/28", End: "2016/01/04"},
+		{Cron: "0 18 * * 5", Duration: "1h", TimeZone: "Nowhere/Unknown"},
+	} {
+		if err := w.Validate(); err == nil {
+			t.Errorf("%#v.Validate() succeeded; want failure", w)
+		}
+		if err := w.Compile(); err == nil {
+			t.Errorf("%#v.Compile() succeeded; want failure", w)
+		}
+		if !w.Active(time.Now()) {
+			t.Errorf("%#v.Active(time.Now()) = false; want true", w)
+		}
+	}
+}
+
+func TestActive(t *testing.T) {
+	now := time.Date(2015, 12, 30, 12, 0, 0, 0, time.UTC)
+	windows := []Window{
+		{Name: "past", Start: "2015-01-01 00:00", End: "2015-01-02 00:00"},
+		{Name: "holidays", Start: "2015-12-28 00:00", End: "2016-01-04 09:00"},
+		{Name: "noon", Cron: "0 12 * * *", Duration: "1h"},
+	}
+	got := Active(windows, now)
+	if len(got) != 2 || got[0].Name != "holidays" || got[1].Name != "noon" {
+		t.Errorf("Active(%#v, %v) = %#v; want holidays and noon", windows, now, got)
+	}
+}
@@ -0,0 +1,115 @@
+// Package health checks the health of services after deployments.
+package health
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gengo/goship/lib/config"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+const (
+	// DefaultTimeout is the default deadline of health checks after deployments.
+	DefaultTimeout = 5 * time.Minute
+	// DefaultInterval is the default interval between attempts of health checks.
+	DefaultInterval = 10 * time.Second
+
+	// hostPlaceholder in URL is replaced with the name of each host.
+	hostPlaceholder = "{{.Host}}"
+)
+
+// Result is a result of a health check.
+type Result struct {
+	// Passed is true iff the check passed before the deadline.
+	Passed bool `json:"passed"`
+	// Attempts is the number of attempts.
+	Attempts int `json:"attempts"`
+	// Error describes the last failure if the check did not pass.
+	Error string `json:"error,omitempty"`
+	// Time is the time when the check finished.
+	Time time.Time `json:"time"`
+}
+
+// Commander runs a command on a remote host. ssh.SSH implements it.
+type Commander interface {
+	Output(ctx context.Context, host, cmd string) ([]byte, error)
+}
+
+// Run runs the check "c" against "hosts" until it passes or its deadline passes.
+// "cmd" is used only if c.Command is not empty.
+func Run(ctx context.Context, c config.HealthCheck, hosts []string, cmd Commander) Result {
+	timeout, interval := DefaultTimeout, DefaultInterval
+	if c.Timeout > 0 {
+		timeout = time.Duration(c.Timeout)
+	}
+	if c.Interval > 0 {
+		interval = time.Duration(c.Interval)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var res Result
+	for {
+		res.Attempts++
+		err := probe(ctx, c, hosts, cmd)
+		if err == nil {
+			res.Passed, res.Error, res.Time = true, "", time.Now()
+			return res
+		}
+		glog.Warningf("Health check failed (attempt %d): %v", res.Attempts, err)
+		res.Error = err.Error()
+		select {
+		case <-ctx.Done():
+			res.Time = time.Now()
+			return res
+		case <-time.After(interval):
+		}
+	}
+}
+
+// probe checks all the hosts once.
+func probe(ctx context.Context, c config.HealthCheck, hosts []string, cmd Commander) error {
+	if c.Command != "" {
+		for _, host := range hosts {
+			if _, err := cmd.Output(ctx, host, c.Command); err != nil {
+				return fmt.Errorf("%q failed on %s: %v", c.Command, host, err)
+			}
+		}
+		return nil
+	}
+	if !strings.Contains(c.URL, hostPlaceholder) {
+		return get(ctx, c, c.URL)
+	}
+	for _, host := range hosts {
+		if err := get(ctx, c, strings.Replace(c.URL, hostPlaceholder, host, -1)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// get sends a GET request to "url" and compares the response status with c.Status.
+func get(ctx context.Context, c config.HealthCheck, url string) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Cancel = ctx.Done()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	want := c.Status
+	if want == 0 {
+		want = http.StatusOK
+	}
+	if resp.StatusCode != want {
+		return fmt.Errorf("GET %s returned %d; want %d", url, resp.StatusCode, want)
+	}
+	return nil
+}
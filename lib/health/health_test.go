@@ -0,0 +1,70 @@
+package health_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gengo/goship/lib/config"
+	"github.com/gengo/goship/lib/health"
+	"golang.org/x/net/context"
+)
+
+func TestRunURL(t *testing.T) {
+	var count int
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count++
+		if count < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer s.Close()
+
+	c := config.HealthCheck{URL: s.URL, Status: http.StatusNoContent, Timeout: config.Duration(time.Second), Interval: config.Duration(10 * time.Millisecond)}
+	res := health.Run(context.Background(), c, []string{"host1"}, nil)
+	if !res.Passed || res.Attempts != 3 {
+		t.Errorf("health.Run(ctx, c, hosts, nil) = %#v; want passed in 3 attempts", res)
+	}
+
+	c.Status = http.StatusOK
+	c.Timeout = config.Duration(50 * time.Millisecond)
+	if res := health.Run(context.Background(), c, []string{"host1"}, nil); res.Passed || res.Error == "" {
+		t.Errorf("health.Run(ctx, c, hosts, nil) = %#v; want failure", res)
+	}
+}
+
+// fakeCommander fails on hosts in "down".
+type fakeCommander struct {
+	down map[string]bool
+	ran  []string
+}
+
+func (c *fakeCommander) Output(ctx context.Context, host, cmd string) ([]byte, error) {
+	c.ran = append(c.ran, fmt.Sprintf("%s:%s", host, cmd))
+	if c.down[host] {
+		return nil, fmt.Errorf("exit status 1")
+	}
+	return nil, nil
+}
+
+func TestRunCommand(t *testing.T) {
+	cmd := &fakeCommander{}
+	c := config.HealthCheck{Command: "check", Timeout: config.Duration(50 * time.Millisecond), Interval: config.Duration(10 * time.Millisecond)}
+	if res := health.Run(context.Background(), c, []string{"host1", "host2"}, cmd); !res.Passed {
+		t.Errorf("health.Run(ctx, c, hosts, cmd) = %#v; want success", res)
+	}
+	if got, want := strings.Join(cmd.ran, ","), "host1:check,host2:check"; got != want {
+		t.Errorf("commands = %q; want %q", got, want)
+	}
+
+	cmd = &fakeCommander{down: map[string]bool{"host2": true}}
+	res := health.Run(context.Background(), c, []string{"host1", "host2"}, cmd)
+	if res.Passed || !strings.Contains(res.Error, "host2") {
+		t.Errorf("health.Run(ctx, c, hosts, cmd) = %#v; want failure on host2", res)
+	}
+}
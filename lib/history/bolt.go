@@ -0,0 +1,145 @@
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// entriesBucket maps deploy IDs to JSON-encoded entries.
+	entriesBucket = []byte("entries")
+	// envsBucket has a nested bucket per environment.
+	// Each nested bucket is a set of IDs of deployments into the environment.
+	envsBucket = []byte("environments")
+)
+
+type boltStore struct {
+	db *bolt.DB
+}
+
+// OpenBolt opens a DeployStore backed by a BoltDB database file "fname".
+// The file is created if it does not exist.
+//
+// Writes are serialized in transactions, so the store is safe for concurrent writers.
+func OpenBolt(fname string) (DeployStore, error) {
+	db, err := bolt.Open(fname, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{entriesBucket, envsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return boltStore{db: db}, nil
+}
+
+func envKey(project, env string) []byte {
+	return []byte(fmt.Sprintf("%s/%s", project, env))
+}
+
+func (s boltStore) Append(e Entry) (string, error) {
+	if e.ID == "" {
+		e.ID = NewID(e.Time)
+	}
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		entries := tx.Bucket(entriesBucket)
+		if entries.Get([]byte(e.ID)) != nil {
+			return fmt.Errorf("duplicated deploy ID %s", e.ID)
+		}
+		if err := entries.Put([]byte(e.ID), buf); err != nil {
+			return err
+		}
+		env, err := tx.Bucket(envsBucket).CreateBucketIfNotExists(envKey(e.Project, e.Environment))
+		if err != nil {
+			return err
+		}
+		return env.Put([]byte(e.ID), nil)
+	})
+	if err != nil {
+		return "", err
+	}
+	return e.ID, nil
+}
+
+func (s boltStore) Update(e Entry) error {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		entries := tx.Bucket(entriesBucket)
+		if entries.Get([]byte(e.ID)) == nil {
+			return ErrNotFound
+		}
+		return entries.Put([]byte(e.ID), buf)
+	})
+}
+
+func (s boltStore) List(project, env string) ([]Entry, error) {
+	return s.Query(Query{Project: project, Environment: env})
+}
+
+func (s boltStore) Get(id string) (Entry, error) {
+	var e Entry
+	err := s.db.View(func(tx *bolt.Tx) error {
+		buf := tx.Bucket(entriesBucket).Get([]byte(id))
+		if buf == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(buf, &e)
+	})
+	return e, err
+}
+
+// Query scans entries in descending order of ID, which is equivalent to the order of time.
+func (s boltStore) Query(q Query) ([]Entry, error) {
+	var matched []Entry
+	err := s.db.View(func(tx *bolt.Tx) error {
+		entries := tx.Bucket(entriesBucket)
+		c := entries.Cursor()
+		if q.Project != "" && q.Environment != "" {
+			env := tx.Bucket(envsBucket).Bucket(envKey(q.Project, q.Environment))
+			if env == nil {
+				return nil
+			}
+			c = env.Cursor()
+		}
+		for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
+			var e Entry
+			if err := json.Unmarshal(entries.Get(k), &e); err != nil {
+				return fmt.Errorf("broken deploy log %s: %v", k, err)
+			}
+			if !q.Match(e) {
+				continue
+			}
+			matched = append(matched, e)
+			if q.Limit > 0 && len(matched) >= q.Limit {
+				return nil
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return matched, nil
+}
+
+func (s boltStore) Close() error {
+	return s.db.Close()
+}
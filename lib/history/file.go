@@ -0,0 +1,282 @@
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+const fileExt = ".json"
+
+type fileStore struct {
+	dir string
+	// envs are the known environments, which are used to split names of the files.
+	envs []Env
+	// mu serializes read-modify-write cycles of the files.
+	mu sync.Mutex
+	// index maps IDs of entries to their environments so that Get reads only one file.
+	// It is built on the first call of Get.
+	index map[string]Env
+}
+
+// Env is the name of an environment of a project.
+type Env struct {
+	Project     string
+	Environment string
+}
+
+// NewFileStore returns a DeployStore which keeps entries in JSON files under "dir".
+// Each environment has its own file "<project>-<env>.json" which contains an array of entries.
+// "envs" are the known environments. They are used to find the project and the environment of a file
+// because both names can contain "-".
+//
+// It is safe for concurrent use only within a single process,
+// and it does not find entries which other processes add after its first call of Get.
+func NewFileStore(dir string, envs ...Env) DeployStore {
+	return &fileStore{dir: dir, envs: envs}
+}
+
+func (s *fileStore) path(project, env string) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%s-%s%s", project, env, fileExt))
+}
+
+func (s *fileStore) Append(e Entry) (string, error) {
+	if e.ID == "" {
+		e.ID = NewID(e.Time)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fname := s.path(e.Project, e.Environment)
+	entries, err := readFile(fname, e.Project, e.Environment)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	entries = append(entries, e)
+	if err := writeFile(fname, entries); err != nil {
+		return "", err
+	}
+	if s.index != nil {
+		s.index[e.ID] = Env{Project: e.Project, Environment: e.Environment}
+	}
+	return e.ID, nil
+}
+
+func (s *fileStore) Update(e Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fname := s.path(e.Project, e.Environment)
+	entries, err := readFile(fname, e.Project, e.Environment)
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	for i := range entries {
+		if entries[i].ID == e.ID {
+			entries[i] = e
+			return writeFile(fname, entries)
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *fileStore) List(project, env string) ([]Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := readFile(s.path(project, env), project, env)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(ByTime(entries))
+	return entries, nil
+}
+
+func (s *fileStore) Get(id string) (Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.index == nil {
+		entries, err := s.readAll()
+		if err != nil {
+			return Entry{}, err
+		}
+		s.index = make(map[string]Env)
+		for _, e := range entries {
+			s.index[e.ID] = Env{Project: e.Project, Environment: e.Environment}
+		}
+	}
+	env, ok := s.index[id]
+	if !ok {
+		return Entry{}, ErrNotFound
+	}
+	entries, err := readFile(s.path(env.Project, env.Environment), env.Project, env.Environment)
+	if os.IsNotExist(err) {
+		return Entry{}, ErrNotFound
+	}
+	if err != nil {
+		return Entry{}, err
+	}
+	for _, e := range entries {
+		if e.ID == id {
+			return e, nil
+		}
+	}
+	return Entry{}, ErrNotFound
+}
+
+func (s *fileStore) Query(q Query) ([]Entry, error) {
+	if q.Project != "" && q.Environment != "" {
+		entries, err := s.List(q.Project, q.Environment)
+		if err != nil {
+			return nil, err
+		}
+		return filter(entries, q), nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries, err := s.readAll()
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(ByTime(entries))
+	return filter(entries, q), nil
+}
+
+// readAll reads the entries of all the environments. Broken files are skipped.
+// s.mu must be locked.
+func (s *fileStore) readAll() ([]Entry, error) {
+	fnames, err := filepath.Glob(filepath.Join(s.dir, "*"+fileExt))
+	if err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	for _, fname := range fnames {
+		project, env, ok := splitBasename(fname, s.envs)
+		if !ok {
+			continue
+		}
+		es, err := readFile(fname, project, env)
+		if err != nil {
+			glog.Errorf("Skipping broken deploy log %s: %v", fname, err)
+			continue
+		}
+		entries = append(entries, es...)
+	}
+	return entries, nil
+}
+
+func (s *fileStore) Close() error {
+	return nil
+}
+
+// splitBasename extracts project and environment names from the name of a deploy log file.
+// The name is matched against the known environments "envs" first.
+// Otherwise, the environment name is assumed not to contain "-".
+func splitBasename(fname string, envs []Env) (project, env string, ok bool) {
+	base := strings.TrimSuffix(filepath.Base(fname), fileExt)
+	for _, e := range envs {
+		if base == e.Project+"-"+e.Environment {
+			return e.Project, e.Environment, true
+		}
+	}
+	i := strings.LastIndex(base, "-")
+	if i <= 0 || i == len(base)-1 {
+		return "", "", false
+	}
+	return base[:i], base[i+1:], true
+}
+
+// readFile reads entries from "fname".
+// It fills fields which did not exist in old versions of the file format.
+func readFile(fname, project, env string) ([]Entry, error) {
+	b, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, nil
+	}
+	var entries []Entry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, fmt.Errorf("broken deploy log %s: %v", fname, err)
+	}
+	// Entries recorded at the same time get different IDs.
+	ids := make(map[string]bool)
+	for i := range entries {
+		e := &entries[i]
+		if e.ID == "" {
+			e.ID = legacyID(*e)
+			if ids[e.ID] {
+				e.ID = fmt.Sprintf("%s-%d", e.ID, i)
+			}
+		}
+		ids[e.ID] = true
+		if e.State == "" {
+			e.State = legacyState(*e)
+		}
+		if e.Project == "" {
+			e.Project = project
+		}
+		if e.Environment == "" {
+			e.Environment = env
+		}
+	}
+	return entries, nil
+}
+
+// writeFile atomically replaces the contents of "fname" with "entries".
+func writeFile(fname string, entries []Entry) error {
+	b, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(fname), filepath.Base(fname))
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	// ioutil.TempFile creates the file with 0600, but deploy logs are readable by others.
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), fname)
+}
+
+func filter(entries []Entry, q Query) []Entry {
+	var matched []Entry
+	for _, e := range entries {
+		if !q.Match(e) {
+			continue
+		}
+		matched = append(matched, e)
+		if q.Limit > 0 && len(matched) >= q.Limit {
+			break
+		}
+	}
+	return matched
+}
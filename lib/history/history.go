@@ -0,0 +1,238 @@
+// Package history provides persistent storage of deployment logs.
+package history
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/gengo/goship/lib/health"
+	"github.com/gengo/goship/lib/revision"
+)
+
+var (
+	// ErrNotFound is returned when no entry matches the given ID.
+	ErrNotFound = errors.New("no such deploy")
+)
+
+// idTimeLayout is the time part of deploy IDs.
+// It has a fixed width so that IDs are ordered by the time when the deployment started.
+const idTimeLayout = "20060102T150405.000000000Z"
+
+// State is a state in the lifecycle of a deployment.
+type State string
+
+const (
+	// StateAwaitingApproval means the deployment has been requested but needs approval by another user.
+	StateAwaitingApproval = State("awaiting_approval")
+	// StatePending means the deployment has been requested but not started yet.
+	StatePending = State("pending")
+	// StateRunning means the deploy command is running.
+	StateRunning = State("running")
+	// StateSucceeded means the deploy command has successfully finished.
+	StateSucceeded = State("succeeded")
+	// StateFailed means the deploy command has failed.
+	StateFailed = State("failed")
+	// StateCancelled means the deployment has been cancelled by an user.
+	StateCancelled = State("cancelled")
+)
+
+const (
+	// ReasonTimeout means the deploy command was killed because it did not finish within the deadline.
+	ReasonTimeout = "timeout"
+	// ReasonApprovalExpired means the deployment was not approved before the approval request expired.
+	ReasonApprovalExpired = "approval expired"
+	// ReasonBatchFailed means the deploy command failed for a batch of hosts in a rolling deployment.
+	ReasonBatchFailed = "batch failed"
+	// ReasonVerificationFailed means the verification command failed after a batch of hosts in a rolling deployment.
+	ReasonVerificationFailed = "verification failed"
+	// ReasonHealthCheckFailed means the deploy command succeeded but the health check of the environment failed.
+	ReasonHealthCheckFailed = "health check failed"
+	// ReasonPreDeployFailed means a pre_deploy hook failed and the deploy command did not run.
+	ReasonPreDeployFailed = "pre_deploy hook failed"
+	// ReasonPostDeployFailed means the deploy command succeeded but a post_deploy hook failed.
+	ReasonPostDeployFailed = "post_deploy hook failed"
+	// ReasonInterrupted means Goship restarted while the deployment was pending or running.
+	ReasonInterrupted = "interrupted by restart"
+	// ReasonScheduleRejected means the scheduled deployment could not start, e.g. because of a lock or a freeze window.
+	ReasonScheduleRejected = "schedule rejected"
+)
+
+// Finished returns true iff "s" is a terminal state.
+func (s State) Finished() bool {
+	switch s {
+	case StateSucceeded, StateFailed, StateCancelled:
+		return true
+	}
+	return false
+}
+
+// RevRange is a range of revisions.
+type RevRange struct {
+	From revision.Revision `json:"from"`
+	To   revision.Revision `json:"to"`
+}
+
+// HostState is the state of a host in a rolling deployment.
+type HostState struct {
+	Host  string `json:"host"`
+	State State  `json:"state"`
+}
+
+// Approval is a record of approval of a deployment.
+type Approval struct {
+	// Expiry is the time when the approval request expires.
+	Expiry time.Time `json:"expiry"`
+	// ApprovedBy is the name of the user who approved the deployment.
+	// It is empty if the deployment has not been approved.
+	ApprovedBy string    `json:"approved_by,omitempty"`
+	ApprovedAt time.Time `json:"approved_at,omitempty"`
+}
+
+// Approved returns true iff the deployment has been approved.
+func (a Approval) Approved() bool {
+	return a.ApprovedBy != ""
+}
+
+// Expired returns true iff the approval request has expired at "t" without approval.
+func (a Approval) Expired(t time.Time) bool {
+	return !a.Approved() && t.After(a.Expiry)
+}
+
+// Entry is a record of a deployment.
+type Entry struct {
+	// ID is the unique identifier of the deployment.
+	ID          string   `json:"id,omitempty"`
+	Project     string   `json:"project,omitempty"`
+	Environment string   `json:"environment,omitempty"`
+	Range       RevRange `json:"range"`
+	// SourceRange is the range of source revisions if the project has a separate source repository.
+	SourceRange *RevRange `json:"source_range,omitempty"`
+	DiffURL     string
+	// ToRevisionMsg is the commit message of the source revision which was deployed.
+	ToRevisionMsg string
+	User          string
+	// State is the current state of the deployment.
+	State State `json:"state,omitempty"`
+	// Success is true iff State is StateSucceeded.
+	// It is kept for compatibility with old deploy logs.
+	Success bool
+	// Time is the time when the deployment started.
+	Time time.Time
+	// RollbackOf is the ID of the deployment whose revision this deployment rolled back to.
+	RollbackOf string `json:"rollback_of,omitempty"`
+	// ScheduleID is the ID of the schedule which started the deployment if any.
+	ScheduleID string `json:"schedule_id,omitempty"`
+	// PromotedFrom is the name of the previous stage in the pipeline if the deployment is a promotion.
+	PromotedFrom string `json:"promoted_from,omitempty"`
+	// Approval is the approval of the deployment if the environment requires approval.
+	Approval *Approval `json:"approval,omitempty"`
+	// Hosts is the progress of each host if the deployment is a rolling deployment.
+	// Hosts which have not been deployed remain StatePending.
+	Hosts []HostState `json:"hosts,omitempty"`
+	// Warnings are messages about failures which did not fail the deployment, e.g. failed hooks.
+	Warnings []string `json:"warnings,omitempty"`
+	// Health is the result of the health check after the deployment if the environment has a health check.
+	Health *health.Result `json:"health,omitempty"`
+	// RolledBackBy is the ID of the deployment which automatically rolled back this deployment.
+	RolledBackBy string `json:"rolled_back_by,omitempty"`
+	// RollbackError describes why the automatic rollback of this deployment could not start.
+	RollbackError string `json:"rollback_error,omitempty"`
+	// Forced is true if an admin deployed into the environment while it was locked.
+	Forced bool `json:"forced,omitempty"`
+	// Reason describes why the deployment failed, e.g. ReasonTimeout.
+	Reason string `json:",omitempty"`
+	// CancelledBy is the name of the user who cancelled the deployment.
+	CancelledBy string `json:",omitempty"`
+	// EndTime is the time when the deployment finished.
+	// It is zero if the deployment has not finished yet.
+	EndTime       time.Time `json:",omitempty"`
+	FormattedTime string    `json:",omitempty"`
+}
+
+// Finish sets the final state of the deployment.
+func (e *Entry) Finish(s State, t time.Time) {
+	e.State = s
+	e.Success = s == StateSucceeded
+	e.EndTime = t
+}
+
+// Query is a set of conditions to filter entries.
+// Zero values of the fields match any entries.
+type Query struct {
+	Project     string
+	Environment string
+	User        string
+	// Since and Until limit the range of Entry.Time.
+	Since, Until time.Time
+	// Limit is the maximum number of entries to return.
+	Limit int
+}
+
+// Match returns true if "e" satisfies the conditions in "q".
+func (q Query) Match(e Entry) bool {
+	switch {
+	case q.Project != "" && q.Project != e.Project:
+		return false
+	case q.Environment != "" && q.Environment != e.Environment:
+		return false
+	case q.User != "" && q.User != e.User:
+		return false
+	case !q.Since.IsZero() && e.Time.Before(q.Since):
+		return false
+	case !q.Until.IsZero() && !e.Time.Before(q.Until):
+		return false
+	}
+	return true
+}
+
+// DeployStore is a persistent storage of deployment logs.
+// Implementations must be safe for concurrent use.
+type DeployStore interface {
+	// Append adds "e" to the store.
+	// It assigns a new ID to "e" if e.ID is empty and returns the ID.
+	Append(e Entry) (string, error)
+	// List returns all entries of the environment in the project, newest first.
+	List(project, env string) ([]Entry, error)
+	// Update replaces the entry which has the same ID as "e".
+	// It returns ErrNotFound if there is no such entry.
+	Update(e Entry) error
+	// Get returns the entry identified by "id".
+	// It returns ErrNotFound if there is no such entry.
+	Get(id string) (Entry, error)
+	// Query returns entries which match "q", newest first.
+	Query(q Query) ([]Entry, error)
+	// Close releases resources held by the store.
+	Close() error
+}
+
+// NewID returns a new unique deploy ID for a deployment started at "t".
+func NewID(t time.Time) string {
+	var buf [4]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		// crypto/rand never fails on supported platforms.
+		panic(err)
+	}
+	return t.UTC().Format(idTimeLayout) + "-" + hex.EncodeToString(buf[:])
+}
+
+// legacyID returns a deterministic ID for an entry recorded before deploy IDs were introduced.
+func legacyID(e Entry) string {
+	return e.Time.UTC().Format(idTimeLayout)
+}
+
+// legacyState returns the state of an entry recorded before the lifecycle of deployments was introduced.
+func legacyState(e Entry) State {
+	if e.Success {
+		return StateSucceeded
+	}
+	return StateFailed
+}
+
+// ByTime sorts entries in descending order of Time.
+type ByTime []Entry
+
+func (d ByTime) Len() int           { return len(d) }
+func (d ByTime) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d ByTime) Less(i, j int) bool { return d[i].Time.After(d[j].Time) }
@@ -0,0 +1,331 @@
+package history_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gengo/goship/lib/history"
+)
+
+func withStores(t *testing.T, f func(name string, s history.DeployStore)) {
+	dir, err := ioutil.TempDir("", "history-test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(%q, %q) failed with %v; want success", "", "history-test", err)
+	}
+	defer os.RemoveAll(dir)
+
+	f("file", history.NewFileStore(dir))
+
+	s, err := history.OpenBolt(filepath.Join(dir, "history.db"))
+	if err != nil {
+		t.Fatalf("history.OpenBolt(%q) failed with %v; want success", filepath.Join(dir, "history.db"), err)
+	}
+	defer s.Close()
+	f("bolt", s)
+}
+
+func TestAppendAndList(t *testing.T) {
+	base := time.Date(2015, time.November, 10, 23, 0, 0, 0, time.UTC)
+	withStores(t, func(name string, s history.DeployStore) {
+		var ids []string
+		for i, env := range []string{"staging", "prod", "staging"} {
+			e := history.Entry{
+				Project:     "example-project",
+				Environment: env,
+				Range:       history.RevRange{From: "abc", To: "def"},
+				User:        "alice",
+				Success:     true,
+				Time:        base.Add(time.Duration(i) * time.Minute),
+			}
+			id, err := s.Append(e)
+			if err != nil {
+				t.Fatalf("s.Append(%#v) failed with %v; want success; backend=%s", e, err, name)
+			}
+			ids = append(ids, id)
+		}
+
+		entries, err := s.List("example-project", "staging")
+		if err != nil {
+			t.Fatalf("s.List(%q, %q) failed with %v; want success; backend=%s", "example-project", "staging", err, name)
+		}
+		var got []string
+		for _, e := range entries {
+			got = append(got, e.ID)
+		}
+		if want := []string{ids[2], ids[0]}; !reflect.DeepEqual(got, want) {
+			t.Errorf("IDs of s.List(%q, %q) = %q; want %q; backend=%s", "example-project", "staging", got, want, name)
+		}
+
+		e, err := s.Get(ids[1])
+		if err != nil {
+			t.Fatalf("s.Get(%q) failed with %v; want success; backend=%s", ids[1], err, name)
+		}
+		if got, want := e.Environment, "prod"; got != want {
+			t.Errorf("s.Get(%q).Environment = %q; want %q; backend=%s", ids[1], got, want, name)
+		}
+		if _, err := s.Get("no-such-id"); err != history.ErrNotFound {
+			t.Errorf("s.Get(%q) failed with %v; want %v; backend=%s", "no-such-id", err, history.ErrNotFound, name)
+		}
+
+		entries, err = s.Query(history.Query{Since: base.Add(time.Minute), Limit: 1})
+		if err != nil {
+			t.Fatalf("s.Query(...) failed with %v; want success; backend=%s", err, name)
+		}
+		if len(entries) != 1 || entries[0].ID != ids[2] {
+			t.Errorf("s.Query(...) = %#v; want an entry with ID %q; backend=%s", entries, ids[2], name)
+		}
+	})
+}
+
+func TestUpdate(t *testing.T) {
+	withStores(t, func(name string, s history.DeployStore) {
+		e := history.Entry{
+			ID:          history.NewID(time.Now()),
+			Project:     "example-project",
+			Environment: "staging",
+			State:       history.StateRunning,
+			Time:        time.Now(),
+		}
+		if _, err := s.Append(e); err != nil {
+			t.Fatalf("s.Append(%#v) failed with %v; want success; backend=%s", e, err, name)
+		}
+		e.Finish(history.StateSucceeded, time.Now())
+		if err := s.Update(e); err != nil {
+			t.Fatalf("s.Update(%#v) failed with %v; want success; backend=%s", e, err, name)
+		}
+		got, err := s.Get(e.ID)
+		if err != nil {
+			t.Fatalf("s.Get(%q) failed with %v; want success; backend=%s", e.ID, err, name)
+		}
+		if got.State != history.StateSucceeded || !got.Success {
+			t.Errorf("s.Get(%q) = %#v; want a succeeded entry; backend=%s", e.ID, got, name)
+		}
+
+		e.ID = "no-such-id"
+		if err := s.Update(e); err != history.ErrNotFound {
+			t.Errorf("s.Update(%#v) failed with %v; want %v; backend=%s", e, err, history.ErrNotFound, name)
+		}
+	})
+}
+
+func TestGet(t *testing.T) {
+	withStores(t, func(name string, s history.DeployStore) {
+		now := time.Now()
+		var ids []string
+		for i, env := range []string{"staging", "prod"} {
+			e := history.Entry{Project: "example-project", Environment: env, Time: now.Add(time.Duration(i) * time.Minute)}
+			id, err := s.Append(e)
+			if err != nil {
+				t.Fatalf("s.Append(%#v) failed with %v; want success; backend=%s", e, err, name)
+			}
+			ids = append(ids, id)
+			// Entries appended after the first lookup are also found.
+			for j, id := range ids {
+				got, err := s.Get(id)
+				if err != nil {
+					t.Errorf("s.Get(%q) failed with %v; want success; backend=%s", id, err, name)
+					continue
+				}
+				if got.ID != id || got.Environment != []string{"staging", "prod"}[j] {
+					t.Errorf("s.Get(%q) = %#v; want the entry in %s; backend=%s", id, got, []string{"staging", "prod"}[j], name)
+				}
+			}
+		}
+		if _, err := s.Get("no-such-id"); err != history.ErrNotFound {
+			t.Errorf("s.Get(%q) failed with %v; want %v; backend=%s", "no-such-id", err, history.ErrNotFound, name)
+		}
+	})
+}
+
+func TestFileMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history-test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(%q, %q) failed with %v; want success", "", "history-test", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := history.NewFileStore(dir)
+	e := history.Entry{Project: "example-project", Environment: "staging", Time: time.Now()}
+	if _, err := s.Append(e); err != nil {
+		t.Fatalf("s.Append(%#v) failed with %v; want success", e, err)
+	}
+	fname := filepath.Join(dir, "example-project-staging.json")
+	fi, err := os.Stat(fname)
+	if err != nil {
+		t.Fatalf("os.Stat(%q) failed with %v; want success", fname, err)
+	}
+	if got, want := fi.Mode().Perm(), os.FileMode(0644); got != want {
+		t.Errorf("mode of %s = %v; want %v", fname, got, want)
+	}
+}
+
+func TestConcurrentAppend(t *testing.T) {
+	const n = 20
+	withStores(t, func(name string, s history.DeployStore) {
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				e := history.Entry{Project: "concurrent", Environment: "prod", Time: time.Now()}
+				if _, err := s.Append(e); err != nil {
+					t.Errorf("s.Append(%#v) failed with %v; want success; backend=%s", e, err, name)
+				}
+			}()
+		}
+		wg.Wait()
+
+		entries, err := s.List("concurrent", "prod")
+		if err != nil {
+			t.Fatalf("s.List(%q, %q) failed with %v; want success; backend=%s", "concurrent", "prod", err, name)
+		}
+		if got, want := len(entries), n; got != want {
+			t.Errorf("len(s.List(%q, %q)) = %d; want %d; backend=%s", "concurrent", "prod", got, want, name)
+		}
+	})
+}
+
+func TestMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history-test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(%q, %q) failed with %v; want success", "", "history-test", err)
+	}
+	defer os.RemoveAll(dir)
+
+	legacy := `[{"range":{"from":"abc","to":"def"},"DiffURL":"","ToRevisionMsg":"","User":"bob","Success":true,"Time":"2015-11-10T23:00:00Z"}]`
+	fname := filepath.Join(dir, "my-project-staging.json")
+	if err := ioutil.WriteFile(fname, []byte(legacy), 0644); err != nil {
+		t.Fatalf("ioutil.WriteFile(%q, ...) failed with %v; want success", fname, err)
+	}
+
+	s, err := history.OpenBolt(filepath.Join(dir, "history.db"))
+	if err != nil {
+		t.Fatalf("history.OpenBolt(...) failed with %v; want success", err)
+	}
+	defer s.Close()
+
+	n, err := history.Migrate(dir, s)
+	if err != nil {
+		t.Fatalf("history.Migrate(%q, s) failed with %v; want success", dir, err)
+	}
+	if got, want := n, 1; got != want {
+		t.Errorf("history.Migrate(%q, s) = %d; want %d", dir, got, want)
+	}
+	if _, err := os.Stat(fname); !os.IsNotExist(err) {
+		t.Errorf("os.Stat(%q) failed with %v; want IsNotExist", fname, err)
+	}
+
+	entries, err := s.List("my-project", "staging")
+	if err != nil {
+		t.Fatalf("s.List(%q, %q) failed with %v; want success", "my-project", "staging", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("len(s.List(%q, %q)) = %d; want 1", "my-project", "staging", len(entries))
+	}
+	if got, want := entries[0].User, "bob"; got != want {
+		t.Errorf("entries[0].User = %q; want %q", got, want)
+	}
+	if got, want := entries[0].State, history.StateSucceeded; got != want {
+		t.Errorf("entries[0].State = %q; want %q", got, want)
+	}
+	if entries[0].ID == "" {
+		t.Errorf("entries[0].ID = %q; want non-empty", entries[0].ID)
+	}
+
+	if n, err := history.Migrate(dir, s); err != nil || n != 0 {
+		t.Errorf("history.Migrate(%q, s) = %d, %v; want 0, nil", dir, n, err)
+	}
+}
+
+func TestMigrateWithKnownEnvs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history-test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(%q, %q) failed with %v; want success", "", "history-test", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Two legacy entries recorded at the same time in an environment whose name contains "-".
+	legacy := `[
+		{"range":{"from":"abc","to":"def"},"User":"bob","Success":true,"Time":"2015-11-10T23:00:00Z"},
+		{"range":{"from":"def","to":"ghi"},"User":"alice","Success":false,"Time":"2015-11-10T23:00:00Z"}
+	]`
+	fname := filepath.Join(dir, "my-project-pre-prod.json")
+	if err := ioutil.WriteFile(fname, []byte(legacy), 0644); err != nil {
+		t.Fatalf("ioutil.WriteFile(%q, ...) failed with %v; want success", fname, err)
+	}
+	env := history.Env{Project: "my-project", Environment: "pre-prod"}
+
+	entries, err := history.NewFileStore(dir, env).Query(history.Query{Project: "my-project"})
+	if err != nil {
+		t.Fatalf("s.Query(...) failed with %v; want success", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("len(s.Query(...)) = %d; want 2", len(entries))
+	}
+	for _, e := range entries {
+		if e.Environment != "pre-prod" {
+			t.Errorf("e.Environment = %q; want %q", e.Environment, "pre-prod")
+		}
+	}
+	if entries[0].ID == entries[1].ID {
+		t.Errorf("entries have the same ID %q; want different IDs", entries[0].ID)
+	}
+
+	s, err := history.OpenBolt(filepath.Join(dir, "history.db"))
+	if err != nil {
+		t.Fatalf("history.OpenBolt(...) failed with %v; want success", err)
+	}
+	defer s.Close()
+	if n, err := history.Migrate(dir, s, env); err != nil || n != 2 {
+		t.Errorf("history.Migrate(%q, s, %#v) = %d, %v; want 2, nil", dir, env, n, err)
+	}
+	if entries, err := s.List("my-project", "pre-prod"); err != nil || len(entries) != 2 {
+		t.Errorf("s.List(%q, %q) = %#v, %v; want 2 entries", "my-project", "pre-prod", entries, err)
+	}
+
+	// Entries whose IDs are used by other deployments are not lost.
+	other := filepath.Join(dir, "other-prod.json")
+	if err := ioutil.WriteFile(other, []byte(legacy), 0644); err != nil {
+		t.Fatalf("ioutil.WriteFile(%q, ...) failed with %v; want success", other, err)
+	}
+	if n, err := history.Migrate(dir, s); err != nil || n != 0 {
+		t.Errorf("history.Migrate(%q, s) = %d, %v; want 0, nil", dir, n, err)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("os.Stat(%q) failed with %v; want the file to be kept", other, err)
+	}
+}
+
+func TestApprovalExpired(t *testing.T) {
+	expiry := time.Date(2015, 10, 21, 10, 0, 0, 0, time.UTC)
+	for _, spec := range []struct {
+		approval history.Approval
+		t        time.Time
+		want     bool
+	}{
+		{
+			approval: history.Approval{Expiry: expiry},
+			t:        expiry.Add(-time.Minute),
+			want:     false,
+		},
+		{
+			approval: history.Approval{Expiry: expiry},
+			t:        expiry.Add(time.Minute),
+			want:     true,
+		},
+		{
+			approval: history.Approval{Expiry: expiry, ApprovedBy: "bob", ApprovedAt: expiry.Add(-time.Minute)},
+			t:        expiry.Add(time.Minute),
+			want:     false,
+		},
+	} {
+		if got, want := spec.approval.Expired(spec.t), spec.want; got != want {
+			t.Errorf("%#v.Expired(%v) = %v; want %v", spec.approval, spec.t, got, want)
+		}
+	}
+}
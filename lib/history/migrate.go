@@ -0,0 +1,67 @@
+package history
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/golang/glog"
+)
+
+// migratedExt is appended to the names of JSON files which have been migrated.
+const migratedExt = ".migrated"
+
+// Migrate imports entries in JSON files under "dir", which NewFileStore writes, into "dst".
+// "envs" are the known environments as in NewFileStore.
+// Imported files are renamed so that they are not imported twice.
+// Files which have entries whose IDs collide with different entries in "dst" are reported and left as they are.
+// It returns the number of imported entries.
+func Migrate(dir string, dst DeployStore, envs ...Env) (int, error) {
+	fnames, err := filepath.Glob(filepath.Join(dir, "*"+fileExt))
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, fname := range fnames {
+		project, env, ok := splitBasename(fname, envs)
+		if !ok {
+			glog.Warningf("Skipping %s: not a deploy log", fname)
+			continue
+		}
+		entries, err := readFile(fname, project, env)
+		if err != nil {
+			glog.Errorf("Failed to migrate %s: %v", fname, err)
+			continue
+		}
+		var collided bool
+		for _, e := range entries {
+			if old, err := dst.Get(e.ID); err == nil {
+				// The entry may have been imported before an interruption.
+				if !sameDeploy(old, e) {
+					glog.Errorf("Failed to migrate deploy %s of %s-%s at %s: the ID is used by deploy of %s-%s at %s", e.ID, e.Project, e.Environment, e.Time, old.Project, old.Environment, old.Time)
+					collided = true
+				}
+				continue
+			} else if err != ErrNotFound {
+				return n, err
+			}
+			if _, err := dst.Append(e); err != nil {
+				return n, err
+			}
+			n++
+		}
+		if collided {
+			glog.Errorf("Keeping %s because some of its entries could not be migrated", fname)
+			continue
+		}
+		if err := os.Rename(fname, fname+migratedExt); err != nil {
+			return n, err
+		}
+		glog.Infof("Migrated %d deploy log(s) of %s-%s", len(entries), project, env)
+	}
+	return n, nil
+}
+
+// sameDeploy returns true if "a" and "b" are records of the same deployment.
+func sameDeploy(a, b Entry) bool {
+	return a.ID == b.ID && a.Project == b.Project && a.Environment == b.Environment && a.Time.Equal(b.Time)
+}
@@ -0,0 +1,294 @@
+package notification
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// replayLimit is the maximum number of messages kept for a running deployment.
+	// Older messages are not replayed once a deployment produces more.
+	replayLimit = 10000
+	// subscriberBuffer is the number of messages which can be queued for a subscriber.
+	// A subscriber is dropped when it falls behind further.
+	subscriberBuffer = 256
+	// recentLimit is the number of the latest messages kept for subscribers which resume after a message.
+	recentLimit = 1000
+	// sseHeartbeat is the interval of comments sent to idle server-sent event streams.
+	sseHeartbeat = 30 * time.Second
+)
+
+// Topic identifies what a published message is about.
+type Topic struct {
+	Project     string
+	Environment string
+	// DeployID is the ID of the deployment which the message belongs to.
+	// It is empty if the message is not about a particular deployment.
+	DeployID string
+}
+
+// Filter selects messages which a subscriber receives.
+type Filter struct {
+	// DeployID selects messages of the deployment if it is not empty.
+	// Project and Environment are ignored in that case.
+	DeployID string
+	// Project selects messages of the project.
+	Project string
+	// Environment selects messages of the environment of Project. All environments are selected if it is empty.
+	Environment string
+}
+
+// Match returns true if messages about "t" should be sent to subscribers with "f".
+func (f Filter) Match(t Topic) bool {
+	if f.DeployID != "" {
+		return f.DeployID == t.DeployID
+	}
+	return f.Project == t.Project && (f.Environment == "" || f.Environment == t.Environment)
+}
+
+// Message is a message published to the hub.
+type Message struct {
+	// Seq is the sequence number of the message, which increases monotonically in a hub.
+	Seq   int64
+	Topic Topic
+	Data  string
+}
+
+type bySeq []Message
+
+func (s bySeq) Len() int           { return len(s) }
+func (s bySeq) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s bySeq) Less(i, j int) bool { return s[i].Seq < s[j].Seq }
+
+// subscriber is a registered receiver of published messages.
+type subscriber struct {
+	filter Filter
+	// since is the sequence number of the last message which the subscriber has received before.
+	since int64
+	ch     chan Message
+	// ready is closed when ch is ready to be used.
+	ready chan struct{}
+}
+
+// Publish sends "data" to the subscribers whose filters match "t".
+//
+// Messages of a deployment are also kept until Finish is called with the ID of the deployment,
+// and they are replayed to subscribers which subscribe later.
+func (h *Hub) Publish(t Topic, data string) {
+	select {
+	case h.publish <- Message{Topic: t, Data: data}:
+	case <-h.done:
+	}
+}
+
+// Finish discards the messages kept for the deployment "id".
+// It should be called after the last message of the deployment has been published.
+func (h *Hub) Finish(id string) {
+	select {
+	case h.finish <- id:
+	case <-h.done:
+	}
+}
+
+// Subscribe registers a subscriber of the messages which match "f".
+// The kept messages of running deployments which match "f" are sent to the returned channel before new messages.
+//
+// The channel is closed when the subscriber falls behind, the hub stops or the returned function is called.
+// The returned function must be called when the subscriber is no longer used.
+func (h *Hub) Subscribe(f Filter) (<-chan Message, func()) {
+	return h.SubscribeSince(f, 0)
+}
+
+// SubscribeSince is like Subscribe but resumes a subscription which has received the message "since" before.
+// The kept messages after "since" are sent to the returned channel, including recent messages of finished deployments.
+// It is equivalent to Subscribe if "since" is 0.
+func (h *Hub) SubscribeSince(f Filter, since int64) (<-chan Message, func()) {
+	s := &subscriber{filter: f, since: since, ready: make(chan struct{})}
+	select {
+	case h.subscribe <- s:
+		<-s.ready
+	case <-h.done:
+		ch := make(chan Message)
+		close(ch)
+		return ch, func() {}
+	}
+	unsubscribe := func() {
+		select {
+		case h.unsubscribe <- s:
+		case <-h.done:
+		}
+	}
+	return s.ch, unsubscribe
+}
+
+// ServeWebsocket sends the messages which match "f" to "ws" until the client or the hub closes the connection.
+// Messages from the client are discarded.
+func (h *Hub) ServeWebsocket(ws *websocket.Conn, f Filter) {
+	msgs, unsubscribe := h.Subscribe(f)
+	defer unsubscribe()
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		var discarded string
+		for websocket.Message.Receive(ws, &discarded) == nil {
+		}
+	}()
+	for {
+		select {
+		case <-closed:
+			return
+		case m, ok := <-msgs:
+			if !ok {
+				return
+			}
+			if err := websocket.Message.Send(ws, m.Data); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// ServeSSE streams the messages which match "f" to "w" as server-sent events
+// until the client disconnects or the hub closes the stream.
+// The stream resumes after the event in the Last-Event-ID header of "r", or in its parameter "last_event_id", if the event is still kept.
+func (h *Hub) ServeSSE(w http.ResponseWriter, r *http.Request, f Filter) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	last := r.Header.Get("Last-Event-ID")
+	if last == "" {
+		last = r.FormValue("last_event_id")
+	}
+	msgs, unsubscribe := h.SubscribeSince(f, h.parseEventID(last))
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Disables buffering in nginx.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	var closed <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		closed = cn.CloseNotify()
+	}
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		var err error
+		select {
+		case <-closed:
+			return
+		case <-heartbeat.C:
+			// Keeps proxies from closing idle streams.
+			_, err = io.WriteString(w, ": heartbeat\n\n")
+		case m, ok := <-msgs:
+			if !ok {
+				return
+			}
+			err = writeEvent(w, h.eventID(m), m.Data)
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// writeEvent writes a server-sent event with "id" and "data" to "w".
+func writeEvent(w io.Writer, id, data string) error {
+	buf := fmt.Sprintf("id: %s\n", id)
+	for _, line := range strings.Split(data, "\n") {
+		buf += fmt.Sprintf("data: %s\n", line)
+	}
+	_, err := io.WriteString(w, buf+"\n")
+	return err
+}
+
+// eventID returns the ID of "m" in server-sent events.
+// It contains the time when the hub started so that IDs from before a restart are not mistaken for new ones.
+func (h *Hub) eventID(m Message) string {
+	return fmt.Sprintf("%d-%d", h.epoch, m.Seq)
+}
+
+// parseEventID returns the sequence number of the message whose ID in server-sent events is "id".
+// It returns 0 if "id" is invalid or was issued by another hub.
+func (h *Hub) parseEventID(id string) int64 {
+	parts := strings.SplitN(id, "-", 2)
+	if len(parts) != 2 || parts[0] != strconv.FormatInt(h.epoch, 10) {
+		return 0
+	}
+	seq, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || seq < 0 {
+		return 0
+	}
+	return seq
+}
+
+// addSubscriber registers "s" and queues the kept messages which match its filter.
+func (h *Hub) addSubscriber(s *subscriber) {
+	var msgs []Message
+	queued := make(map[int64]bool)
+	queue := func(m Message) {
+		if m.Seq > s.since && !queued[m.Seq] && s.filter.Match(m.Topic) {
+			msgs = append(msgs, m)
+			queued[m.Seq] = true
+		}
+	}
+	for _, kept := range h.replay {
+		for _, m := range kept {
+			queue(m)
+		}
+	}
+	if s.since > 0 {
+		for _, m := range h.recent {
+			queue(m)
+		}
+	}
+	sort.Sort(bySeq(msgs))
+	s.ch = make(chan Message, subscriberBuffer+len(msgs))
+	for _, m := range msgs {
+		s.ch <- m
+	}
+	h.subscribers[s] = true
+	close(s.ready)
+}
+
+// deliver numbers "m", keeps it for replay and sends it to the matching subscribers.
+func (h *Hub) deliver(m Message) {
+	h.seq++
+	m.Seq = h.seq
+	if id := m.Topic.DeployID; id != "" {
+		kept := append(h.replay[id], m)
+		if len(kept) > replayLimit {
+			kept = kept[len(kept)-replayLimit:]
+		}
+		h.replay[id] = kept
+	}
+	h.recent = append(h.recent, m)
+	if len(h.recent) > recentLimit {
+		h.recent = h.recent[len(h.recent)-recentLimit:]
+	}
+	for s := range h.subscribers {
+		if !s.filter.Match(m.Topic) {
+			continue
+		}
+		select {
+		case s.ch <- m:
+		default:
+			delete(h.subscribers, s)
+			close(s.ch)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package notification
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/websocket"
+)
+
+func TestFilterMatch(t *testing.T) {
+	for _, spec := range []struct {
+		f    Filter
+		t    Topic
+		want bool
+	}{
+		{
+			f:    Filter{DeployID: "1"},
+			t:    Topic{Project: "proj", Environment: "env", DeployID: "1"},
+			want: true,
+		},
+		{
+			f:    Filter{DeployID: "1", Project: "proj"},
+			t:    Topic{Project: "proj", Environment: "env", DeployID: "2"},
+			want: false,
+		},
+		{
+			f:    Filter{Project: "proj", Environment: "env"},
+			t:    Topic{Project: "proj", Environment: "env", DeployID: "2"},
+			want: true,
+		},
+		{
+			f:    Filter{Project: "proj", Environment: "env"},
+			t:    Topic{Project: "proj", Environment: "other"},
+			want: false,
+		},
+		{
+			f:    Filter{Project: "proj"},
+			t:    Topic{Project: "proj", Environment: "other"},
+			want: true,
+		},
+		{
+			f:    Filter{Project: "proj"},
+			t:    Topic{Project: "other", Environment: "env"},
+			want: false,
+		},
+	} {
+		if got := spec.f.Match(spec.t); got != spec.want {
+			t.Errorf("%#v.Match(%#v) = %v; want %v", spec.f, spec.t, got, spec.want)
+		}
+	}
+}
+
+func receiveData(t *testing.T, ch <-chan Message, want []string) {
+	for _, w := range want {
+		select {
+		case m, ok := <-ch:
+			if !ok {
+				t.Errorf("ch closed; want %q", w)
+				return
+			}
+			if got := m.Data; got != w {
+				t.Errorf("m.Data = %q; want %q", got, w)
+			}
+		case <-time.After(100 * time.Millisecond):
+			t.Errorf("ch timed out; want %q", w)
+			return
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := NewHub(ctx)
+
+	deploy, unsubscribeDeploy := h.Subscribe(Filter{DeployID: "1"})
+	defer unsubscribeDeploy()
+	env, unsubscribeEnv := h.Subscribe(Filter{Project: "proj", Environment: "env"})
+	defer unsubscribeEnv()
+
+	h.Publish(Topic{Project: "proj", Environment: "env", DeployID: "1"}, "line 1")
+	h.Publish(Topic{Project: "proj", Environment: "other", DeployID: "2"}, "other line")
+	h.Publish(Topic{Project: "proj", Environment: "env", DeployID: "3"}, "line 3")
+	h.Publish(Topic{Project: "proj", Environment: "env", DeployID: "1"}, "line 2")
+
+	receiveData(t, deploy, []string{"line 1", "line 2"})
+	receiveData(t, env, []string{"line 1", "line 3", "line 2"})
+}
+
+func TestSubscribeReplay(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := NewHub(ctx)
+
+	h.Publish(Topic{Project: "proj", Environment: "env", DeployID: "1"}, "line 1")
+	h.Publish(Topic{Project: "proj", Environment: "env", DeployID: "2"}, "other line")
+	h.Publish(Topic{Project: "proj", Environment: "env", DeployID: "1"}, "line 2")
+
+	late, unsubscribe := h.Subscribe(Filter{DeployID: "1"})
+	defer unsubscribe()
+	h.Publish(Topic{Project: "proj", Environment: "env", DeployID: "1"}, "line 3")
+	receiveData(t, late, []string{"line 1", "line 2", "line 3"})
+
+	env, unsubscribeEnv := h.Subscribe(Filter{Project: "proj"})
+	defer unsubscribeEnv()
+	receiveData(t, env, []string{"line 1", "other line", "line 2", "line 3"})
+
+	h.Finish("1")
+	finished, unsubscribeFinished := h.Subscribe(Filter{DeployID: "1"})
+	defer unsubscribeFinished()
+	h.Publish(Topic{Project: "proj", Environment: "env", DeployID: "1"}, "after finish")
+	receiveData(t, finished, []string{"after finish"})
+}
+
+func TestSubscribeWithStuckSubscriber(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := NewHub(ctx)
+
+	ch, unsubscribe := h.Subscribe(Filter{DeployID: "1"})
+	defer unsubscribe()
+	for i := 0; i < 2*subscriberBuffer; i++ {
+		h.Publish(Topic{DeployID: "1"}, "example message")
+	}
+	n := 0
+	for _ = range ch {
+		n++
+	}
+	if n > subscriberBuffer {
+		t.Errorf("received %d messages; want at most %d", n, subscriberBuffer)
+	}
+}
+
+func TestSubscribeAfterCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	h := NewHub(ctx)
+	cancel()
+	// Waits for the hub to stop.
+	time.Sleep(10 * time.Millisecond)
+
+	h.Publish(Topic{DeployID: "1"}, "example message")
+	ch, unsubscribe := h.Subscribe(Filter{DeployID: "1"})
+	unsubscribe()
+	if _, ok := <-ch; ok {
+		t.Errorf("<-ch succeeded; want closed")
+	}
+}
+
+func TestServeWebsocket(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := NewHub(ctx)
+	h.Publish(Topic{Project: "proj", Environment: "env", DeployID: "1"}, "line 1")
+
+	s := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		h.ServeWebsocket(ws, Filter{DeployID: "1"})
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatalf("url.Parse(%q) failed with %v; want success", s.URL, err)
+	}
+	u.Scheme = "ws"
+	const origin = "http://origin.example"
+	ws, err := websocket.Dial(u.String(), "", origin)
+	if err != nil {
+		t.Fatalf("websocket.Dial(%q, %q, %q) failed with %v; want success", u.String(), "", origin, err)
+	}
+	defer ws.Close()
+
+	// Messages from clients are not relayed.
+	if err := websocket.Message.Send(ws, "from client"); err != nil {
+		t.Errorf("websocket.Message.Send(ws, %q) failed with %v; want success", "from client", err)
+	}
+	h.Publish(Topic{Project: "proj", Environment: "env", DeployID: "2"}, "other line")
+	h.Publish(Topic{Project: "proj", Environment: "env", DeployID: "1"}, "line 2")
+	for _, want := range []string{"line 1", "line 2"} {
+		var msg string
+		if err := websocket.Message.Receive(ws, &msg); err != nil {
+			t.Errorf("websocket.Message.Receive(ws, &msg) failed with %v; want success", err)
+			return
+		}
+		if got := msg; got != want {
+			t.Errorf("msg = %q; want %q", got, want)
+		}
+	}
+}
+
+func TestSubscribeSince(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := NewHub(ctx)
+
+	ch, unsubscribe := h.Subscribe(Filter{Project: "proj"})
+	h.Publish(Topic{Project: "proj", Environment: "env", DeployID: "1"}, "line 1")
+	h.Publish(Topic{Project: "proj", Environment: "env"}, "locked")
+	var last Message
+	select {
+	case last = <-ch:
+	case <-time.After(100 * time.Millisecond):
+		t.Fatalf("ch timed out; want a message")
+	}
+	unsubscribe()
+
+	h.Publish(Topic{Project: "proj", Environment: "env", DeployID: "1"}, "line 2")
+	h.Finish("1")
+	h.Publish(Topic{Project: "other", Environment: "env"}, "other message")
+
+	resumed, unsubscribeResumed := h.SubscribeSince(Filter{Project: "proj"}, last.Seq)
+	defer unsubscribeResumed()
+	receiveData(t, resumed, []string{"locked", "line 2"})
+
+	fresh, unsubscribeFresh := h.SubscribeSince(Filter{Project: "proj"}, 0)
+	defer unsubscribeFresh()
+	h.Publish(Topic{Project: "proj", Environment: "env"}, "unlocked")
+	receiveData(t, fresh, []string{"unlocked"})
+}
+
+func TestParseEventID(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := NewHub(ctx)
+
+	for _, spec := range []struct {
+		id   string
+		want int64
+	}{
+		{id: h.eventID(Message{Seq: 3}), want: 3},
+		{id: fmt.Sprintf("%d-3", h.epoch+1), want: 0},
+		{id: fmt.Sprintf("%d-x", h.epoch), want: 0},
+		{id: "3", want: 0},
+		{id: "", want: 0},
+	} {
+		if got := h.parseEventID(spec.id); got != spec.want {
+			t.Errorf("h.parseEventID(%q) = %d; want %d", spec.id, got, spec.want)
+		}
+	}
+}
+
+// readEvents reads "n" server-sent events from "r" and returns their IDs and data.
+func readEvents(t *testing.T, r *bufio.Reader, n int) (ids, data []string) {
+	for len(data) < n {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("r.ReadString('\\n') failed with %v; want success", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			ids = append(ids, strings.TrimPrefix(line, "id: "))
+		case strings.HasPrefix(line, "data: "):
+			data = append(data, strings.TrimPrefix(line, "data: "))
+		}
+	}
+	return ids, data
+}
+
+func TestServeSSE(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := NewHub(ctx)
+	h.Publish(Topic{Project: "proj", Environment: "env", DeployID: "1"}, "line 1")
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeSSE(w, r, Filter{DeployID: "1"})
+	}))
+	defer s.Close()
+
+	get := func(lastEventID string) *http.Response {
+		req, err := http.NewRequest("GET", s.URL, nil)
+		if err != nil {
+			t.Fatalf("http.NewRequest(%q, %q, nil) failed with %v; want success", "GET", s.URL, err)
+		}
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("http.DefaultClient.Do(req) failed with %v; want success", err)
+		}
+		if got, want := resp.Header.Get("Content-Type"), "text/event-stream"; got != want {
+			t.Errorf("Content-Type = %q; want %q", got, want)
+		}
+		return resp
+	}
+
+	resp := get("")
+	h.Publish(Topic{Project: "proj", Environment: "env", DeployID: "1"}, "line 2")
+	ids, data := readEvents(t, bufio.NewReader(resp.Body), 2)
+	resp.Body.Close()
+	if got, want := strings.Join(data, ","), "line 1,line 2"; got != want {
+		t.Errorf("data = %q; want %q", got, want)
+	}
+
+	h.Publish(Topic{Project: "proj", Environment: "env", DeployID: "1"}, "line 3")
+	resp = get(ids[0])
+	defer resp.Body.Close()
+	_, data = readEvents(t, bufio.NewReader(resp.Body), 2)
+	if got, want := strings.Join(data, ","), "line 2,line 3"; got != want {
+		t.Errorf("data = %q; want %q", got, want)
+	}
+}
@@ -1,141 +1,68 @@
 package notification
 
 import (
+	"time"
+
 	"golang.org/x/net/context"
-	"golang.org/x/net/websocket"
 )
 
-// NewHub returns a new hub which is accepting notifications and connections.
+// NewHub returns a new hub which is accepting notifications and subscribers.
 // The hub stops accepting new requests when "ctx" is canceled.
 func NewHub(ctx context.Context) *Hub {
 	h := &Hub{
-		broadcast:   make(chan string),
-		register:    make(chan *connection),
-		connections: make(map[*connection]context.CancelFunc),
+		done:        ctx.Done(),
+		publish:     make(chan Message),
+		finish:      make(chan string),
+		subscribe:   make(chan *subscriber),
+		unsubscribe: make(chan *subscriber),
+		subscribers: make(map[*subscriber]bool),
+		replay:      make(map[string][]Message),
+		epoch:       time.Now().UnixNano(),
 	}
 	go h.run(ctx)
 	return h
 }
 
-// Hub is a hub of websocket connections.
-// Those connections are connected to each other via this hub.
+// Hub delivers published messages to subscribers whose filters match the topics of the messages.
 type Hub struct {
-	// connections are the registered connections.
-	connections map[*connection]context.CancelFunc
-
-	// broadcast accepts inbound messages from the connections.
-	broadcast chan string
-
-	// register accepts new connections to be registered
-	register chan *connection
-}
-
-// AcceptConnection receives a websocket connection and register it as a subscriber of broadcast notifications.
-func (h *Hub) AcceptConnection(ws *websocket.Conn) {
-	r, w := make(chan string, 256), h.broadcast
-	c := connection{ws: ws, r: r, w: w, closed: make(chan struct{})}
-	h.register <- &c
-	<-c.closed
-}
-
-// Broadcast sends "msg" to the registered connections.
-func (h *Hub) Broadcast(msg string) {
-	h.broadcast <- msg
+	// done is closed when the hub stops.
+	done <-chan struct{}
+	// publish accepts messages to be delivered to the subscribers.
+	publish chan Message
+	// finish accepts IDs of deployments whose messages are no longer replayed.
+	finish chan string
+	// subscribe and unsubscribe accept subscribers to be registered and unregistered.
+	subscribe, unsubscribe chan *subscriber
+	// subscribers are the registered subscribers.
+	subscribers map[*subscriber]bool
+	// replay keeps messages of running deployments by deployment ID.
+	replay map[string][]Message
+	// recent keeps the latest messages for subscribers which resume after a message.
+	recent []Message
+	// seq is the sequence number of the last published message.
+	seq int64
+	// epoch is the time when the hub started in nanoseconds.
+	epoch int64
 }
 
 func (h *Hub) run(ctx context.Context) {
 	for {
 		select {
 		case <-ctx.Done():
-			return
-		case c := <-h.register:
-			h.connections[c] = c.start(ctx)
-		case m := <-h.broadcast:
-			for c, cancel := range h.connections {
-				select {
-				case <-c.closed:
-					delete(h.connections, c)
-				case c.r <- m:
-				default:
-					delete(h.connections, c)
-					cancel()
-				}
-			}
-		}
-	}
-}
-
-// connection is a bidirectional pipe between a websocket connection and go channels.
-type connection struct {
-	// The websocket connection.
-	ws *websocket.Conn
-
-	r chan string
-	w chan<- string
-
-	// closed is a channel which is closed when this connection is being closed
-	closed chan struct{}
-}
-
-// start starts forwarding between internal channels and the websocket connection
-// The forwarding loop stops when "ctx" is canceled or the function which this function returns is called.
-func (c *connection) start(ctx context.Context) context.CancelFunc {
-	ctx, cancel := context.WithCancel(ctx)
-	go func() {
-		defer cancel()
-		c.writerLoop(ctx)
-	}()
-	go func() {
-		defer cancel()
-		c.readerLoop(ctx)
-	}()
-	go func() {
-		<-ctx.Done()
-		close(c.closed)
-	}()
-	return cancel
-}
-
-func (c *connection) writerLoop(ctx context.Context) {
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case message := <-c.r:
-			err := websocket.Message.Send(c.ws, message)
-			if err != nil {
-				// TODO(yugui) add logging
-				break
-			}
-		}
-	}
-}
-
-func (c *connection) readerLoop(ctx context.Context) {
-	defer c.ws.Close()
-	ch := make(chan string, 1)
-	for {
-		go func() {
-			var message string
-			err := websocket.Message.Receive(c.ws, &message)
-			if err != nil {
-				// TODO(yugui) add logging
-				close(ch)
-				return
+			for s := range h.subscribers {
+				close(s.ch)
 			}
-			ch <- message
-		}()
-		select {
-		case <-ctx.Done():
 			return
-		case m, ok := <-ch:
-			if !ok {
-				return
-			}
-			select {
-			case <-ctx.Done():
-				return
-			case c.w <- m:
+		case m := <-h.publish:
+			h.deliver(m)
+		case id := <-h.finish:
+			delete(h.replay, id)
+		case s := <-h.subscribe:
+			h.addSubscriber(s)
+		case s := <-h.unsubscribe:
+			if h.subscribers[s] {
+				delete(h.subscribers, s)
+				close(s.ch)
 			}
 		}
 	}
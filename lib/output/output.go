@@ -0,0 +1,414 @@
+// Package output records the output of deployments.
+//
+// An output is a sequence of lines. Each line keeps the stream which it was written to,
+// the time elapsed since the output started and its original text including ANSI escape sequences.
+//
+// Outputs are stored in a compact binary format:
+// a header which consists of the magic string and the start time in nanoseconds since the Unix epoch (8 bytes, big endian),
+// followed by a record per line. A record consists of the code of the stream (1 byte),
+// the time elapsed since the previous record in nanoseconds (uvarint),
+// the length of the text (uvarint) and the text itself.
+package output
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// magic is the beginning of output files.
+const magic = "GOSHIPOUT1\n"
+
+// headerSize is the size of the header of output files.
+const headerSize = len(magic) + 8
+
+// maxLineSize is the maximum length of the text of a line.
+// Longer lengths in output files are rejected so that a corrupt record cannot exhaust the memory.
+const maxLineSize = 1 << 20
+
+// ErrInvalidFormat means that a file is not an output file.
+var ErrInvalidFormat = errors.New("invalid output format")
+
+var (
+	// ErrLimitReached means that a line was discarded because the output reached its limit.
+	// The truncation marker was recorded instead.
+	ErrLimitReached = errors.New("output limit reached")
+	// ErrTruncated means that a line was discarded because the output has been truncated.
+	ErrTruncated = errors.New("output truncated")
+)
+
+// CompressedExt is the extension which Compress appends to the names of compressed files.
+const CompressedExt = ".gz"
+
+// TruncationMarker returns the line which is recorded when an output exceeds "limit" bytes.
+func TruncationMarker(limit int64) string {
+	return fmt.Sprintf("===== output truncated: exceeded %d bytes =====", limit)
+}
+
+// Stream is a stream which lines are written to.
+type Stream string
+
+const (
+	// Stdout is the standard output of commands.
+	Stdout = Stream("stdout")
+	// Stderr is the standard error output of commands.
+	Stderr = Stream("stderr")
+	// System is messages of Goship itself, e.g. section markers.
+	System = Stream("system")
+)
+
+// streamCodes are the streams indexed by their codes in output files.
+var streamCodes = []Stream{System, Stdout, Stderr}
+
+func (s Stream) code() (byte, error) {
+	for i, c := range streamCodes {
+		if c == s {
+			return byte(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown stream %q", s)
+}
+
+// Line is a line of an output.
+type Line struct {
+	Stream Stream `json:"stream"`
+	// Elapsed is the time elapsed since the output started. It never decreases in an output.
+	Elapsed time.Duration `json:"elapsed"`
+	// Text is the text of the line without its line break.
+	// It keeps ANSI escape sequences.
+	Text string `json:"text"`
+}
+
+// Log is a recorded output.
+type Log struct {
+	// Start is the time when the output started.
+	Start time.Time
+	Lines []Line
+}
+
+// Writer appends lines to an output file.
+// It is safe for concurrent use, and lines are recorded in the order which WriteLine is called in.
+type Writer struct {
+	mu    sync.Mutex
+	f     *os.File
+	start time.Time
+	// last is the elapsed time of the last line.
+	last time.Duration
+	// now returns the current time.
+	now func() time.Time
+	// size is the total size of the texts of the lines.
+	size int64
+	// limit is the maximum of size. It is unlimited if zero.
+	limit     int64
+	truncated bool
+}
+
+// Create opens the output file "name" for appending, creating it and its directory if necessary.
+// The output of a new file starts at "start".
+func Create(name string, start time.Time) (*Writer, error) {
+	return create(name, start, time.Now)
+}
+
+func create(name string, start time.Time, now func() time.Time) (*Writer, error) {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w := &Writer{f: f, start: start, now: now}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if fi.Size() == 0 {
+		var header [headerSize]byte
+		copy(header[:], magic)
+		binary.BigEndian.PutUint64(header[len(magic):], uint64(start.UnixNano()))
+		if _, err := f.Write(header[:]); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return w, nil
+	}
+
+	// Continues the existing output.
+	l, n, err := read(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if n < fi.Size() {
+		// Drops a partially written record so that new records are not appended to it.
+		if err := f.Truncate(n); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	w.start = l.Start
+	if n := len(l.Lines); n > 0 {
+		w.last = l.Lines[n-1].Elapsed
+	}
+	for _, line := range l.Lines {
+		w.size += int64(len(line.Text))
+	}
+	return w, nil
+}
+
+// SetLimit limits the total size of the texts of the lines to "n" bytes.
+// Once a line exceeds the limit, the truncation marker is recorded and the rest of the output is discarded.
+// The output is unlimited if "n" is zero.
+func (w *Writer) SetLimit(n int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.limit = n
+}
+
+// Limit returns the limit of the total size of the texts of the lines.
+func (w *Writer) Limit() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.limit
+}
+
+// WriteLine appends "text" written to "s".
+// It returns ErrLimitReached if "text" exceeds the limit of the output, and ErrTruncated for lines after that.
+func (w *Writer) WriteLine(s Stream, text string) error {
+	code, err := s.code()
+	if err != nil {
+		return err
+	}
+	if len(text) > maxLineSize {
+		return fmt.Errorf("line of %d bytes exceeds the maximum of %d bytes", len(text), maxLineSize)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.truncated {
+		return ErrTruncated
+	}
+	if w.limit > 0 && w.size+int64(len(text)) > w.limit {
+		w.truncated = true
+		sc, _ := System.code()
+		if err := w.write(sc, TruncationMarker(w.limit)); err != nil {
+			return err
+		}
+		return ErrLimitReached
+	}
+	if err := w.write(code, text); err != nil {
+		return err
+	}
+	w.size += int64(len(text))
+	return nil
+}
+
+// write appends a record of "text" with the stream "code".
+func (w *Writer) write(code byte, text string) error {
+	elapsed := w.now().Sub(w.start)
+	if elapsed < w.last {
+		// Keeps elapsed times monotonic even if the clock goes back.
+		elapsed = w.last
+	}
+	buf := make([]byte, 1+2*binary.MaxVarintLen64+len(text))
+	buf[0] = code
+	n := 1
+	n += binary.PutUvarint(buf[n:], uint64(elapsed-w.last))
+	n += binary.PutUvarint(buf[n:], uint64(len(text)))
+	n += copy(buf[n:], text)
+	if _, err := w.f.Write(buf[:n]); err != nil {
+		return err
+	}
+	w.last = elapsed
+	return nil
+}
+
+// Close closes the output file.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.f.Close()
+}
+
+// Read reads an output from "r".
+// A partially written record at the end is ignored because the output may be still being written.
+func Read(r io.Reader) (Log, error) {
+	l, _, err := read(r)
+	return l, err
+}
+
+// read reads an output from "r" like Read.
+// It also returns the number of bytes up to the end of the last complete record.
+func read(r io.Reader) (Log, int64, error) {
+	cr := &countingReader{r: bufio.NewReader(r)}
+	var header [headerSize]byte
+	if _, err := io.ReadFull(cr, header[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return Log{}, 0, ErrInvalidFormat
+		}
+		return Log{}, 0, err
+	}
+	if !bytes.Equal(header[:len(magic)], []byte(magic)) {
+		return Log{}, 0, ErrInvalidFormat
+	}
+	l := Log{Start: time.Unix(0, int64(binary.BigEndian.Uint64(header[len(magic):])))}
+
+	var elapsed time.Duration
+	for {
+		n := cr.n
+		code, err := cr.ReadByte()
+		if err == io.EOF {
+			return l, n, nil
+		}
+		if err != nil {
+			return Log{}, 0, err
+		}
+		if int(code) >= len(streamCodes) {
+			return Log{}, 0, ErrInvalidFormat
+		}
+		delta, err := binary.ReadUvarint(cr)
+		if err != nil {
+			return partial(l, n, err)
+		}
+		size, err := binary.ReadUvarint(cr)
+		if err != nil {
+			return partial(l, n, err)
+		}
+		if size > maxLineSize {
+			return Log{}, 0, ErrInvalidFormat
+		}
+		text := make([]byte, size)
+		if _, err := io.ReadFull(cr, text); err != nil {
+			return partial(l, n, err)
+		}
+		elapsed += time.Duration(delta)
+		l.Lines = append(l.Lines, Line{Stream: streamCodes[code], Elapsed: elapsed, Text: string(text)})
+	}
+}
+
+// partial returns "l" and "n" if "err" means that the last record is incomplete.
+func partial(l Log, n int64, err error) (Log, int64, error) {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return l, n, nil
+	}
+	return Log{}, 0, err
+}
+
+// countingReader counts the bytes read from "r".
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+// ReadFile reads the output file "name".
+// It decompresses the file if its name ends with CompressedExt.
+func ReadFile(name string) (Log, error) {
+	r, err := Open(name)
+	if err != nil {
+		return Log{}, err
+	}
+	defer r.Close()
+	return Read(r)
+}
+
+// Open opens the file "name" for reading.
+// It decompresses the file if its name ends with CompressedExt.
+func Open(name string) (io.ReadCloser, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(name, CompressedExt) {
+		return f, nil
+	}
+	z, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return gzipFile{Reader: z, f: f}, nil
+}
+
+// gzipFile is a compressed file which is being read.
+type gzipFile struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (z gzipFile) Close() error {
+	err := z.Reader.Close()
+	if cerr := z.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Compress compresses the file "name" into "name" + CompressedExt and removes the original file.
+// It returns the number of bytes which the compression freed. It can be negative for tiny files.
+func Compress(name string) (int64, error) {
+	src, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	fi, err := src.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	// Writes into a temporary file so that readers never see a partially compressed file.
+	tmp := name + CompressedExt + ".tmp"
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, err
+	}
+	z := gzip.NewWriter(dst)
+	_, err = io.Copy(z, src)
+	if cerr := z.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	zfi, err := os.Stat(tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	if err := os.Rename(tmp, name+CompressedExt); err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	if err := os.Remove(name); err != nil {
+		return 0, err
+	}
+	return fi.Size() - zfi.Size(), nil
+}
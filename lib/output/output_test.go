@@ -0,0 +1,265 @@
+package output
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClock returns the given times in order.
+type fakeClock struct {
+	times []time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	t := c.times[0]
+	c.times = c.times[1:]
+	return t
+}
+
+func TestWriteAndRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goship-output")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(%q, %q) failed with %v; want success", "", "goship-output", err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "proj-env", "1.out")
+
+	start := time.Unix(1000, 0)
+	clock := &fakeClock{times: []time.Time{
+		start.Add(time.Second),
+		start.Add(2 * time.Second),
+		// The clock goes back.
+		start.Add(time.Second / 2),
+		start.Add(5 * time.Second),
+	}}
+	w, err := create(name, start, clock.now)
+	if err != nil {
+		t.Fatalf("create(%q, %v, now) failed with %v; want success", name, start, err)
+	}
+	for _, l := range []struct {
+		s    Stream
+		text string
+	}{
+		{System, "===== deploy ====="},
+		{Stdout, "\x1b[32mok\x1b[0m"},
+		{Stderr, "warning"},
+	} {
+		if err := w.WriteLine(l.s, l.text); err != nil {
+			t.Errorf("w.WriteLine(%q, %q) failed with %v; want success", l.s, l.text, err)
+		}
+	}
+	if err := w.WriteLine(Stream("unknown"), "text"); err == nil {
+		t.Errorf("w.WriteLine(%q, %q) succeeded; want failure", "unknown", "text")
+	}
+	if err := w.Close(); err != nil {
+		t.Errorf("w.Close() failed with %v; want success", err)
+	}
+
+	// Reopening continues the output.
+	w, err = create(name, start.Add(time.Hour), clock.now)
+	if err != nil {
+		t.Fatalf("create(%q, %v, now) failed with %v; want success", name, start, err)
+	}
+	if err := w.WriteLine(Stdout, ""); err != nil {
+		t.Errorf("w.WriteLine(%q, %q) failed with %v; want success", Stdout, "", err)
+	}
+	w.Close()
+
+	got, err := ReadFile(name)
+	if err != nil {
+		t.Fatalf("ReadFile(%q) failed with %v; want success", name, err)
+	}
+	want := Log{
+		Start: start,
+		Lines: []Line{
+			{Stream: System, Elapsed: time.Second, Text: "===== deploy ====="},
+			{Stream: Stdout, Elapsed: 2 * time.Second, Text: "\x1b[32mok\x1b[0m"},
+			{Stream: Stderr, Elapsed: 2 * time.Second, Text: "warning"},
+			{Stream: Stdout, Elapsed: 5 * time.Second, Text: ""},
+		},
+	}
+	if !got.Start.Equal(want.Start) || !reflect.DeepEqual(got.Lines, want.Lines) {
+		t.Errorf("ReadFile(%q) = %#v; want %#v", name, got, want)
+	}
+
+	// A partially written record is ignored.
+	buf, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatalf("ioutil.ReadFile(%q) failed with %v; want success", name, err)
+	}
+	partial := append(buf, 1, 0, 10, 'x')
+	got, err = Read(bytes.NewReader(partial))
+	if err != nil {
+		t.Errorf("Read(partial) failed with %v; want success", err)
+	}
+	if !reflect.DeepEqual(got.Lines, want.Lines) {
+		t.Errorf("Read(partial) = %#v; want %#v", got.Lines, want.Lines)
+	}
+
+	// Reopening drops a partially written record before appending.
+	if err := ioutil.WriteFile(name, partial, 0644); err != nil {
+		t.Fatalf("ioutil.WriteFile(%q) failed with %v; want success", name, err)
+	}
+	clock.times = []time.Time{start.Add(6 * time.Second)}
+	w, err = create(name, start, clock.now)
+	if err != nil {
+		t.Fatalf("create(%q, %v, now) failed with %v; want success", name, start, err)
+	}
+	if err := w.WriteLine(Stdout, "resumed"); err != nil {
+		t.Errorf("w.WriteLine(%q, %q) failed with %v; want success", Stdout, "resumed", err)
+	}
+	w.Close()
+	want.Lines = append(want.Lines, Line{Stream: Stdout, Elapsed: 6 * time.Second, Text: "resumed"})
+	got, err = ReadFile(name)
+	if err != nil {
+		t.Fatalf("ReadFile(%q) failed with %v; want success", name, err)
+	}
+	if !reflect.DeepEqual(got.Lines, want.Lines) {
+		t.Errorf("ReadFile(%q) = %#v; want %#v", name, got.Lines, want.Lines)
+	}
+
+	if err := w.WriteLine(Stdout, strings.Repeat("x", maxLineSize+1)); err == nil {
+		t.Errorf("w.WriteLine(%q, <%d bytes>) succeeded; want failure", Stdout, maxLineSize+1)
+	}
+}
+
+func TestWriteLineWithLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goship-output")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(%q, %q) failed with %v; want success", "", "goship-output", err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "1.out")
+
+	start := time.Unix(1000, 0)
+	w, err := create(name, start, func() time.Time { return start })
+	if err != nil {
+		t.Fatalf("create(%q, %v, now) failed with %v; want success", name, start, err)
+	}
+	w.SetLimit(10)
+	for _, spec := range []struct {
+		s    Stream
+		text string
+		want error
+	}{
+		{s: Stdout, text: "12345"},
+		{s: Stderr, text: "67890"},
+		{s: Stdout, text: "x", want: ErrLimitReached},
+		{s: Stdout, text: "", want: ErrTruncated},
+		{s: System, text: "===== done =====", want: ErrTruncated},
+	} {
+		if err := w.WriteLine(spec.s, spec.text); err != spec.want {
+			t.Errorf("w.WriteLine(%q, %q) = %v; want %v", spec.s, spec.text, err, spec.want)
+		}
+	}
+	w.Close()
+
+	got, err := ReadFile(name)
+	if err != nil {
+		t.Fatalf("ReadFile(%q) failed with %v; want success", name, err)
+	}
+	want := []Line{
+		{Stream: Stdout, Text: "12345"},
+		{Stream: Stderr, Text: "67890"},
+		{Stream: System, Text: TruncationMarker(10)},
+	}
+	if !reflect.DeepEqual(got.Lines, want) {
+		t.Errorf("ReadFile(%q) = %#v; want %#v", name, got.Lines, want)
+	}
+}
+
+func TestCompress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goship-output")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(%q, %q) failed with %v; want success", "", "goship-output", err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "1.out")
+
+	start := time.Unix(1000, 0)
+	w, err := create(name, start, func() time.Time { return start })
+	if err != nil {
+		t.Fatalf("create(%q, %v, now) failed with %v; want success", name, start, err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := w.WriteLine(Stdout, "a chatty deploy command"); err != nil {
+			t.Fatalf("w.WriteLine(%q, %q) failed with %v; want success", Stdout, "a chatty deploy command", err)
+		}
+	}
+	w.Close()
+	want, err := ReadFile(name)
+	if err != nil {
+		t.Fatalf("ReadFile(%q) failed with %v; want success", name, err)
+	}
+
+	freed, err := Compress(name)
+	if err != nil {
+		t.Fatalf("Compress(%q) failed with %v; want success", name, err)
+	}
+	if freed <= 0 {
+		t.Errorf("Compress(%q) = %d; want > 0", name, freed)
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("os.Stat(%q) = %v; want not exist", name, err)
+	}
+	got, err := ReadFile(name + CompressedExt)
+	if err != nil {
+		t.Fatalf("ReadFile(%q) failed with %v; want success", name+CompressedExt, err)
+	}
+	if !got.Start.Equal(want.Start) || !reflect.DeepEqual(got.Lines, want.Lines) {
+		t.Errorf("ReadFile(%q) = %#v; want %#v", name+CompressedExt, got, want)
+	}
+}
+
+func TestReadInvalid(t *testing.T) {
+	// A record which claims a text longer than the maximum.
+	huge := magic + "\x00\x00\x00\x00\x00\x00\x00\x00" + "\x01\x00\xff\xff\xff\xff\xff\xff\xff\xff\x7f"
+	for _, s := range []string{"", "plain text output\n", magic, huge} {
+		if _, err := Read(strings.NewReader(s)); err != ErrInvalidFormat {
+			t.Errorf("Read(%q) failed with %v; want %v", s, err, ErrInvalidFormat)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	l := Log{
+		Start: time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC),
+		Lines: []Line{
+			{Stream: System, Elapsed: 0, Text: "start"},
+			{Stream: Stdout, Elapsed: 1500 * time.Millisecond, Text: "\x1b[1;31mfailed\x1b[0m <b>\x1b[K"},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := WriteText(&buf, l); err != nil {
+		t.Errorf("WriteText(&buf, l) failed with %v; want success", err)
+	}
+	if got, want := buf.String(), "start\nfailed <b>\n"; got != want {
+		t.Errorf("WriteText(&buf, l) wrote %q; want %q", got, want)
+	}
+
+	buf.Reset()
+	if err := WriteJSON(&buf, l); err != nil {
+		t.Errorf("WriteJSON(&buf, l) failed with %v; want success", err)
+	}
+	want := `{"stream":"system","time":"2016-01-02T03:04:05Z","elapsed":0,"text":"start"}` + "\n" +
+		`{"stream":"stdout","time":"2016-01-02T03:04:06.5Z","elapsed":1.5,"text":"\u001b[1;31mfailed\u001b[0m \u003cb\u003e\u001b[K"}` + "\n"
+	if got := buf.String(); got != want {
+		t.Errorf("WriteJSON(&buf, l) wrote %q; want %q", got, want)
+	}
+
+	buf.Reset()
+	if err := WriteHTML(&buf, l); err != nil {
+		t.Errorf("WriteHTML(&buf, l) failed with %v; want success", err)
+	}
+	want = `<span class="line stdout"><span class="elapsed">[   1.500]</span> <span class="ansi-bold ansi-fg-1">failed</span> &lt;b&gt;</span>`
+	if got := buf.String(); !strings.Contains(got, want) {
+		t.Errorf("WriteHTML(&buf, l) wrote %q; want to contain %q", got, want)
+	}
+}
@@ -0,0 +1,172 @@
+package output
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ansiSequence matches ANSI escape sequences.
+var ansiSequence = regexp.MustCompile(`\x1B\[([0-9;]*)([A-Za-z])`)
+
+// StripANSI removes ANSI escape sequences from "text".
+func StripANSI(text string) string {
+	return ansiSequence.ReplaceAllString(text, "")
+}
+
+// WriteText writes the lines of "l" as plain text without ANSI escape sequences.
+func WriteText(w io.Writer, l Log) error {
+	for _, line := range l.Lines {
+		if _, err := io.WriteString(w, StripANSI(line.Text)+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jsonLine is a line of outputs in JSON lines.
+type jsonLine struct {
+	Stream Stream    `json:"stream"`
+	Time   time.Time `json:"time"`
+	// Elapsed is the time elapsed since the output started in seconds.
+	Elapsed float64 `json:"elapsed"`
+	// Text keeps ANSI escape sequences.
+	Text string `json:"text"`
+}
+
+// WriteJSON writes the lines of "l" as JSON lines, i.e. a JSON object per line.
+func WriteJSON(w io.Writer, l Log) error {
+	enc := json.NewEncoder(w)
+	for _, line := range l.Lines {
+		jl := jsonLine{
+			Stream:  line.Stream,
+			Time:    l.Start.Add(line.Elapsed),
+			Elapsed: line.Elapsed.Seconds(),
+			Text:    line.Text,
+		}
+		if err := enc.Encode(jl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stylesheet is the CSS for the HTML which WriteHTML writes.
+const Stylesheet = `
+pre.output { color: #eee; background-color: #222; padding: 5px; }
+pre.output .stderr { color: #f99; }
+pre.output .system { color: #9cf; }
+pre.output .elapsed { color: #888; }
+pre.output .ansi-bold { font-weight: bold; }
+pre.output .ansi-fg-0 { color: #555; } pre.output .ansi-bg-0 { background-color: #000; }
+pre.output .ansi-fg-1 { color: #e33; } pre.output .ansi-bg-1 { background-color: #a00; }
+pre.output .ansi-fg-2 { color: #3c3; } pre.output .ansi-bg-2 { background-color: #0a0; }
+pre.output .ansi-fg-3 { color: #dd3; } pre.output .ansi-bg-3 { background-color: #a50; }
+pre.output .ansi-fg-4 { color: #58f; } pre.output .ansi-bg-4 { background-color: #00a; }
+pre.output .ansi-fg-5 { color: #d5d; } pre.output .ansi-bg-5 { background-color: #a0a; }
+pre.output .ansi-fg-6 { color: #3dd; } pre.output .ansi-bg-6 { background-color: #0aa; }
+pre.output .ansi-fg-7 { color: #eee; } pre.output .ansi-bg-7 { background-color: #aaa; }
+`
+
+// WriteHTML writes the lines of "l" as an HTML fragment.
+// Colours and bold text of ANSI escape sequences are rendered with the classes in Stylesheet.
+func WriteHTML(w io.Writer, l Log) error {
+	if _, err := io.WriteString(w, `<pre class="output">`); err != nil {
+		return err
+	}
+	for _, line := range l.Lines {
+		elapsed := fmt.Sprintf("[%8.3f]", line.Elapsed.Seconds())
+		s := fmt.Sprintf(`<span class="line %s"><span class="elapsed">%s</span> %s</span>`+"\n", line.Stream, elapsed, ansiToHTML(line.Text))
+		if _, err := io.WriteString(w, s); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "</pre>")
+	return err
+}
+
+// sgrState is the text attributes set by ANSI SGR sequences.
+type sgrState struct {
+	bold   bool
+	fg, bg int
+}
+
+func (s sgrState) classes() []string {
+	var c []string
+	if s.bold {
+		c = append(c, "ansi-bold")
+	}
+	if s.fg >= 0 {
+		c = append(c, fmt.Sprintf("ansi-fg-%d", s.fg))
+	}
+	if s.bg >= 0 {
+		c = append(c, fmt.Sprintf("ansi-bg-%d", s.bg))
+	}
+	return c
+}
+
+// apply updates "s" with the parameters of an SGR sequence.
+func (s *sgrState) apply(params string) {
+	if params == "" {
+		params = "0"
+	}
+	for _, p := range strings.Split(params, ";") {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			continue
+		}
+		switch {
+		case n == 0:
+			*s = sgrState{fg: -1, bg: -1}
+		case n == 1:
+			s.bold = true
+		case n == 22:
+			s.bold = false
+		case 30 <= n && n <= 37:
+			s.fg = n - 30
+		case n == 39:
+			s.fg = -1
+		case 40 <= n && n <= 47:
+			s.bg = n - 40
+		case n == 49:
+			s.bg = -1
+		case 90 <= n && n <= 97:
+			// Bright colours are rendered as bold normal colours.
+			s.fg, s.bold = n-90, true
+		case 100 <= n && n <= 107:
+			s.bg = n - 100
+		}
+	}
+}
+
+// ansiToHTML escapes "text" and converts its SGR sequences into spans.
+// Other escape sequences are removed.
+func ansiToHTML(text string) string {
+	var buf []string
+	st := sgrState{fg: -1, bg: -1}
+	write := func(s string) {
+		if s == "" {
+			return
+		}
+		s = html.EscapeString(s)
+		if c := st.classes(); len(c) > 0 {
+			s = fmt.Sprintf(`<span class="%s">%s</span>`, strings.Join(c, " "), s)
+		}
+		buf = append(buf, s)
+	}
+	pos := 0
+	for _, m := range ansiSequence.FindAllStringSubmatchIndex(text, -1) {
+		write(text[pos:m[0]])
+		if text[m[4]:m[5]] == "m" {
+			st.apply(text[m[2]:m[3]])
+		}
+		pos = m[1]
+	}
+	write(text[pos:])
+	return strings.Join(buf, "")
+}
@@ -0,0 +1,61 @@
+// Package process runs commands in their own process groups so that they can be terminated together with their children.
+package process
+
+import (
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Process is a command running in its own process group.
+type Process struct {
+	cmd *exec.Cmd
+	// exited is closed when the command exits.
+	exited chan struct{}
+}
+
+// Start starts "cmd" in a new process group.
+func Start(cmd *exec.Cmd) (*Process, error) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = new(syscall.SysProcAttr)
+	}
+	cmd.SysProcAttr.Setpgid = true
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &Process{cmd: cmd, exited: make(chan struct{})}, nil
+}
+
+// Wait waits for the command to exit.
+// It must be called exactly once.
+func (p *Process) Wait() error {
+	defer close(p.exited)
+	return p.cmd.Wait()
+}
+
+// Terminate sends SIGTERM to the process group, and then sends SIGKILL
+// if the command does not exit within "grace".
+// It blocks until the command exits or SIGKILL is sent.
+func (p *Process) Terminate(grace time.Duration) {
+	select {
+	case <-p.exited:
+		return
+	default:
+	}
+	pgid := p.cmd.Process.Pid
+	glog.Infof("Sending SIGTERM to process group %d", pgid)
+	if err := syscall.Kill(-pgid, syscall.SIGTERM); err != nil {
+		glog.Errorf("Failed to send SIGTERM to process group %d: %v", pgid, err)
+	}
+	select {
+	case <-p.exited:
+		return
+	case <-time.After(grace):
+	}
+	glog.Warningf("Process group %d did not exit in %s; sending SIGKILL", pgid, grace)
+	if err := syscall.Kill(-pgid, syscall.SIGKILL); err != nil {
+		glog.Errorf("Failed to send SIGKILL to process group %d: %v", pgid, err)
+	}
+}
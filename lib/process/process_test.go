@@ -0,0 +1,42 @@
+package process
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func terminateAndWait(t *testing.T, p *Process, grace time.Duration) {
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Wait()
+	}()
+	p.Terminate(grace)
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("p.Wait() succeeded; want failure by signal")
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("p.Wait() timed out; want the process to exit")
+	}
+}
+
+func TestTerminate(t *testing.T) {
+	p, err := Start(exec.Command("sleep", "10"))
+	if err != nil {
+		t.Fatalf("Start(exec.Command(%q, %q)) failed with %v; want success", "sleep", "10", err)
+	}
+	terminateAndWait(t, p, time.Second)
+}
+
+func TestTerminateWithKill(t *testing.T) {
+	const script = "trap '' TERM; while :; do sleep 0.01; done"
+	p, err := Start(exec.Command("sh", "-c", script))
+	if err != nil {
+		t.Fatalf("Start(exec.Command(%q, %q, %q)) failed with %v; want success", "sh", "-c", script, err)
+	}
+	// Wait for the shell to install the trap.
+	time.Sleep(100 * time.Millisecond)
+	terminateAndWait(t, p, 100*time.Millisecond)
+}
@@ -0,0 +1,171 @@
+// Package queue serializes deployments per environment.
+package queue
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	// ErrFull is returned when no more jobs can wait for the environment.
+	ErrFull = errors.New("too many deployments are waiting")
+)
+
+// Job is a deployment to be run in a queue.
+type Job struct {
+	// ID identifies the job in the queue.
+	ID string
+	// Start is called when the job leaves the queue to run, before Run. It is optional.
+	// It is called while the queue is locked, so Remove of the job never fails before Start.
+	// It must not call methods of the queue.
+	Start func()
+	// Run runs the deployment.
+	Run func()
+}
+
+// start calls j.Start if any.
+func (j Job) start() {
+	if j.Start != nil {
+		j.Start()
+	}
+}
+
+// Status is a snapshot of a queue of an environment.
+type Status struct {
+	// Running is the ID of the running job. It is empty if the queue is idle.
+	Running string `json:"running,omitempty"`
+	// Waiting is a list of IDs of jobs waiting for the running job, in the order of execution.
+	Waiting []string `json:"waiting"`
+}
+
+// Position returns the position of the job "id" in the queue.
+// The running job is at 0 and the next one is at 1.
+// It returns -1 if there is no such job.
+func (s Status) Position(id string) int {
+	if s.Running == id {
+		return 0
+	}
+	for i, w := range s.Waiting {
+		if w == id {
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// Queue runs jobs one by one per key, typically per "project-env".
+// Jobs with different keys run concurrently.
+type Queue struct {
+	// limit is the maximum number of waiting jobs per key.
+	limit int
+
+	mu   sync.Mutex
+	envs map[string]*Status
+	jobs map[string]Job
+}
+
+// New returns a new Queue.
+// At most "limit" jobs can wait for a running job of the same key.
+// Jobs are rejected while another job of the same key is running if "limit" is 0.
+func New(limit int) *Queue {
+	return &Queue{
+		limit: limit,
+		envs:  make(map[string]*Status),
+		jobs:  make(map[string]Job),
+	}
+}
+
+// Enqueue adds "j" to the queue of "key" and returns the position of "j".
+// "j" starts immediately if no other job of "key" is running.
+// It returns ErrFull if too many jobs are waiting.
+func (q *Queue) Enqueue(key string, j Job) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	st, ok := q.envs[key]
+	if !ok {
+		q.envs[key] = &Status{Running: j.ID}
+		j.start()
+		go q.run(key, j)
+		return 0, nil
+	}
+	if len(st.Waiting) >= q.limit {
+		return 0, ErrFull
+	}
+	st.Waiting = append(st.Waiting, j.ID)
+	q.jobs[j.ID] = j
+	return len(st.Waiting), nil
+}
+
+// EnqueueFirst adds "j" to the head of the queue of "key" regardless of the limit and returns the position of "j".
+// "j" runs next to the running job of "key", or immediately if no job of "key" is running.
+func (q *Queue) EnqueueFirst(key string, j Job) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	st, ok := q.envs[key]
+	if !ok {
+		q.envs[key] = &Status{Running: j.ID}
+		j.start()
+		go q.run(key, j)
+		return 0
+	}
+	st.Waiting = append([]string{j.ID}, st.Waiting...)
+	q.jobs[j.ID] = j
+	return 1
+}
+
+// Status returns the current status of the queue of "key".
+func (q *Queue) Status(key string) Status {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	st, ok := q.envs[key]
+	if !ok {
+		return Status{Waiting: []string{}}
+	}
+	return Status{
+		Running: st.Running,
+		Waiting: append([]string{}, st.Waiting...),
+	}
+}
+
+// Remove removes the waiting job "id" from the queue of "key".
+// It returns false if the job is not waiting, e.g. it is already running.
+func (q *Queue) Remove(key, id string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	st, ok := q.envs[key]
+	if !ok {
+		return false
+	}
+	for i, w := range st.Waiting {
+		if w == id {
+			st.Waiting = append(st.Waiting[:i], st.Waiting[i+1:]...)
+			delete(q.jobs, id)
+			return true
+		}
+	}
+	return false
+}
+
+// run runs "j" and then the following jobs of "key" until the queue becomes empty.
+func (q *Queue) run(key string, j Job) {
+	for {
+		j.Run()
+
+		q.mu.Lock()
+		st := q.envs[key]
+		if len(st.Waiting) == 0 {
+			delete(q.envs, key)
+			q.mu.Unlock()
+			return
+		}
+		id := st.Waiting[0]
+		st.Running, st.Waiting = id, st.Waiting[1:]
+		j = q.jobs[id]
+		delete(q.jobs, id)
+		j.start()
+		q.mu.Unlock()
+	}
+}
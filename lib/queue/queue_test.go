@@ -0,0 +1,179 @@
+package queue
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEnqueueSerializesJobs(t *testing.T) {
+	q := New(5)
+	var (
+		mu     sync.Mutex
+		order  []string
+		active int
+		wg     sync.WaitGroup
+	)
+	release := make(chan struct{})
+	for i := 0; i < 3; i++ {
+		id := fmt.Sprintf("job-%d", i)
+		wg.Add(1)
+		pos, err := q.Enqueue("proj-env", Job{ID: id, Run: func() {
+			defer wg.Done()
+			mu.Lock()
+			active++
+			if active > 1 {
+				t.Errorf("%d jobs are running concurrently; want 1", active)
+			}
+			order = append(order, id)
+			mu.Unlock()
+
+			<-release
+
+			mu.Lock()
+			active--
+			mu.Unlock()
+		}})
+		if err != nil {
+			t.Fatalf("q.Enqueue(%q, %q) failed with %v; want success", "proj-env", id, err)
+		}
+		if got, want := pos, i; got != want {
+			t.Errorf("q.Enqueue(%q, %q) = %d; want %d", "proj-env", id, got, want)
+		}
+	}
+
+	st := q.Status("proj-env")
+	if got, want := st.Position("job-2"), 2; got != want {
+		t.Errorf("st.Position(%q) = %d; want %d", "job-2", got, want)
+	}
+	close(release)
+	wg.Wait()
+
+	if want := []string{"job-0", "job-1", "job-2"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("order = %q; want %q", order, want)
+	}
+}
+
+func TestEnqueueRejectsWhenFull(t *testing.T) {
+	q := New(0)
+	release := make(chan struct{})
+	defer close(release)
+	if _, err := q.Enqueue("proj-env", Job{ID: "running", Run: func() { <-release }}); err != nil {
+		t.Fatalf("q.Enqueue(%q, %q) failed with %v; want success", "proj-env", "running", err)
+	}
+	if _, err := q.Enqueue("proj-env", Job{ID: "rejected", Run: func() {}}); err != ErrFull {
+		t.Errorf("q.Enqueue(%q, %q) failed with %v; want %v", "proj-env", "rejected", err, ErrFull)
+	}
+
+	done := make(chan struct{})
+	if _, err := q.Enqueue("proj-other", Job{ID: "other", Run: func() { close(done) }}); err != nil {
+		t.Fatalf("q.Enqueue(%q, %q) failed with %v; want success", "proj-other", "other", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("job in another environment did not run")
+	}
+}
+
+func TestRemove(t *testing.T) {
+	q := New(5)
+	release := make(chan struct{})
+	defer close(release)
+	if _, err := q.Enqueue("proj-env", Job{ID: "running", Run: func() { <-release }}); err != nil {
+		t.Fatalf("q.Enqueue(%q, %q) failed with %v; want success", "proj-env", "running", err)
+	}
+	for _, id := range []string{"waiting-1", "waiting-2"} {
+		if _, err := q.Enqueue("proj-env", Job{ID: id, Run: func() {}}); err != nil {
+			t.Fatalf("q.Enqueue(%q, %q) failed with %v; want success", "proj-env", id, err)
+		}
+	}
+
+	if q.Remove("proj-env", "running") {
+		t.Errorf("q.Remove(%q, %q) = true; want false", "proj-env", "running")
+	}
+	if !q.Remove("proj-env", "waiting-1") {
+		t.Errorf("q.Remove(%q, %q) = false; want true", "proj-env", "waiting-1")
+	}
+	if got, want := q.Status("proj-env").Waiting, []string{"waiting-2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("q.Status(%q).Waiting = %q; want %q", "proj-env", got, want)
+	}
+}
+
+func TestEnqueueFirst(t *testing.T) {
+	q := New(1)
+	release := make(chan struct{})
+	defer close(release)
+	if _, err := q.Enqueue("proj-env", Job{ID: "running", Run: func() { <-release }}); err != nil {
+		t.Fatalf("q.Enqueue(%q, %q) failed with %v; want success", "proj-env", "running", err)
+	}
+	if _, err := q.Enqueue("proj-env", Job{ID: "waiting", Run: func() {}}); err != nil {
+		t.Fatalf("q.Enqueue(%q, %q) failed with %v; want success", "proj-env", "waiting", err)
+	}
+
+	// The queue is full, but the job is added to its head.
+	if got, want := q.EnqueueFirst("proj-env", Job{ID: "first", Run: func() {}}), 1; got != want {
+		t.Errorf("q.EnqueueFirst(%q, %q) = %d; want %d", "proj-env", "first", got, want)
+	}
+	if got, want := q.Status("proj-env").Waiting, []string{"first", "waiting"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("q.Status(%q).Waiting = %q; want %q", "proj-env", got, want)
+	}
+
+	done := make(chan struct{})
+	if got, want := q.EnqueueFirst("proj-other", Job{ID: "other", Run: func() { close(done) }}), 0; got != want {
+		t.Errorf("q.EnqueueFirst(%q, %q) = %d; want %d", "proj-other", "other", got, want)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("job in an idle queue did not run")
+	}
+}
+
+func TestStart(t *testing.T) {
+	q := New(1)
+	var (
+		mu      sync.Mutex
+		started []string
+	)
+	start := func(id string) func() {
+		return func() {
+			mu.Lock()
+			defer mu.Unlock()
+			started = append(started, id)
+		}
+	}
+	release := make(chan struct{})
+	ran := make(chan string, 2)
+	if _, err := q.Enqueue("proj-env", Job{ID: "running", Start: start("running"), Run: func() { <-release }}); err != nil {
+		t.Fatalf("q.Enqueue(%q, %q) failed with %v; want success", "proj-env", "running", err)
+	}
+	if _, err := q.Enqueue("proj-env", Job{ID: "waiting", Start: start("waiting"), Run: func() {
+		mu.Lock()
+		defer mu.Unlock()
+		ran <- fmt.Sprintf("%q", started)
+	}}); err != nil {
+		t.Fatalf("q.Enqueue(%q, %q) failed with %v; want success", "proj-env", "waiting", err)
+	}
+	mu.Lock()
+	if got, want := started, []string{"running"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("started = %q; want %q", got, want)
+	}
+	mu.Unlock()
+
+	close(release)
+	select {
+	case got := <-ran:
+		// The waiting job has started before it runs.
+		if want := fmt.Sprintf("%q", []string{"running", "waiting"}); got != want {
+			t.Errorf("started = %s in Run; want %s", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("waiting job did not run")
+	}
+	if q.Remove("proj-env", "waiting") {
+		t.Errorf("q.Remove(%q, %q) = true after the job started; want false", "proj-env", "waiting")
+	}
+}
@@ -28,3 +28,6 @@ type Control interface {
 	LatestDeployed(ctx context.Context, hostname string, proj config.Project, env config.Environment) (rev, srcRev Revision, err error)
 	RevisionURL(p config.Project, rev Revision) string
 }
+
+// ControlFactory returns a Control for "proj" which accesses to deploy targets as "deployUser".
+type ControlFactory func(deployUser string, proj config.Project) (Control, error)
@@ -0,0 +1,35 @@
+// Package factory builds revision.Control for projects according to their repository types.
+package factory
+
+import (
+	"fmt"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/gengo/goship/lib/config"
+	githublib "github.com/gengo/goship/lib/github"
+	"github.com/gengo/goship/lib/revision"
+	gcrrev "github.com/gengo/goship/lib/revision/gcr"
+	githubrev "github.com/gengo/goship/lib/revision/github"
+	"github.com/gengo/goship/lib/ssh"
+)
+
+// New returns a new revision.ControlFactory.
+// Deploy targets are accessed over SSH with the private key in "sshKeyPath".
+func New(gcl githublib.Client, dcl *docker.Client, sshKeyPath string) revision.ControlFactory {
+	return func(deployUser string, proj config.Project) (revision.Control, error) {
+		s, err := ssh.WithPrivateKeyFile(deployUser, sshKeyPath)
+		if err != nil {
+			return nil, err
+		}
+
+		c := githubrev.New(gcl, s)
+		switch t := proj.RepoType; t {
+		case config.RepoTypeGithub:
+		case config.RepoTypeDocker:
+			c = gcrrev.New(c, dcl, s)
+		default:
+			return nil, fmt.Errorf("unknown repository type %q", t)
+		}
+		return c, nil
+	}
+}
@@ -0,0 +1,207 @@
+// Package schedule stores deployments scheduled for future times in etcd and runs them when they are due.
+package schedule
+
+import (
+	"encoding/json"
+	"errors"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/gengo/goship/lib/config"
+	"github.com/gengo/goship/lib/history"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// schedulesDir is the etcd directory which stores schedules.
+const schedulesDir = "/goship/schedules"
+
+var (
+	// ErrNotFound is returned when no schedule matches the given ID.
+	ErrNotFound = errors.New("no such schedule")
+)
+
+// Schedule is a deployment scheduled for a future time.
+type Schedule struct {
+	// ID is the unique identifier of the schedule.
+	ID          string `json:"id"`
+	Project     string `json:"project"`
+	Environment string `json:"environment"`
+	// Range is the range of revisions to deploy.
+	// Range.From can be empty. The currently deployed revision is used in that case.
+	Range history.RevRange `json:"range"`
+	// SourceRange is the range of source revisions if the project has a separate source repository.
+	SourceRange *history.RevRange `json:"source_range,omitempty"`
+	// User is the name of the user who scheduled the deployment.
+	// The deployment runs on behalf of the user.
+	User string `json:"user"`
+	// Time is the time when the deployment should start.
+	Time time.Time `json:"time"`
+	// CreatedAt is the time when the deployment was scheduled.
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ByTime sorts schedules in ascending order of Time.
+type ByTime []Schedule
+
+func (s ByTime) Len() int           { return len(s) }
+func (s ByTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s ByTime) Less(i, j int) bool { return s[i].Time.Before(s[j].Time) }
+
+func key(id string) string {
+	return path.Join(schedulesDir, id)
+}
+
+func isEtcdError(err error, code int) bool {
+	switch err := err.(type) {
+	case *etcd.EtcdError:
+		return err.ErrorCode == code
+	case etcd.EtcdError:
+		return err.ErrorCode == code
+	}
+	return false
+}
+
+const (
+	etcdErrKeyNotFound = 100
+	etcdErrTestFailed  = 101
+)
+
+// Add stores "s" and returns its ID.
+func Add(client config.ETCDInterface, s Schedule) (string, error) {
+	if s.ID == "" {
+		s.ID = history.NewID(s.Time)
+	}
+	buf, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+	if _, err := client.Create(key(s.ID), string(buf), 0); err != nil {
+		return "", err
+	}
+	return s.ID, nil
+}
+
+// entry is a schedule and its raw value in etcd.
+type entry struct {
+	Schedule
+	raw string
+}
+
+func list(client config.ETCDInterface) ([]entry, error) {
+	resp, err := client.Get(schedulesDir, false, true)
+	if isEtcdError(err, etcdErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []entry
+	for _, node := range resp.Node.Nodes {
+		var s Schedule
+		if err := json.Unmarshal([]byte(node.Value), &s); err != nil {
+			glog.Errorf("Skipping broken schedule %s: %v", node.Key, err)
+			continue
+		}
+		entries = append(entries, entry{Schedule: s, raw: node.Value})
+	}
+	return entries, nil
+}
+
+// List returns pending schedules in ascending order of Time.
+func List(client config.ETCDInterface) ([]Schedule, error) {
+	entries, err := list(client)
+	if err != nil {
+		return nil, err
+	}
+	schedules := make([]Schedule, 0, len(entries))
+	for _, e := range entries {
+		schedules = append(schedules, e.Schedule)
+	}
+	sort.Sort(ByTime(schedules))
+	return schedules, nil
+}
+
+// Get returns the pending schedule "id".
+func Get(client config.ETCDInterface, id string) (Schedule, error) {
+	s, _, err := get(client, id)
+	return s, err
+}
+
+func get(client config.ETCDInterface, id string) (Schedule, string, error) {
+	resp, err := client.Get(key(id), false, false)
+	if isEtcdError(err, etcdErrKeyNotFound) {
+		return Schedule{}, "", ErrNotFound
+	}
+	if err != nil {
+		return Schedule{}, "", err
+	}
+	var s Schedule
+	if err := json.Unmarshal([]byte(resp.Node.Value), &s); err != nil {
+		return Schedule{}, "", err
+	}
+	return s, resp.Node.Value, nil
+}
+
+// Cancel removes the pending schedule "id".
+func Cancel(client config.ETCDInterface, id string) error {
+	_, raw, err := get(client, id)
+	if err != nil {
+		return err
+	}
+	if !claim(client, id, raw) {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// claim atomically removes the schedule "id" whose value is "raw".
+// It returns false if another process has already removed it.
+func claim(client config.ETCDInterface, id, raw string) bool {
+	_, err := client.CompareAndDelete(key(id), raw, 0)
+	if isEtcdError(err, etcdErrKeyNotFound) || isEtcdError(err, etcdErrTestFailed) {
+		return false
+	}
+	if err != nil {
+		glog.Errorf("Failed to remove schedule %s: %v", id, err)
+		return false
+	}
+	return true
+}
+
+// Run runs due schedules with "fn" until "ctx" is done.
+// It polls etcd every "interval".
+// Each schedule is removed before it runs, so it runs at most once even if multiple processes poll the same etcd.
+func Run(ctx context.Context, client config.ETCDInterface, interval time.Duration, fn func(Schedule)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		runDue(client, time.Now(), fn)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runDue runs schedules which are due at "t" with "fn".
+func runDue(client config.ETCDInterface, t time.Time, fn func(Schedule)) {
+	entries, err := list(client)
+	if err != nil {
+		glog.Errorf("Failed to list schedules: %v", err)
+		return
+	}
+	for _, e := range entries {
+		if e.Time.After(t) {
+			continue
+		}
+		if !claim(client, e.ID, e.raw) {
+			continue
+		}
+		glog.Infof("Running scheduled deployment %s of %s-%s to %s", e.ID, e.Project, e.Environment, e.Range.To)
+		fn(e.Schedule)
+	}
+}
@@ -0,0 +1,144 @@
+package schedule
+
+import (
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/gengo/goship/lib/history"
+)
+
+// fakeEtcdClient is an in-memory emulation of etcd which supports atomic operations.
+type fakeEtcdClient map[string]string
+
+func (cl fakeEtcdClient) Get(key string, sort, recursive bool) (*etcd.Response, error) {
+	if v, ok := cl[key]; ok {
+		return &etcd.Response{Action: "get", Node: &etcd.Node{Key: key, Value: v}}, nil
+	}
+	dir := &etcd.Node{Key: key, Dir: true}
+	for k, v := range cl {
+		if strings.HasPrefix(k, key+"/") {
+			dir.Nodes = append(dir.Nodes, &etcd.Node{Key: k, Value: v})
+		}
+	}
+	if len(dir.Nodes) == 0 {
+		return nil, &etcd.EtcdError{ErrorCode: 100, Message: "Key not found", Cause: key}
+	}
+	return &etcd.Response{Action: "get", Node: dir}, nil
+}
+
+func (cl fakeEtcdClient) Set(key, value string, ttl uint64) (*etcd.Response, error) {
+	cl[key] = value
+	return &etcd.Response{Action: "set", Node: &etcd.Node{Key: key, Value: value}}, nil
+}
+
+func (cl fakeEtcdClient) Create(key, value string, ttl uint64) (*etcd.Response, error) {
+	if _, ok := cl[key]; ok {
+		return nil, &etcd.EtcdError{ErrorCode: 105, Message: "Key already exists", Cause: key}
+	}
+	return cl.Set(key, value, ttl)
+}
+
+func (cl fakeEtcdClient) CompareAndSwap(key, value string, ttl uint64, prevValue string, prevIndex uint64) (*etcd.Response, error) {
+	if v, ok := cl[key]; !ok || v != prevValue {
+		return nil, &etcd.EtcdError{ErrorCode: 101, Message: "Compare failed", Cause: key}
+	}
+	return cl.Set(key, value, ttl)
+}
+
+func (cl fakeEtcdClient) CompareAndDelete(key, prevValue string, prevIndex uint64) (*etcd.Response, error) {
+	v, ok := cl[key]
+	if !ok {
+		return nil, &etcd.EtcdError{ErrorCode: 100, Message: "Key not found", Cause: key}
+	}
+	if v != prevValue {
+		return nil, &etcd.EtcdError{ErrorCode: 101, Message: "Compare failed", Cause: key}
+	}
+	delete(cl, key)
+	return &etcd.Response{Action: "compareAndDelete", Node: &etcd.Node{Key: key}}, nil
+}
+
+func TestAddAndList(t *testing.T) {
+	cl := make(fakeEtcdClient)
+	if got, err := List(cl); err != nil || len(got) != 0 {
+		t.Errorf("List(cl) = %v, %v; want [], <nil>", got, err)
+	}
+
+	now := time.Date(2015, 10, 20, 1, 0, 0, 0, time.UTC)
+	var ids []string
+	for _, d := range []time.Duration{2 * time.Hour, time.Hour} {
+		s := Schedule{
+			Project:     "proj",
+			Environment: "prod",
+			Range:       history.RevRange{To: "abc"},
+			User:        "alice",
+			Time:        now.Add(d),
+			CreatedAt:   now,
+		}
+		id, err := Add(cl, s)
+		if err != nil {
+			t.Fatalf("Add(cl, %#v) failed with %v; want success", s, err)
+		}
+		if _, ok := cl[path.Join(schedulesDir, id)]; !ok {
+			t.Errorf("schedule %s not stored in etcd", id)
+		}
+		ids = append(ids, id)
+	}
+
+	got, err := List(cl)
+	if err != nil {
+		t.Fatalf("List(cl) failed with %v; want success", err)
+	}
+	var gotIDs []string
+	for _, s := range got {
+		gotIDs = append(gotIDs, s.ID)
+	}
+	if want := []string{ids[1], ids[0]}; !reflect.DeepEqual(gotIDs, want) {
+		t.Errorf("IDs of List(cl) = %q; want %q", gotIDs, want)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	cl := make(fakeEtcdClient)
+	id, err := Add(cl, Schedule{Project: "proj", Environment: "prod", Time: time.Now()})
+	if err != nil {
+		t.Fatalf("Add(cl, s) failed with %v; want success", err)
+	}
+	if err := Cancel(cl, id); err != nil {
+		t.Errorf("Cancel(cl, %q) failed with %v; want success", id, err)
+	}
+	if err := Cancel(cl, id); err != ErrNotFound {
+		t.Errorf("Cancel(cl, %q) failed with %v; want %v", id, err, ErrNotFound)
+	}
+	if _, err := Get(cl, id); err != ErrNotFound {
+		t.Errorf("Get(cl, %q) failed with %v; want %v", id, err, ErrNotFound)
+	}
+}
+
+func TestRunDue(t *testing.T) {
+	cl := make(fakeEtcdClient)
+	now := time.Date(2015, 10, 20, 1, 0, 0, 0, time.UTC)
+	due, err := Add(cl, Schedule{Project: "proj", Environment: "prod", Time: now.Add(-time.Minute)})
+	if err != nil {
+		t.Fatalf("Add(cl, s) failed with %v; want success", err)
+	}
+	future, err := Add(cl, Schedule{Project: "proj", Environment: "prod", Time: now.Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("Add(cl, s) failed with %v; want success", err)
+	}
+
+	var ran []string
+	fn := func(s Schedule) { ran = append(ran, s.ID) }
+	runDue(cl, now, fn)
+	// Schedules run only once.
+	runDue(cl, now, fn)
+	if want := []string{due}; !reflect.DeepEqual(ran, want) {
+		t.Errorf("ran = %q; want %q", ran, want)
+	}
+	if _, err := Get(cl, future); err != nil {
+		t.Errorf("Get(cl, %q) failed with %v; want success", future, err)
+	}
+}
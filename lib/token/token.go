@@ -0,0 +1,270 @@
+// Package token manages API tokens of non-browser clients, e.g. CI jobs and chatbots.
+// Tokens are stored hashed in etcd, so secrets are shown only when they are created.
+package token
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/gengo/goship/lib/config"
+	"github.com/golang/glog"
+)
+
+const (
+	// tokensDir is the etcd directory which stores tokens keyed by the hashes of their secrets.
+	tokensDir = "/goship/tokens"
+	// secretPrefix is the prefix of secrets which makes them easy to find in leaked logs.
+	secretPrefix = "goship_"
+
+	etcdErrKeyNotFound = 100
+)
+
+var (
+	// ErrNotFound is returned when no token matches the given ID.
+	ErrNotFound = errors.New("no such token")
+	// ErrInvalid is returned when a secret does not match any valid token.
+	ErrInvalid = errors.New("invalid or expired token")
+)
+
+// Scope is an operation which a token is allowed to do.
+type Scope string
+
+const (
+	// ScopeRead allows reading projects, environments and deployments.
+	ScopeRead = Scope("read")
+	// ScopeDeploy allows starting deployments.
+	ScopeDeploy = Scope("deploy")
+	// ScopeLock allows locking and unlocking environments and commenting on them.
+	ScopeLock = Scope("lock")
+)
+
+// Token is an API token.
+type Token struct {
+	// ID is the public identifier of the token. It is not a secret.
+	ID string `json:"id"`
+	// Name describes what the token is used for.
+	Name string `json:"name"`
+	// User is the name of the user who requests with the token are on behalf of.
+	User string `json:"user"`
+	// Service is true if the token is for a service account rather than a personal token of User.
+	Service bool `json:"service,omitempty"`
+	// Projects are the names of projects which the token is allowed to access.
+	// The token can access all projects if it is empty.
+	Projects []string `json:"projects,omitempty"`
+	// Scopes are the operations which the token is allowed to do.
+	Scopes []Scope `json:"scopes"`
+	// CreatedBy is the name of the user who created the token.
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	// Expiry is the time when the token expires. It is zero if the token does not expire.
+	Expiry time.Time `json:"expiry,omitempty"`
+}
+
+// Validate returns an error if "t" is not a valid token.
+func (t Token) Validate() error {
+	if t.Name == "" {
+		return fmt.Errorf("name of token must be specified")
+	}
+	if t.User == "" {
+		return fmt.Errorf("user of token must be specified")
+	}
+	if len(t.Scopes) == 0 {
+		return fmt.Errorf("scopes of token must be specified")
+	}
+	for _, s := range t.Scopes {
+		switch s {
+		case ScopeRead, ScopeDeploy, ScopeLock:
+		default:
+			return fmt.Errorf("unknown scope %q; must be one of %q, %q and %q", s, ScopeRead, ScopeDeploy, ScopeLock)
+		}
+	}
+	return nil
+}
+
+// Allows returns true if "t" is allowed to do "s" in the project "proj".
+// ScopeDeploy and ScopeLock imply ScopeRead.
+func (t Token) Allows(proj string, s Scope) bool {
+	if len(t.Projects) > 0 {
+		var found bool
+		for _, p := range t.Projects {
+			if p == proj {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for _, ts := range t.Scopes {
+		if ts == s || s == ScopeRead {
+			return true
+		}
+	}
+	return false
+}
+
+// Expired returns true if "t" has expired at "now".
+func (t Token) Expired(now time.Time) bool {
+	return !t.Expiry.IsZero() && !now.Before(t.Expiry)
+}
+
+// ByCreatedAt sorts tokens in ascending order of CreatedAt.
+type ByCreatedAt []Token
+
+func (s ByCreatedAt) Len() int           { return len(s) }
+func (s ByCreatedAt) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s ByCreatedAt) Less(i, j int) bool { return s[i].CreatedAt.Before(s[j].CreatedAt) }
+
+// hash returns the key of the token whose secret is "secret".
+func hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func key(secret string) string {
+	return path.Join(tokensDir, hash(secret))
+}
+
+func isEtcdError(err error, code int) bool {
+	switch err := err.(type) {
+	case *etcd.EtcdError:
+		return err.ErrorCode == code
+	case etcd.EtcdError:
+		return err.ErrorCode == code
+	}
+	return false
+}
+
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		// crypto/rand never fails on supported platforms.
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// Create stores "t" with a new ID and a new secret.
+// It returns the secret and the stored token. The secret cannot be retrieved later.
+func Create(client config.ETCDInterface, t Token) (string, Token, error) {
+	if err := t.Validate(); err != nil {
+		return "", Token{}, err
+	}
+	secret := secretPrefix + randomHex(32)
+	t.ID = randomHex(8)
+	buf, err := json.Marshal(t)
+	if err != nil {
+		return "", Token{}, err
+	}
+	if _, err := client.Create(key(secret), string(buf), 0); err != nil {
+		return "", Token{}, err
+	}
+	return secret, t, nil
+}
+
+// Lookup returns the token whose secret is "secret".
+// It returns ErrInvalid if there is no such token or it has expired at "now".
+func Lookup(client config.ETCDInterface, secret string, now time.Time) (Token, error) {
+	if !strings.HasPrefix(secret, secretPrefix) {
+		return Token{}, ErrInvalid
+	}
+	resp, err := client.Get(key(secret), false, false)
+	if isEtcdError(err, etcdErrKeyNotFound) {
+		return Token{}, ErrInvalid
+	}
+	if err != nil {
+		return Token{}, err
+	}
+	var t Token
+	if err := json.Unmarshal([]byte(resp.Node.Value), &t); err != nil {
+		return Token{}, err
+	}
+	if t.Expired(now) {
+		return Token{}, ErrInvalid
+	}
+	return t, nil
+}
+
+// entry is a token, the etcd key which stores it and its raw value.
+type entry struct {
+	Token
+	key, raw string
+}
+
+func list(client config.ETCDInterface) ([]entry, error) {
+	resp, err := client.Get(tokensDir, false, true)
+	if isEtcdError(err, etcdErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []entry
+	for _, node := range resp.Node.Nodes {
+		var t Token
+		if err := json.Unmarshal([]byte(node.Value), &t); err != nil {
+			glog.Errorf("Skipping broken token %s: %v", node.Key, err)
+			continue
+		}
+		entries = append(entries, entry{Token: t, key: node.Key, raw: node.Value})
+	}
+	return entries, nil
+}
+
+// List returns all tokens in ascending order of CreatedAt.
+func List(client config.ETCDInterface) ([]Token, error) {
+	entries, err := list(client)
+	if err != nil {
+		return nil, err
+	}
+	tokens := make([]Token, 0, len(entries))
+	for _, e := range entries {
+		tokens = append(tokens, e.Token)
+	}
+	sort.Sort(ByCreatedAt(tokens))
+	return tokens, nil
+}
+
+// Get returns the token "id".
+func Get(client config.ETCDInterface, id string) (Token, error) {
+	e, err := get(client, id)
+	return e.Token, err
+}
+
+func get(client config.ETCDInterface, id string) (entry, error) {
+	entries, err := list(client)
+	if err != nil {
+		return entry{}, err
+	}
+	for _, e := range entries {
+		if e.ID == id {
+			return e, nil
+		}
+	}
+	return entry{}, ErrNotFound
+}
+
+// Revoke removes the token "id".
+func Revoke(client config.ETCDInterface, id string) error {
+	e, err := get(client, id)
+	if err != nil {
+		return err
+	}
+	if _, err := client.CompareAndDelete(e.key, e.raw, 0); err != nil {
+		if isEtcdError(err, etcdErrKeyNotFound) {
+			return ErrNotFound
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package token
+
+import (
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
+)
+
+// fakeEtcdClient is an in-memory emulation of etcd which supports atomic operations.
+type fakeEtcdClient map[string]string
+
+func (cl fakeEtcdClient) Get(key string, sort, recursive bool) (*etcd.Response, error) {
+	if v, ok := cl[key]; ok {
+		return &etcd.Response{Action: "get", Node: &etcd.Node{Key: key, Value: v}}, nil
+	}
+	dir := &etcd.Node{Key: key, Dir: true}
+	for k, v := range cl {
+		if strings.HasPrefix(k, key+"/") {
+			dir.Nodes = append(dir.Nodes, &etcd.Node{Key: k, Value: v})
+		}
+	}
+	if len(dir.Nodes) == 0 {
+		return nil, &etcd.EtcdError{ErrorCode: 100, Message: "Key not found", Cause: key}
+	}
+	return &etcd.Response{Action: "get", Node: dir}, nil
+}
+
+func (cl fakeEtcdClient) Set(key, value string, ttl uint64) (*etcd.Response, error) {
+	cl[key] = value
+	return &etcd.Response{Action: "set", Node: &etcd.Node{Key: key, Value: value}}, nil
+}
+
+func (cl fakeEtcdClient) Create(key, value string, ttl uint64) (*etcd.Response, error) {
+	if _, ok := cl[key]; ok {
+		return nil, &etcd.EtcdError{ErrorCode: 105, Message: "Key already exists", Cause: key}
+	}
+	return cl.Set(key, value, ttl)
+}
+
+func (cl fakeEtcdClient) CompareAndSwap(key, value string, ttl uint64, prevValue string, prevIndex uint64) (*etcd.Response, error) {
+	if v, ok := cl[key]; !ok || v != prevValue {
+		return nil, &etcd.EtcdError{ErrorCode: 101, Message: "Compare failed", Cause: key}
+	}
+	return cl.Set(key, value, ttl)
+}
+
+func (cl fakeEtcdClient) CompareAndDelete(key, prevValue string, prevIndex uint64) (*etcd.Response, error) {
+	v, ok := cl[key]
+	if !ok {
+		return nil, &etcd.EtcdError{ErrorCode: 100, Message: "Key not found", Cause: key}
+	}
+	if v != prevValue {
+		return nil, &etcd.EtcdError{ErrorCode: 101, Message: "Compare failed", Cause: key}
+	}
+	delete(cl, key)
+	return &etcd.Response{Action: "compareAndDelete", Node: &etcd.Node{Key: key}}, nil
+}
+
+func TestCreateAndLookup(t *testing.T) {
+	cl := make(fakeEtcdClient)
+	now := time.Date(2015, 10, 20, 1, 0, 0, 0, time.UTC)
+	tok := Token{
+		Name:      "ci",
+		User:      "alice",
+		Scopes:    []Scope{ScopeDeploy},
+		CreatedBy: "alice",
+		CreatedAt: now,
+		Expiry:    now.Add(time.Hour),
+	}
+	secret, created, err := Create(cl, tok)
+	if err != nil {
+		t.Fatalf("Create(cl, %#v) failed with %v; want success", tok, err)
+	}
+	if created.ID == "" {
+		t.Errorf("created.ID is empty; want an ID")
+	}
+	for k, v := range cl {
+		if strings.Contains(k, secret) || strings.Contains(v, secret) {
+			t.Errorf("secret %q is stored in plain text in %s", secret, k)
+		}
+	}
+	if _, ok := cl[path.Join(tokensDir, hash(secret))]; !ok {
+		t.Errorf("token is not stored under its hash")
+	}
+
+	got, err := Lookup(cl, secret, now)
+	if err != nil {
+		t.Fatalf("Lookup(cl, %q, %v) failed with %v; want success", secret, now, err)
+	}
+	if got.ID != created.ID || got.User != "alice" {
+		t.Errorf("Lookup(cl, %q, %v) = %#v; want %#v", secret, now, got, created)
+	}
+	for _, s := range []string{secret + "x", "", strings.TrimPrefix(secret, secretPrefix)} {
+		if _, err := Lookup(cl, s, now); err != ErrInvalid {
+			t.Errorf("Lookup(cl, %q, %v) failed with %v; want %v", s, now, err, ErrInvalid)
+		}
+	}
+	if _, err := Lookup(cl, secret, now.Add(time.Hour)); err != ErrInvalid {
+		t.Errorf("Lookup(cl, %q, expiry) failed with %v; want %v", secret, err, ErrInvalid)
+	}
+}
+
+func TestCreateInvalid(t *testing.T) {
+	cl := make(fakeEtcdClient)
+	for _, tok := range []Token{
+		{User: "alice", Scopes: []Scope{ScopeRead}},
+		{Name: "ci", Scopes: []Scope{ScopeRead}},
+		{Name: "ci", User: "alice"},
+		{Name: "ci", User: "alice", Scopes: []Scope{"admin"}},
+	} {
+		if _, _, err := Create(cl, tok); err == nil {
+			t.Errorf("Create(cl, %#v) succeeded; want failure", tok)
+		}
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	cl := make(fakeEtcdClient)
+	secret, tok, err := Create(cl, Token{Name: "ci", User: "alice", Scopes: []Scope{ScopeRead}})
+	if err != nil {
+		t.Fatalf("Create(cl, tok) failed with %v; want success", err)
+	}
+	if got, err := List(cl); err != nil || len(got) != 1 || got[0].ID != tok.ID {
+		t.Errorf("List(cl) = %v, %v; want [%v], <nil>", got, err, tok)
+	}
+	if err := Revoke(cl, tok.ID); err != nil {
+		t.Errorf("Revoke(cl, %q) failed with %v; want success", tok.ID, err)
+	}
+	if err := Revoke(cl, tok.ID); err != ErrNotFound {
+		t.Errorf("Revoke(cl, %q) failed with %v; want %v", tok.ID, err, ErrNotFound)
+	}
+	if _, err := Lookup(cl, secret, time.Now()); err != ErrInvalid {
+		t.Errorf("Lookup(cl, secret, now) failed with %v; want %v", err, ErrInvalid)
+	}
+}
+
+func TestAllows(t *testing.T) {
+	tok := Token{Projects: []string{"proj1"}, Scopes: []Scope{ScopeDeploy}}
+	for _, spec := range []struct {
+		proj  string
+		scope Scope
+		want  bool
+	}{
+		{proj: "proj1", scope: ScopeDeploy, want: true},
+		{proj: "proj1", scope: ScopeRead, want: true},
+		{proj: "proj1", scope: ScopeLock, want: false},
+		{proj: "proj2", scope: ScopeRead, want: false},
+	} {
+		if got := tok.Allows(spec.proj, spec.scope); got != spec.want {
+			t.Errorf("tok.Allows(%q, %q) = %v; want %v", spec.proj, spec.scope, got, spec.want)
+		}
+	}
+	tok.Projects = nil
+	if !tok.Allows("proj2", ScopeDeploy) {
+		t.Errorf("tok.Allows(%q, %q) = false; want true", "proj2", ScopeDeploy)
+	}
+}
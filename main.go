@@ -7,8 +7,11 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/coreos/go-etcd/etcd"
 	docker "github.com/fsouza/go-dockerclient"
@@ -20,14 +23,17 @@ import (
 	"github.com/gengo/goship/lib/auth"
 	"github.com/gengo/goship/lib/config"
 	githublib "github.com/gengo/goship/lib/github"
+	"github.com/gengo/goship/lib/history"
 	"github.com/gengo/goship/lib/notification"
+	"github.com/gengo/goship/lib/queue"
+	"github.com/gengo/goship/lib/revision/factory"
 	"github.com/gengo/goship/lib/revision/gcr"
+	"github.com/gengo/goship/lib/schedule"
 	helpers "github.com/gengo/goship/lib/view-helpers"
 	_ "github.com/gengo/goship/plugins"
 	"github.com/golang/glog"
 	ghandlers "github.com/gorilla/handlers"
 	"golang.org/x/net/context"
-	"golang.org/x/net/websocket"
 	googleoauth "golang.org/x/oauth2/google"
 )
 
@@ -42,13 +48,21 @@ var (
 	cookieSessionHash = flag.String("c", "COOKIE-SESSION-HASH", "Random cookie session key (default jhjhjhjhjhjjhjhhj)")
 	defaultUser       = flag.String("u", "genericUser", "Default User if non auth (default genericUser)")
 	defaultAvatar     = flag.String("a", "https://camo.githubusercontent.com/33a7d9a138ac73ece82dee977c216eb13dffc984/687474703a2f2f692e696d6775722e636f6d2f524c766b486b612e706e67", "Default Avatar (default goship gopher image)")
-	confirmDeployFlag = flag.Bool("f", true, "Flag to always ask for confirmation before deploying")
+	confirmDeployFlag = flag.Bool("f", true, "Flag to always ask for confirmation of the deploy plan before deploying")
 	requestLog        = flag.String("request-log", "-", "destination of request log. '-' means stdout")
+	historyBackend    = flag.String("history", "bolt", "Backend of deploy history: 'bolt' or 'file' (default bolt)")
+	queueLimit        = flag.Int("queue-limit", 3, "Maximum number of deployments waiting per environment. Extra requests are rejected (default 3)")
+	scheduleInterval  = flag.Duration("schedule-interval", 30*time.Second, "Interval of polling scheduled deployments and expired approval requests (default 30s)")
+	cancelGrace       = flag.Duration("cancel-grace", 10*time.Second, "Grace period before killing a cancelled or timed out deploy command (default 10s)")
+	maxOutputSize     = flag.Int64("max-output-size", 100<<20, "Maximum size of the output of a deployment in bytes unless its project configures one. 0 means unlimited (default 100MiB)")
+	janitorInterval   = flag.Duration("janitor-interval", time.Hour, "Interval of removing and compressing old outputs of deployments (default 1h)")
 )
 
 var validPathWithEnv = regexp.MustCompile("^/(deployLog|commits)/(.*)$")
 
-func extractDeployLogHandler(ac acl.AccessControl, ecl *etcd.Client, fn func(http.ResponseWriter, *http.Request, string, config.Environment, string)) http.HandlerFunc {
+// extractDeployLogHandler extracts a project and an environment from the URL.
+// The URL can also identify an environment by the ID of a deployment into the environment.
+func extractDeployLogHandler(ac acl.AccessControl, ecl *etcd.Client, store history.DeployStore, fn func(http.ResponseWriter, *http.Request, string, config.Environment, config.Project, string)) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		m := validPathWithEnv.FindStringSubmatch(r.URL.Path)
 		if m == nil {
@@ -69,35 +83,33 @@ func extractDeployLogHandler(ac acl.AccessControl, ecl *etcd.Client, fn func(htt
 		}
 		c.Projects = acl.ReadableProjects(ac, c.Projects, u)
 		// get project name and env from url
-		a := strings.Split(m[2], "-")
+		fullEnv := m[2]
+		a := strings.Split(fullEnv, "-")
 		l := len(a)
 		environmentName := a[l-1]
-		var projectName string
+		var projectName, deployID string
 		if m[1] == "commits" {
 			projectName = m[2]
 		} else {
 			projectName = strings.Join(a[0:l-1], "-")
 		}
+		if d, err := store.Get(m[2]); err == nil {
+			projectName, environmentName, deployID = d.Project, d.Environment, d.ID
+			fullEnv = fmt.Sprintf("%s-%s", projectName, environmentName)
+		}
 		e, err := config.EnvironmentFromName(c.Projects, projectName, environmentName)
 		if err != nil {
 			glog.Errorf("Can't get environment from name: %v", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		fn(w, r, m[2], *e, projectName)
-	}
-}
-
-var validPathWithEnvAndTime = regexp.MustCompile("^/(output)/(.*)/(.*)$")
-
-func extractOutputHandler(fn func(http.ResponseWriter, *http.Request, string, string)) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		m := validPathWithEnvAndTime.FindStringSubmatch(r.URL.Path)
-		if m == nil {
-			http.NotFound(w, r)
+		p, err := config.ProjectFromName(c.Projects, projectName)
+		if err != nil {
+			glog.Errorf("Can't get project from name: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		fn(w, r, m[2], m[3])
+		fn(w, r, fullEnv, *e, p, deployID)
 	}
 }
 
@@ -113,7 +125,72 @@ func newGithubClient() (githublib.Client, error) {
 	return githublib.NewClient(gt), nil
 }
 
-func buildHandler(ctx context.Context) (http.Handler, error) {
+// openDeployStore opens the backend of deploy history specified by the command line flags.
+// JSON files written by the old versions of goship are migrated into the store unless the backend is "file".
+func openDeployStore() (history.DeployStore, error) {
+	envs := knownEnvs(etcd.NewClient([]string{*ETCDServer}))
+	switch *historyBackend {
+	case "file":
+		return history.NewFileStore(*dataPath, envs...), nil
+	case "bolt":
+		s, err := history.OpenBolt(filepath.Join(*dataPath, "history.db"))
+		if err != nil {
+			return nil, err
+		}
+		n, err := history.Migrate(*dataPath, s, envs...)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		if n > 0 {
+			glog.Infof("Migrated %d deploy log(s) into %s", n, *historyBackend)
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("unknown history backend %q", *historyBackend)
+}
+
+// knownEnvs returns the environments in the configuration.
+// It returns nil if it fails to load the configuration.
+func knownEnvs(client config.ETCDInterface) []history.Env {
+	c, err := config.Load(client)
+	if err != nil {
+		glog.Errorf("Failed to load configuration to find deploy logs: %v", err)
+		return nil
+	}
+	var envs []history.Env
+	for _, p := range c.Projects {
+		for _, e := range p.Environments {
+			envs = append(envs, history.Env{Project: p.Name, Environment: e.Name})
+		}
+	}
+	return envs
+}
+
+// recoverDeploys marks deployments which were pending or running when Goship stopped as failed at "t".
+// They are no longer in the deploy queue, which lives only in memory.
+// It returns the number of the deployments.
+func recoverDeploys(store history.DeployStore, t time.Time) (int, error) {
+	entries, err := store.Query(history.Query{})
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, e := range entries {
+		if e.State != history.StatePending && e.State != history.StateRunning {
+			continue
+		}
+		e.Reason = history.ReasonInterrupted
+		e.Finish(history.StateFailed, t)
+		if err := store.Update(e); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+func buildHandler(ctx context.Context, store history.DeployStore) (http.Handler, error) {
 	gcl, err := newGithubClient()
 	if err != nil {
 		glog.Errorf("Failed to build github client: %v", err)
@@ -131,7 +208,10 @@ func buildHandler(ctx context.Context) (http.Handler, error) {
 	}
 
 	hub := notification.NewHub(ctx)
+	q := queue.New(*queueLimit)
+	running := newRunningDeploys(*cancelGrace)
 	ecl := etcd.NewClient([]string{*ETCDServer})
+	auth.EnableTokens(ecl)
 	assets := helpers.New(*staticFilePath)
 
 	mux := http.NewServeMux()
@@ -140,22 +220,41 @@ func buildHandler(ctx context.Context) (http.Handler, error) {
 		http.ServeFile(w, r, r.URL.Path[1:])
 	})
 
-	dph, err := deploypage.New(assets, fmt.Sprintf("ws://%s/web_push", *bindAddress))
+	dph, err := deploypage.New(assets, "/events", *confirmDeployFlag)
 	if err != nil {
 		glog.Errorf("Failed to build deploy page handler: %v", err)
 		return nil, err
 	}
 	mux.Handle("/deploy", auth.Authenticate(dph))
-	mux.Handle("/web_push", websocket.Handler(hub.AcceptConnection))
-
-	dlh := DeployLogHandler{assets: assets}
-	mux.Handle("/deployLog/", auth.AuthenticateFunc(extractDeployLogHandler(ac, ecl, dlh.ServeHTTP)))
-	mux.Handle("/output/", auth.AuthenticateFunc(extractOutputHandler(DeployOutputHandler)))
-	mux.Handle("/commits/", auth.Authenticate(commits.New(ac, ecl, gcl, dcl, *keyPath)))
-	mux.Handle("/deploy_handler", auth.Authenticate(DeployHandler{ecl: ecl, hub: hub}))
-	mux.Handle("/lock", auth.Authenticate(lock.NewLock(ecl)))
-	mux.Handle("/unlock", auth.Authenticate(lock.NewUnlock(ecl)))
+
+	dlh := DeployLogHandler{ac: ac, ecl: ecl, assets: assets, store: store}
+	mux.Handle("/deployLog/", auth.AuthenticateFunc(extractDeployLogHandler(ac, ecl, store, dlh.ServeHTTP)))
+	controls := factory.New(gcl, dcl, *keyPath)
+	mux.Handle("/commits/", auth.Authenticate(commits.New(ac, ecl, controls)))
+	awaiting, err := loadAwaitingApprovals(store)
+	if err != nil {
+		glog.Errorf("Failed to load deployments awaiting approval: %v", err)
+		return nil, err
+	}
+	dh := DeployHandler{ac: ac, ecl: ecl, controls: controls, hub: hub, store: store, queue: q, running: running, outputs: newDeployOutputs(), approving: new(sync.Mutex), awaiting: awaiting}
+	mux.Handle("/output/", auth.Authenticate(DeployOutputHandler{dh: dh}))
+	go schedule.Run(ctx, ecl, *scheduleInterval, dh.runSchedule)
+	go runJanitor(ctx, ecl, store, *janitorInterval)
+	go dh.runApprovalExpiry(ctx, *scheduleInterval)
+	mux.Handle("/deploy_handler", auth.Authenticate(dh))
+	mux.Handle("/web_push", PushHandler{dh: dh})
+	mux.Handle("/events", EventsHandler{dh: dh})
+	mux.Handle("/approve", auth.Authenticate(ApproveHandler{dh: dh}))
+	mux.Handle("/promote", auth.Authenticate(PromoteHandler{dh: dh}))
+	mux.Handle("/cancel", auth.Authenticate(CancelHandler{ac: ac, ecl: ecl, hub: hub, store: store, queue: q, running: running, approving: dh.approving}))
+	mux.Handle("/deploy_queue", auth.Authenticate(DeployQueueHandler{ac: ac, ecl: ecl, store: store, queue: q}))
+	mux.Handle("/schedules", auth.Authenticate(ScheduleHandler{ac: ac, ecl: ecl}))
+	mux.Handle("/schedules/cancel", auth.Authenticate(CancelScheduleHandler{ac: ac, ecl: ecl}))
+	mux.Handle("/lock", auth.Authenticate(lock.NewLock(ecl, hub)))
+	mux.Handle("/unlock", auth.Authenticate(lock.NewUnlock(ecl, hub)))
 	mux.Handle("/comment", auth.Authenticate(comment.New(ecl)))
+	mux.Handle(apiPrefix, APIHandler{dh: dh})
+	mux.Handle("/tokens", auth.Authenticate(TokensHandler{ecl: ecl, assets: assets}))
 	mux.HandleFunc("/auth/github/login", auth.LoginHandler)
 	mux.HandleFunc("/auth/github/callback", auth.CallbackHandler)
 
@@ -195,7 +294,18 @@ func main() {
 		glog.Fatal("could not create data dir: %v", err)
 	}
 
-	h, err := buildHandler(ctx)
+	store, err := openDeployStore()
+	if err != nil {
+		glog.Fatalf("Failed to open deploy history: %v", err)
+	}
+	defer store.Close()
+	if n, err := recoverDeploys(store, time.Now()); err != nil {
+		glog.Errorf("Failed to recover interrupted deployments: %v", err)
+	} else if n > 0 {
+		glog.Warningf("Marked %d deployment(s) interrupted by the restart as failed", n)
+	}
+
+	h, err := buildHandler(ctx, store)
 	if err != nil {
 		glog.Fatal(err)
 	}
@@ -1,8 +1,30 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/gengo/goship/lib/acl"
+	"github.com/gengo/goship/lib/config"
+	"github.com/gengo/goship/lib/freeze"
+	"github.com/gengo/goship/lib/history"
+	"github.com/gengo/goship/lib/notification"
+	"github.com/gengo/goship/lib/output"
+	"github.com/gengo/goship/lib/queue"
+	"github.com/gengo/goship/lib/revision"
+	"github.com/gengo/goship/lib/schedule"
+	"golang.org/x/net/context"
+	"golang.org/x/net/websocket"
 )
 
 func TestStripANSICodes(t *testing.T) {
@@ -46,3 +68,1081 @@ func TestFormatTime(t *testing.T) {
 		}
 	}
 }
+
+func TestDeployCommand(t *testing.T) {
+	entry := history.Entry{
+		Project:     "proj",
+		Environment: "prod",
+		Range:       history.RevRange{From: "abc", To: "def"},
+		User:        "alice",
+	}
+	for _, spec := range []struct {
+		env  config.Environment
+		want []string
+	}{
+		{
+			env:  config.Environment{Deploy: `/tmp/deploy -p={{.Project}} -e={{.Env}}  -m "from {{.FromRevision}}"`},
+			want: []string{"/tmp/deploy", "-p=proj", "-e=prod", "-m", "from abc"},
+		},
+		{
+			env: config.Environment{
+				Deploy:     "ignored",
+				DeployArgs: []string{"/tmp/deploy", "--to={{.ToRevision}}", "--hosts={{.Hosts}}", "by {{.User}}"},
+				Hosts:      []string{"host1", "host2"},
+			},
+			want: []string{"/tmp/deploy", "--to=def", "--hosts=host1,host2", "by alice"},
+		},
+	} {
+		got, err := deployCommand(spec.env, entry)
+		if err != nil {
+			t.Errorf("deployCommand(%#v, entry) failed with %v; want success", spec.env, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, spec.want) {
+			t.Errorf("deployCommand(%#v, entry) = %q; want %q", spec.env, got, spec.want)
+		}
+	}
+
+	if got, err := deployCommand(config.Environment{}, entry); err == nil {
+		t.Errorf("deployCommand(%#v, entry) = %q; want failure", config.Environment{}, got)
+	}
+}
+
+func TestDeployEnv(t *testing.T) {
+	env := config.Environment{
+		Hosts: []string{"host1", "host2"},
+		Env:   map[string]string{"RAILS_ENV": "production", "DEBUG": "1"},
+	}
+	entry := history.Entry{
+		ID:          "20150101T000000.000000000Z-0123abcd",
+		Project:     "proj",
+		Environment: "prod",
+		Range:       history.RevRange{From: "abc", To: "def"},
+		SourceRange: &history.RevRange{From: "123", To: "456"},
+		User:        "alice",
+	}
+	got := deployEnv(env, entry)
+	want := []string{
+		"DEBUG=1",
+		"RAILS_ENV=production",
+		"GOSHIP_DEPLOY_ID=20150101T000000.000000000Z-0123abcd",
+		"GOSHIP_PROJECT=proj",
+		"GOSHIP_ENV=prod",
+		"GOSHIP_FROM_REVISION=abc",
+		"GOSHIP_TO_REVISION=def",
+		"GOSHIP_FROM_SOURCE_REVISION=123",
+		"GOSHIP_TO_SOURCE_REVISION=456",
+		"GOSHIP_USER=alice",
+		"GOSHIP_HOSTS=host1,host2",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("deployEnv(%#v, %#v) = %q; want %q", env, entry, got, want)
+	}
+}
+
+func TestCurrentDeploy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goship-test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(%q, %q) failed with %v; want success", "", "goship-test", err)
+	}
+	defer os.RemoveAll(dir)
+	store := history.NewFileStore(dir)
+
+	if _, err := currentDeploy(store, "proj", "prod"); err != history.ErrNotFound {
+		t.Errorf("currentDeploy(store, %q, %q) failed with %v; want %v", "proj", "prod", err, history.ErrNotFound)
+	}
+
+	now := time.Now()
+	for i, state := range []history.State{history.StateSucceeded, history.StateSucceeded, history.StateFailed} {
+		e := history.Entry{
+			ID:          fmt.Sprintf("deploy-%d", i),
+			Project:     "proj",
+			Environment: "prod",
+			State:       state,
+			Time:        now.Add(time.Duration(i) * time.Minute),
+		}
+		if _, err := store.Append(e); err != nil {
+			t.Fatalf("store.Append(%#v) failed with %v; want success", e, err)
+		}
+	}
+	got, err := currentDeploy(store, "proj", "prod")
+	if err != nil {
+		t.Fatalf("currentDeploy(store, %q, %q) failed with %v; want success", "proj", "prod", err)
+	}
+	if got, want := got.ID, "deploy-1"; got != want {
+		t.Errorf("currentDeploy(store, %q, %q).ID = %q; want %q", "proj", "prod", got, want)
+	}
+}
+
+// deployersACL allows only "deployers" to deploy.
+type deployersACL []string
+
+func (a deployersACL) Readable(owner, repo, user string) bool { return true }
+
+func (a deployersACL) Deployable(owner, repo, user string) bool {
+	for _, d := range a {
+		if d == user {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRecoverDeploys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goship-test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(%q, %q) failed with %v; want success", "", "goship-test", err)
+	}
+	defer os.RemoveAll(dir)
+	store := history.NewFileStore(dir)
+
+	now := time.Now()
+	states := map[string]history.State{
+		"deploy-0": history.StateSucceeded,
+		"deploy-1": history.StateAwaitingApproval,
+		"deploy-2": history.StateRunning,
+		"deploy-3": history.StatePending,
+	}
+	for id, state := range states {
+		e := history.Entry{ID: id, Project: "proj", Environment: "prod", State: state, Time: now}
+		if _, err := store.Append(e); err != nil {
+			t.Fatalf("store.Append(%#v) failed with %v; want success", e, err)
+		}
+	}
+
+	if n, err := recoverDeploys(store, now); err != nil || n != 2 {
+		t.Errorf("recoverDeploys(store, %v) = %d, %v; want 2, nil", now, n, err)
+	}
+	for id, want := range map[string]history.State{
+		"deploy-0": history.StateSucceeded,
+		"deploy-1": history.StateAwaitingApproval,
+		"deploy-2": history.StateFailed,
+		"deploy-3": history.StateFailed,
+	} {
+		e, err := store.Get(id)
+		if err != nil {
+			t.Errorf("store.Get(%q) failed with %v; want success", id, err)
+			continue
+		}
+		if e.State != want {
+			t.Errorf("state of %s = %q; want %q", id, e.State, want)
+		}
+		if e.State != states[id] && (e.Reason != history.ReasonInterrupted || e.EndTime.IsZero()) {
+			t.Errorf("%s = %#v; want reason %q and end time", id, e, history.ReasonInterrupted)
+		}
+	}
+}
+
+func TestRecordRejectedSchedule(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goship-test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(%q, %q) failed with %v; want success", "", "goship-test", err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(orig string) { *dataPath = orig }(*dataPath)
+	*dataPath = dir
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := DeployHandler{
+		hub:     notification.NewHub(ctx),
+		store:   history.NewFileStore(dir),
+		outputs: newDeployOutputs(),
+	}
+	s := schedule.Schedule{ID: "schedule-1", Project: "proj", Environment: "prod", User: "alice"}
+	deploy := history.RevRange{From: "abc", To: "def"}
+	now := time.Now()
+	for _, spec := range []struct {
+		cause error
+		want  history.State
+	}{
+		{cause: requestError{statusLocked, "environment is locked"}, want: history.StateCancelled},
+		{cause: fmt.Errorf("etcd is down"), want: history.StateFailed},
+	} {
+		e, err := h.recordRejectedSchedule(s, deploy, spec.cause, now)
+		if err != nil {
+			t.Errorf("h.recordRejectedSchedule(%#v, %#v, %v, %v) failed with %v; want success", s, deploy, spec.cause, now, err)
+			continue
+		}
+		got, err := h.store.Get(e.ID)
+		if err != nil {
+			t.Errorf("h.store.Get(%q) failed with %v; want success", e.ID, err)
+			continue
+		}
+		if got.State != spec.want || got.Reason != history.ReasonScheduleRejected || got.ScheduleID != s.ID || got.Range != deploy || got.User != s.User {
+			t.Errorf("h.store.Get(%q) = %#v; want %q with reason %q by %s of %s", e.ID, got, spec.want, history.ReasonScheduleRejected, s.User, s.ID)
+		}
+		buf, err := readDeployOutput(got)
+		if err != nil {
+			t.Errorf("readDeployOutput(%#v) failed with %v; want success", got, err)
+			continue
+		}
+		if !strings.Contains(string(buf), spec.cause.Error()) {
+			t.Errorf("readDeployOutput(%#v) = %q; want %q in it", got, buf, spec.cause.Error())
+		}
+	}
+}
+
+func TestCheckDeployable(t *testing.T) {
+	var (
+		ac       = acl.AccessControl(deployersACL{"alice", "admin"})
+		c        = config.Config{Admins: []string{"admin"}}
+		proj     = config.Project{Name: "proj"}
+		unlocked = config.Environment{Name: "prod"}
+		locked   = config.Environment{Name: "prod", IsLocked: true}
+		frozen   = config.Environment{
+			Name:    "prod",
+			Freezes: []freeze.Window{{Name: "new year", Start: "2015-01-01 00:00", End: "2015-01-02 00:00"}},
+		}
+		now = time.Date(2015, 1, 1, 12, 0, 0, 0, time.UTC)
+	)
+	for _, spec := range []struct {
+		env   config.Environment
+		user  string
+		force bool
+		want  int
+	}{
+		{env: unlocked, user: "alice", want: http.StatusOK},
+		{env: unlocked, user: "bob", want: http.StatusForbidden},
+		{env: locked, user: "alice", want: statusLocked},
+		{env: locked, user: "alice", force: true, want: http.StatusForbidden},
+		{env: locked, user: "admin", want: statusLocked},
+		{env: locked, user: "admin", force: true, want: http.StatusOK},
+		{env: frozen, user: "alice", want: statusLocked},
+		{env: frozen, user: "admin", want: http.StatusOK},
+	} {
+		got, err := checkDeployable(ac, c, proj, spec.env, spec.user, spec.force, now)
+		if got != spec.want {
+			t.Errorf("checkDeployable(ac, c, proj, %#v, %q, %v) = %d, %v; want %d", spec.env, spec.user, spec.force, got, err, spec.want)
+		}
+		if (err == nil) != (spec.want == http.StatusOK) {
+			t.Errorf("checkDeployable(ac, c, proj, %#v, %q, %v) failed with %v", spec.env, spec.user, spec.force, err)
+		}
+	}
+}
+
+func TestExpireApproval(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goship-test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(%q, %q) failed with %v; want success", "", "goship-test", err)
+	}
+	defer os.RemoveAll(dir)
+	store := history.NewFileStore(dir)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hub := notification.NewHub(ctx)
+
+	now := time.Now()
+	e := history.Entry{
+		ID:          "deploy-1",
+		Project:     "proj",
+		Environment: "prod",
+		State:       history.StateAwaitingApproval,
+		Time:        now,
+		Approval:    &history.Approval{Expiry: now.Add(time.Hour)},
+	}
+	if _, err := store.Append(e); err != nil {
+		t.Fatalf("store.Append(%#v) failed with %v; want success", e, err)
+	}
+
+	if expired, err := expireApproval(store, hub, &e, now.Add(time.Minute)); err != nil || expired {
+		t.Errorf("expireApproval(store, hub, &e, %v) = %v, %v; want false, <nil>", now.Add(time.Minute), expired, err)
+	}
+	if expired, err := expireApproval(store, hub, &e, now.Add(2*time.Hour)); err != nil || !expired {
+		t.Errorf("expireApproval(store, hub, &e, %v) = %v, %v; want true, <nil>", now.Add(2*time.Hour), expired, err)
+	}
+	got, err := store.Get(e.ID)
+	if err != nil {
+		t.Fatalf("store.Get(%q) failed with %v; want success", e.ID, err)
+	}
+	if got.State != history.StateCancelled || got.Reason != history.ReasonApprovalExpired {
+		t.Errorf("got.State, got.Reason = %q, %q; want %q, %q", got.State, got.Reason, history.StateCancelled, history.ReasonApprovalExpired)
+	}
+
+	// Requests which nobody approves are also expired.
+	pending := history.Entry{
+		ID:          "deploy-2",
+		Project:     "proj",
+		Environment: "staging",
+		State:       history.StateAwaitingApproval,
+		Time:        now,
+		Approval:    &history.Approval{Expiry: now.Add(time.Hour)},
+	}
+	if _, err := store.Append(pending); err != nil {
+		t.Fatalf("store.Append(%#v) failed with %v; want success", pending, err)
+	}
+	awaiting, err := loadAwaitingApprovals(store)
+	if err != nil {
+		t.Fatalf("loadAwaitingApprovals(store) failed with %v; want success", err)
+	}
+	if got, want := awaiting.list(), []string{pending.ID}; !reflect.DeepEqual(got, want) {
+		t.Errorf("awaiting.list() = %q; want %q", got, want)
+	}
+	h := DeployHandler{hub: hub, store: store, approving: new(sync.Mutex), awaiting: awaiting}
+	if expired, err := h.expireApprovals(now.Add(time.Minute)); err != nil || len(expired) != 0 {
+		t.Errorf("h.expireApprovals(%v) = %#v, %v; want no entries", now.Add(time.Minute), expired, err)
+	}
+	expired, err := h.expireApprovals(now.Add(2 * time.Hour))
+	if err != nil || len(expired) != 1 || expired[0].ID != pending.ID {
+		t.Errorf("h.expireApprovals(%v) = %#v, %v; want %s", now.Add(2*time.Hour), expired, err, pending.ID)
+	}
+	if got, err := store.Get(pending.ID); err != nil || got.State != history.StateCancelled {
+		t.Errorf("store.Get(%q) = %#v, %v; want %q", pending.ID, got, err, history.StateCancelled)
+	}
+	if got := awaiting.list(); len(got) != 0 {
+		t.Errorf("awaiting.list() = %q after expiry; want none", got)
+	}
+}
+
+func TestCancelApproval(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goship-test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(%q, %q) failed with %v; want success", "", "goship-test", err)
+	}
+	defer os.RemoveAll(dir)
+	h := CancelHandler{store: history.NewFileStore(dir), approving: new(sync.Mutex)}
+
+	now := time.Now()
+	for _, spec := range []struct {
+		stored history.State
+		want   bool
+	}{
+		{stored: history.StateAwaitingApproval, want: true},
+		// The deployment has been approved after the handler read it.
+		{stored: history.StatePending, want: false},
+	} {
+		e := history.Entry{ID: "deploy-" + string(spec.stored), Project: "proj", Environment: "prod", State: spec.stored, Time: now}
+		if _, err := h.store.Append(e); err != nil {
+			t.Fatalf("h.store.Append(%#v) failed with %v; want success", e, err)
+		}
+		read := e
+		read.State = history.StateAwaitingApproval
+		ok, err := h.cancelApproval(&read, "bob", now)
+		if err != nil || ok != spec.want {
+			t.Errorf("h.cancelApproval(%#v, %q, %v) = %v, %v; want %v, nil", e, "bob", now, ok, err, spec.want)
+		}
+		got, err := h.store.Get(e.ID)
+		if err != nil {
+			t.Fatalf("h.store.Get(%q) failed with %v; want success", e.ID, err)
+		}
+		want := spec.stored
+		if spec.want {
+			want = history.StateCancelled
+		}
+		if got.State != want || (spec.want && got.CancelledBy != "bob") {
+			t.Errorf("h.store.Get(%q) = %#v; want %q", e.ID, got, want)
+		}
+	}
+}
+
+func TestCheckSoak(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goship-test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(%q, %q) failed with %v; want success", "", "goship-test", err)
+	}
+	defer os.RemoveAll(dir)
+	store := history.NewFileStore(dir)
+
+	if err := checkSoak(store, "proj", "staging", "abc", time.Hour, time.Now()); err == nil {
+		t.Errorf("checkSoak succeeded without deployments; want failure")
+	}
+
+	now := time.Now()
+	for _, e := range []history.Entry{
+		{
+			ID:      "deploy-1",
+			Range:   history.RevRange{From: "abc", To: "def"},
+			State:   history.StateSucceeded,
+			Time:    now.Add(-3 * time.Hour),
+			EndTime: now.Add(-3 * time.Hour),
+		},
+		{
+			ID:    "deploy-2",
+			Range: history.RevRange{From: "def", To: "ghi"},
+			State: history.StateRunning,
+			Time:  now.Add(-time.Minute),
+		},
+	} {
+		e.Project, e.Environment = "proj", "staging"
+		if _, err := store.Append(e); err != nil {
+			t.Fatalf("store.Append(%#v) failed with %v; want success", e, err)
+		}
+	}
+	for _, spec := range []struct {
+		rev  revision.Revision
+		soak time.Duration
+		ok   bool
+	}{
+		{rev: "def", soak: 2 * time.Hour, ok: true},
+		{rev: "def", soak: 4 * time.Hour, ok: false},
+		{rev: "ghi", soak: time.Minute, ok: false},
+	} {
+		err := checkSoak(store, "proj", "staging", spec.rev, spec.soak, now)
+		if spec.ok && err != nil {
+			t.Errorf("checkSoak(store, %q, %q, %q, %v, now) failed with %v; want success", "proj", "staging", spec.rev, spec.soak, err)
+		}
+		if !spec.ok && err == nil {
+			t.Errorf("checkSoak(store, %q, %q, %q, %v, now) succeeded; want failure", "proj", "staging", spec.rev, spec.soak)
+		}
+	}
+}
+
+// hostsControl is a revision.Control which reports revisions running in hosts.
+type hostsControl struct {
+	revision.Control
+	revs map[string]revision.Revision
+}
+
+func (c hostsControl) LatestDeployed(ctx context.Context, hostname string, proj config.Project, env config.Environment) (rev, srcRev revision.Revision, err error) {
+	return c.revs[hostname], "src-" + c.revs[hostname], nil
+}
+
+func TestStageRevision(t *testing.T) {
+	ctrl := hostsControl{revs: map[string]revision.Revision{
+		"host1": "abc",
+		"host2": "abc",
+		"host3": "def",
+	}}
+	proj := config.Project{Name: "proj"}
+	env := config.Environment{Name: "staging", Hosts: []string{"host1", "host2"}}
+	rev, srcRev, err := stageRevision(context.Background(), ctrl, proj, env)
+	if err != nil {
+		t.Fatalf("stageRevision(ctx, ctrl, %#v, %#v) failed with %v; want success", proj, env, err)
+	}
+	if rev != "abc" || srcRev != "src-abc" {
+		t.Errorf("stageRevision(ctx, ctrl, %#v, %#v) = %q, %q; want %q, %q", proj, env, rev, srcRev, "abc", "src-abc")
+	}
+
+	env.Hosts = append(env.Hosts, "host3")
+	if _, _, err := stageRevision(context.Background(), ctrl, proj, env); err == nil {
+		t.Errorf("stageRevision(ctx, ctrl, %#v, %#v) succeeded; want failure", proj, env)
+	}
+}
+
+func TestRollout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goship-test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(%q, %q) failed with %v; want success", "", "goship-test", err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(orig string) { *dataPath = orig }(*dataPath)
+	*dataPath = dir
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := DeployHandler{
+		hub:     notification.NewHub(ctx),
+		store:   history.NewFileStore(dir),
+		running: newRunningDeploys(time.Second),
+		outputs: newDeployOutputs(),
+	}
+	for i, spec := range []struct {
+		rollout    config.Rollout
+		wantState  history.State
+		wantReason string
+		wantHosts  []history.State
+	}{
+		{
+			rollout:   config.Rollout{BatchSize: 2, Verify: "true"},
+			wantState: history.StateSucceeded,
+			wantHosts: []history.State{history.StateSucceeded, history.StateSucceeded, history.StateSucceeded, history.StateSucceeded},
+		},
+		{
+			rollout:    config.Rollout{BatchSize: 1},
+			wantState:  history.StateFailed,
+			wantReason: history.ReasonBatchFailed,
+			wantHosts:  []history.State{history.StateSucceeded, history.StateSucceeded, history.StateFailed, history.StatePending},
+		},
+		{
+			rollout:    config.Rollout{BatchSize: 2, Verify: "false"},
+			wantState:  history.StateFailed,
+			wantReason: history.ReasonVerificationFailed,
+			wantHosts:  []history.State{history.StateFailed, history.StateFailed, history.StatePending, history.StatePending},
+		},
+	} {
+		env := config.Environment{
+			Name:       "prod",
+			DeployArgs: []string{"sh", "-c", `test "$GOSHIP_HOSTS" != host3`},
+			Hosts:      []string{"host1", "host2", "host3", "host4"},
+			Rollout:    &spec.rollout,
+		}
+		if spec.wantState == history.StateSucceeded {
+			env.DeployArgs = []string{"true"}
+		}
+		entry := history.Entry{
+			ID:          fmt.Sprintf("deploy-%d", i),
+			Project:     "proj",
+			Environment: "prod",
+			State:       history.StateRunning,
+		}
+		if _, err := h.store.Append(entry); err != nil {
+			t.Fatalf("h.store.Append(%#v) failed with %v; want success", entry, err)
+		}
+		h.running.add(entry.ID)
+		state, err := h.run(context.Background(), &entry, env)
+		h.running.remove(entry.ID)
+		if err != nil {
+			t.Errorf("h.run(ctx, &entry, %#v) failed with %v; want success", env, err)
+		}
+		if state != spec.wantState || entry.Reason != spec.wantReason {
+			t.Errorf("h.run(ctx, &entry, %#v) = %q with reason %q; want %q with reason %q", env, state, entry.Reason, spec.wantState, spec.wantReason)
+		}
+		var got []history.State
+		for _, st := range entry.Hosts {
+			got = append(got, st.State)
+		}
+		if !reflect.DeepEqual(got, spec.wantHosts) {
+			t.Errorf("states of hosts = %q; want %q with rollout %#v", got, spec.wantHosts, spec.rollout)
+		}
+	}
+
+	// A rollout without hosts must not succeed without running the command.
+	env := config.Environment{Name: "prod", DeployArgs: []string{"true"}, Rollout: &config.Rollout{BatchSize: 1}}
+	entry := history.Entry{ID: "deploy-no-hosts", Project: "proj", Environment: "prod", State: history.StateRunning}
+	if state, err := h.run(context.Background(), &entry, env); state != history.StateFailed || err == nil {
+		t.Errorf("h.run(ctx, &entry, %#v) = %q, %v; want %q with an error", env, state, err, history.StateFailed)
+	}
+}
+
+func TestCheckHealth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goship-test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(%q, %q) failed with %v; want success", "", "goship-test", err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(orig string) { *dataPath = orig }(*dataPath)
+	*dataPath = dir
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthy" {
+			http.NotFound(w, r)
+		}
+	}))
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := DeployHandler{hub: notification.NewHub(ctx), outputs: newDeployOutputs()}
+	entry := history.Entry{ID: "deploy-1", Project: "proj", Environment: "prod"}
+	for _, spec := range []struct {
+		path string
+		want bool
+	}{
+		{path: "/healthy", want: true},
+		{path: "/unhealthy", want: false},
+	} {
+		env := config.Environment{
+			Hosts:       []string{"host1"},
+			HealthCheck: &config.HealthCheck{URL: s.URL + spec.path, Timeout: config.Duration(50 * time.Millisecond), Interval: config.Duration(10 * time.Millisecond)},
+		}
+		if got := h.checkHealth(context.Background(), config.Config{}, env, entry); got.Passed != spec.want {
+			t.Errorf("h.checkHealth(ctx, c, env, entry) = %#v; want Passed = %v with %s", got, spec.want, spec.path)
+		}
+	}
+}
+
+func TestCancelHealthCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goship-test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(%q, %q) failed with %v; want success", "", "goship-test", err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(orig string) { *dataPath = orig }(*dataPath)
+	*dataPath = dir
+
+	checking := make(chan struct{})
+	var once sync.Once
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		once.Do(func() { close(checking) })
+		http.NotFound(w, r)
+	}))
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := DeployHandler{
+		hub:     notification.NewHub(ctx),
+		store:   history.NewFileStore(dir),
+		running: newRunningDeploys(time.Second),
+		outputs: newDeployOutputs(),
+	}
+	proj := config.Project{Name: "proj"}
+	env := config.Environment{
+		Name:        "prod",
+		Hosts:       []string{"host1"},
+		DeployArgs:  []string{"true"},
+		HealthCheck: &config.HealthCheck{URL: s.URL, Timeout: config.Duration(time.Minute), Interval: config.Duration(10 * time.Millisecond), Rollback: true},
+	}
+	entry := history.Entry{ID: "deploy-1", Project: "proj", Environment: "prod", State: history.StatePending}
+	if _, err := h.store.Append(entry); err != nil {
+		t.Fatalf("h.store.Append(%#v) failed with %v; want success", entry, err)
+	}
+
+	h.running.add(entry.ID)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.deploy(context.Background(), config.Config{Pivotal: &config.PivotalConfiguration{}}, proj, env, entry)
+	}()
+	select {
+	case <-checking:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("health check did not start")
+	}
+	if !h.running.cancel(entry.ID, "bob") {
+		t.Errorf("h.running.cancel(%q, %q) = false during the health check; want true", entry.ID, "bob")
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("deployment did not finish after cancelled")
+	}
+
+	got, err := h.store.Get(entry.ID)
+	if err != nil {
+		t.Fatalf("h.store.Get(%q) failed with %v; want success", entry.ID, err)
+	}
+	if got.State != history.StateCancelled || got.CancelledBy != "bob" || got.RolledBackBy != "" || got.RollbackError != "" {
+		t.Errorf("h.store.Get(%q) = %#v; want cancelled by bob without rollback", entry.ID, got)
+	}
+}
+
+func TestAutoRollback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goship-test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(%q, %q) failed with %v; want success", "", "goship-test", err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(orig string) { *dataPath = orig }(*dataPath)
+	*dataPath = dir
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := DeployHandler{
+		controls: func(string, config.Project) (revision.Control, error) { return urlControl{}, nil },
+		hub:      notification.NewHub(ctx),
+		store:    history.NewFileStore(dir),
+		queue:    queue.New(0),
+		running:  newRunningDeploys(time.Second),
+		outputs:  newDeployOutputs(),
+	}
+	proj := config.Project{Name: "proj"}
+	// Neither approvals nor the full queue block the rollback.
+	env := config.Environment{Name: "prod", DeployArgs: []string{"true"}, RequiresApproval: true}
+
+	prev := history.Entry{ID: "deploy-0", Project: "proj", Environment: "prod", State: history.StateSucceeded, Range: history.RevRange{To: "rev0"}}
+	failed := history.Entry{ID: "deploy-1", Project: "proj", Environment: "prod", State: history.StateRunning, Range: history.RevRange{From: "rev0", To: "rev1"}}
+	for _, e := range []history.Entry{prev, failed} {
+		if _, err := h.store.Append(e); err != nil {
+			t.Fatalf("h.store.Append(%#v) failed with %v; want success", e, err)
+		}
+	}
+	// The failed deployment is still running in the queue.
+	if _, err := h.queue.Enqueue(queueKey("proj", "prod"), queue.Job{ID: failed.ID, Run: func() { select {} }}); err != nil {
+		t.Fatalf("h.queue.Enqueue failed with %v; want success", err)
+	}
+
+	h.autoRollback(config.Config{}, proj, env, &failed)
+	if failed.RolledBackBy == "" || failed.RollbackError != "" {
+		t.Fatalf("h.autoRollback did not start a rollback: RolledBackBy = %q, RollbackError = %q", failed.RolledBackBy, failed.RollbackError)
+	}
+	if got, want := h.queue.Status(queueKey("proj", "prod")).Waiting, []string{failed.RolledBackBy}; !reflect.DeepEqual(got, want) {
+		t.Errorf("waiting deployments = %q; want %q", got, want)
+	}
+	rb, err := h.store.Get(failed.RolledBackBy)
+	if err != nil {
+		t.Fatalf("h.store.Get(%q) failed with %v; want success", failed.RolledBackBy, err)
+	}
+	if rb.State != history.StatePending || rb.RollbackOf != prev.ID || rb.Range.To != prev.Range.To {
+		t.Errorf("rollback = %#v; want a pending rollback of %s to %s", rb, prev.ID, prev.Range.To)
+	}
+
+	// The failure to start a rollback is recorded.
+	other := history.Entry{ID: "deploy-2", Project: "proj", Environment: "staging", State: history.StateRunning}
+	h.autoRollback(config.Config{}, proj, config.Environment{Name: "staging"}, &other)
+	if other.RolledBackBy != "" || other.RollbackError == "" {
+		t.Errorf("h.autoRollback without previous deployments: RolledBackBy = %q, RollbackError = %q; want an error", other.RolledBackBy, other.RollbackError)
+	}
+}
+
+func TestRunHooks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goship-test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(%q, %q) failed with %v; want success", "", "goship-test", err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(orig string) { *dataPath = orig }(*dataPath)
+	*dataPath = dir
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := DeployHandler{
+		hub:     notification.NewHub(ctx),
+		running: newRunningDeploys(time.Second),
+		outputs: newDeployOutputs(),
+	}
+	marker := filepath.Join(dir, "deployed")
+	for i, spec := range []struct {
+		pre, post    []config.Hook
+		wantState    history.State
+		wantReason   string
+		wantWarnings int
+		wantDeployed bool
+	}{
+		{
+			pre:          []config.Hook{{Command: "false", OnFailure: config.HookIgnore}, {Command: "false", OnFailure: config.HookWarn}},
+			post:         []config.Hook{{Command: "true"}},
+			wantState:    history.StateSucceeded,
+			wantWarnings: 1,
+			wantDeployed: true,
+		},
+		{
+			pre:        []config.Hook{{Name: "migrate", Command: "false"}},
+			wantState:  history.StateFailed,
+			wantReason: history.ReasonPreDeployFailed,
+		},
+		{
+			post:         []config.Hook{{Command: "false", OnFailure: config.HookAbort}},
+			wantState:    history.StateFailed,
+			wantReason:   history.ReasonPostDeployFailed,
+			wantDeployed: true,
+		},
+	} {
+		os.Remove(marker)
+		env := config.Environment{
+			Name:       "prod",
+			DeployArgs: []string{"touch", marker},
+			PreDeploy:  spec.pre,
+			PostDeploy: spec.post,
+		}
+		entry := history.Entry{ID: fmt.Sprintf("deploy-%d", i), Project: "proj", Environment: "prod"}
+		if err := h.outputs.open(entry, 0); err != nil {
+			t.Fatalf("h.outputs.open(%#v, 0) failed with %v; want success", entry, err)
+		}
+		h.running.add(entry.ID)
+		state, err := h.run(context.Background(), &entry, env)
+		h.running.remove(entry.ID)
+		h.outputs.close(entry.ID)
+		if err != nil {
+			t.Errorf("h.run(ctx, &entry, %#v) failed with %v; want success", env, err)
+		}
+		if state != spec.wantState || entry.Reason != spec.wantReason || len(entry.Warnings) != spec.wantWarnings {
+			t.Errorf("h.run(ctx, &entry, %#v) = %q with reason %q and warnings %q; want %q with reason %q and %d warnings", env, state, entry.Reason, entry.Warnings, spec.wantState, spec.wantReason, spec.wantWarnings)
+		}
+		if _, err := os.Stat(marker); (err == nil) != spec.wantDeployed {
+			t.Errorf("deployed = %v; want %v with %#v", err == nil, spec.wantDeployed, env)
+		}
+	}
+
+	e := history.Entry{ID: "deploy-1", Project: "proj", Environment: "prod"}
+	buf, err := readDeployOutput(e)
+	if err != nil {
+		t.Fatalf("readDeployOutput(%#v) failed with %v; want success", e, err)
+	}
+	if got, want := string(buf), "===== pre_deploy: migrate =====\n"; !strings.HasPrefix(got, want) {
+		t.Errorf("output = %q; want prefix %q", got, want)
+	}
+}
+
+// urlControl is a revision.Control which returns fixed URLs of revisions.
+type urlControl struct {
+	revision.Control
+}
+
+func (c urlControl) RevisionURL(p config.Project, rev revision.Revision) string {
+	return "https://example.com/" + string(rev)
+}
+
+func TestBuildPlan(t *testing.T) {
+	d := preparedDeploy{
+		proj: config.Project{Name: "proj"},
+		env: config.Environment{
+			Name:       "prod",
+			DeployArgs: []string{"/tmp/deploy", "--hosts={{.Hosts}}", "--to={{.ToRevision}}"},
+			Hosts:      []string{"host1", "host2", "host3"},
+			Rollout:    &config.Rollout{BatchSize: 2},
+			PreDeploy:  []config.Hook{{Name: "migrate", Command: "/tmp/migrate {{.ToRevision}}"}},
+			PostDeploy: []config.Hook{{Command: "/tmp/purge", OnFailure: config.HookWarn}},
+		},
+		ctrl: urlControl{},
+		entry: history.Entry{
+			ID:          "20150101T000000.000000000Z-0123abcd",
+			Project:     "proj",
+			Environment: "prod",
+			Range:       history.RevRange{From: "abc", To: "def"},
+			User:        "alice",
+		},
+	}
+	p := buildPlan(d)
+	if got, want := p.Command, []string{"/tmp/deploy", "--hosts=host1,host2", "--to=def"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("p.Command = %q; want %q", got, want)
+	}
+	if got, want := p.Batches, [][]string{{"host1", "host2"}, {"host3"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("p.Batches = %q; want %q", got, want)
+	}
+	if got, want := p.RevisionURL, "https://example.com/def"; got != want {
+		t.Errorf("p.RevisionURL = %q; want %q", got, want)
+	}
+	wantHooks := []plannedHook{
+		{Phase: preDeploy, Name: "migrate", Command: []string{"/tmp/migrate", "def"}, OnFailure: config.HookAbort},
+		{Phase: postDeploy, Name: "/tmp/purge", Command: []string{"/tmp/purge"}, OnFailure: config.HookWarn},
+	}
+	if !reflect.DeepEqual(p.Hooks, wantHooks) {
+		t.Errorf("p.Hooks = %#v; want %#v", p.Hooks, wantHooks)
+	}
+	if got, want := p.Env[0], "GOSHIP_DEPLOY_ID="+dryRunID; got != want {
+		t.Errorf("p.Env[0] = %q; want %q", got, want)
+	}
+	if len(p.Warnings) != 0 {
+		t.Errorf("p.Warnings = %q; want no warnings", p.Warnings)
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	for _, spec := range []struct {
+		method, path string
+		status       int
+	}{
+		{method: "GET", path: "/api/v1/", status: http.StatusNotFound},
+		{method: "GET", path: "/api/v1/unknown", status: http.StatusNotFound},
+		{method: "GET", path: "/api/v1/projects/proj/environments/prod/unknown", status: http.StatusNotFound},
+		{method: "DELETE", path: "/api/v1/projects", status: http.StatusMethodNotAllowed},
+		{method: "POST", path: "/api/v1/deploys/123", status: http.StatusMethodNotAllowed},
+		{method: "GET", path: "/api/v1/projects/proj/environments/prod/comment", status: http.StatusMethodNotAllowed},
+	} {
+		r, err := http.NewRequest(spec.method, "http://localhost"+spec.path, nil)
+		if err != nil {
+			t.Fatalf("http.NewRequest(%q, %q, nil) failed with %v", spec.method, spec.path, err)
+		}
+		w := httptest.NewRecorder()
+		APIHandler{}.ServeHTTP(w, r)
+		if got, want := w.Code, spec.status; got != want {
+			t.Errorf("status of %s %s = %d; want %d", spec.method, spec.path, got, want)
+		}
+		var body apiError
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Error == "" {
+			t.Errorf("body of %s %s = %q; want an error in JSON", spec.method, spec.path, w.Body.String())
+		}
+	}
+}
+
+func TestCheckSameOrigin(t *testing.T) {
+	for _, spec := range []struct {
+		origin string
+		ok     bool
+	}{
+		{origin: "", ok: true},
+		{origin: "http://goship.example.com:8000", ok: true},
+		{origin: "https://goship.example.com:8000", ok: true},
+		{origin: "http://evil.example.com", ok: false},
+		{origin: "http://goship.example.com", ok: false},
+	} {
+		r, err := http.NewRequest("GET", "ws://goship.example.com:8000/web_push?deploy=1", nil)
+		if err != nil {
+			t.Fatalf("http.NewRequest failed with %v; want success", err)
+		}
+		if spec.origin != "" {
+			r.Header.Set("Origin", spec.origin)
+		}
+		cfg := &websocket.Config{Version: websocket.ProtocolVersionHybi13}
+		err = checkSameOrigin(cfg, r)
+		if spec.ok && err != nil {
+			t.Errorf("checkSameOrigin(cfg, r) failed with %v; want success; origin=%q", err, spec.origin)
+		}
+		if !spec.ok && err == nil {
+			t.Errorf("checkSameOrigin(cfg, r) succeeded; want failure; origin=%q", spec.origin)
+		}
+	}
+}
+
+func TestReadDeployLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goship-test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(%q, %q) failed with %v; want success", "", "goship-test", err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(orig string) { *dataPath = orig }(*dataPath)
+	*dataPath = dir
+
+	o := newDeployOutputs()
+	current := history.Entry{ID: "deploy-1", Project: "proj", Environment: "prod"}
+	if err := o.open(current, 0); err != nil {
+		t.Fatalf("o.open(%#v, 0) failed with %v; want success", current, err)
+	}
+	for _, l := range []struct {
+		s    output.Stream
+		text string
+	}{
+		{output.System, "===== deploy ====="},
+		{output.Stdout, "\x1b[32mdeployed\x1b[0m"},
+		{output.Stderr, "warning"},
+	} {
+		if err := o.writeLine(current, l.s, l.text); err != nil {
+			t.Errorf("o.writeLine(%#v, %q, %q) failed with %v; want success", current, l.s, l.text, err)
+		}
+	}
+	o.close(current.ID)
+	// Lines written after the output is closed are discarded.
+	if err := o.writeLine(current, output.Stdout, "late"); err != errOutputClosed {
+		t.Errorf("o.writeLine(%#v, %q, %q) = %v after close; want %v", current, output.Stdout, "late", err, errOutputClosed)
+	}
+
+	// Outputs of older versions are plain text.
+	legacy := history.Entry{ID: "deploy-0", Project: "proj", Environment: "prod"}
+	if err := ioutil.WriteFile(filepath.Join(dir, "proj-prod", "deploy-0.log"), []byte("line 1\nline 2\n"), 0644); err != nil {
+		t.Fatalf("ioutil.WriteFile failed with %v; want success", err)
+	}
+
+	for _, spec := range []struct {
+		e    history.Entry
+		want []output.Stream
+		text string
+	}{
+		{
+			e:    current,
+			want: []output.Stream{output.System, output.Stdout, output.Stderr},
+			text: "===== deploy =====\ndeployed\nwarning\n",
+		},
+		{
+			e:    legacy,
+			want: []output.Stream{output.Stdout, output.Stdout},
+			text: "line 1\nline 2\n",
+		},
+	} {
+		l, err := readDeployLog(spec.e)
+		if err != nil {
+			t.Errorf("readDeployLog(%#v) failed with %v; want success", spec.e, err)
+			continue
+		}
+		var got []output.Stream
+		for _, line := range l.Lines {
+			got = append(got, line.Stream)
+		}
+		if !reflect.DeepEqual(got, spec.want) {
+			t.Errorf("streams of readDeployLog(%#v) = %q; want %q", spec.e, got, spec.want)
+		}
+		buf, err := readDeployOutput(spec.e)
+		if err != nil {
+			t.Errorf("readDeployOutput(%#v) failed with %v; want success", spec.e, err)
+			continue
+		}
+		if got := string(buf); got != spec.text {
+			t.Errorf("readDeployOutput(%#v) = %q; want %q", spec.e, got, spec.text)
+		}
+	}
+}
+
+func TestCleanOutputs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goship-test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(%q, %q) failed with %v; want success", "", "goship-test", err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(orig string) { *dataPath = orig }(*dataPath)
+	*dataPath = dir
+	store := history.NewFileStore(dir)
+
+	now := time.Now()
+	o := newDeployOutputs()
+	var entries []history.Entry
+	for _, spec := range []struct {
+		id    string
+		age   time.Duration
+		state history.State
+	}{
+		{id: "legacy", age: 96 * time.Hour, state: history.StateSucceeded},
+		{id: "old", age: 72 * time.Hour, state: history.StateFailed},
+		{id: "recent", age: 30 * time.Hour, state: history.StateSucceeded},
+		{id: "latest", age: time.Hour, state: history.StateSucceeded},
+		{id: "running", state: history.StateRunning},
+	} {
+		e := history.Entry{
+			ID:          spec.id,
+			Project:     "proj",
+			Environment: "prod",
+			State:       spec.state,
+			Time:        now.Add(-spec.age),
+		}
+		if spec.state.Finished() {
+			e.EndTime = e.Time
+		}
+		if _, err := store.Append(e); err != nil {
+			t.Fatalf("store.Append(%#v) failed with %v; want success", e, err)
+		}
+		if err := o.open(e, 0); err != nil {
+			t.Fatalf("o.open(%#v, 0) failed with %v; want success", e, err)
+		}
+		if err := o.writeLine(e, output.Stdout, "output of "+e.ID); err != nil {
+			t.Fatalf("o.writeLine(%#v, %q, %q) failed with %v; want success", e, output.Stdout, "output of "+e.ID, err)
+		}
+		o.close(e.ID)
+		entries = append(entries, e)
+	}
+	// Outputs of older versions are plain text.
+	legacy := deployOutputPath(entries[0])
+	if err := os.Rename(legacy, strings.TrimSuffix(legacy, ".out")+".log"); err != nil {
+		t.Fatalf("os.Rename failed with %v; want success", err)
+	}
+
+	// Nothing is removed or compressed without a retention policy.
+	c := config.Config{
+		Projects: []config.Project{
+			{
+				Name:         "proj",
+				Environments: []config.Environment{{Name: "prod"}},
+			},
+		},
+	}
+	r, err := cleanOutputs(c, store, now)
+	if err != nil {
+		t.Fatalf("cleanOutputs(c, store, %v) failed with %v; want success", now, err)
+	}
+	if r != (janitorReport{}) {
+		t.Errorf("cleanOutputs(c, store, %v) = %#v without retention; want nothing cleaned", now, r)
+	}
+
+	c.Projects[0].Retention = &config.Retention{
+		KeepDeploys:   3,
+		KeepFor:       config.Duration(48 * time.Hour),
+		CompressAfter: config.Duration(24 * time.Hour),
+	}
+	r, err = cleanOutputs(c, store, now)
+	if err != nil {
+		t.Fatalf("cleanOutputs(c, store, %v) failed with %v; want success", now, err)
+	}
+	// The running deployment does not take one of the kept slots.
+	// Freed bytes are not checked because compression enlarges outputs as tiny as these.
+	if r.Removed != 1 || r.Compressed != 2 {
+		t.Errorf("cleanOutputs(c, store, %v) = %#v; want 1 removed and 2 compressed", now, r)
+	}
+
+	for _, spec := range []struct {
+		e       history.Entry
+		removed bool
+		file    string
+	}{
+		{e: entries[0], removed: true},
+		{e: entries[1], file: deployOutputPath(entries[1]) + output.CompressedExt},
+		{e: entries[2], file: deployOutputPath(entries[2]) + output.CompressedExt},
+		{e: entries[3], file: deployOutputPath(entries[3])},
+		{e: entries[4], file: deployOutputPath(entries[4])},
+	} {
+		buf, err := readDeployOutput(spec.e)
+		if spec.removed {
+			if !os.IsNotExist(err) {
+				t.Errorf("readDeployOutput(%#v) failed with %v; want not exist", spec.e, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("readDeployOutput(%#v) failed with %v; want success", spec.e, err)
+			continue
+		}
+		if got, want := string(buf), "output of "+spec.e.ID+"\n"; got != want {
+			t.Errorf("readDeployOutput(%#v) = %q; want %q", spec.e, got, want)
+		}
+		if _, err := os.Stat(spec.file); err != nil {
+			t.Errorf("os.Stat(%q) failed with %v; want success", spec.file, err)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gengo/goship/lib/auth"
+	"github.com/gengo/goship/lib/config"
+	"github.com/gengo/goship/lib/history"
+	"github.com/gengo/goship/lib/revision"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// promoteTimeout is the deadline of fetching revisions running in deploy targets.
+const promoteTimeout = 30 * time.Second
+
+// PromoteHandler deploys into an environment the revision running in the previous stage of the pipeline.
+// i.e. http://127.0.0.1:8000/promote?project=admin&environment=production
+type PromoteHandler struct {
+	dh DeployHandler
+}
+
+func (h PromoteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	u, err := auth.CurrentUser(r)
+	if err != nil {
+		glog.Errorf("Failed to fetch current user: %v", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	projName, envName := r.FormValue("project"), r.FormValue("environment")
+	if projName == "" || envName == "" {
+		http.Error(w, "project and environment must be specified", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), promoteTimeout)
+	defer cancel()
+	entry, pos, err := h.dh.promote(ctx, projName, envName, u.Name, r.FormValue("force") != "", time.Now())
+	if re, ok := err.(requestError); ok {
+		http.Error(w, re.msg, re.status)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp := deployResponse{ID: entry.ID, State: entry.State, Position: pos, Approval: entry.Approval}
+	buf, err := json.Marshal(resp)
+	if err != nil {
+		glog.Errorf("Failed to marshal response: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(buf)
+}
+
+// promote deploys into "envName" the revision which is running in the previous stage of the pipeline.
+// The deployment goes through start, so it is subject to the same checks as manual deployments.
+func (h DeployHandler) promote(ctx context.Context, projName, envName, user string, force bool, t time.Time) (history.Entry, int, error) {
+	c, err := config.Load(h.ecl)
+	if err != nil {
+		glog.Errorf("Failed to fetch latest configuration: %v", err)
+		return history.Entry{}, 0, err
+	}
+	proj, err := config.ProjectFromName(c.Projects, projName)
+	if err != nil {
+		return history.Entry{}, 0, requestError{http.StatusNotFound, "no such project"}
+	}
+	env, err := config.EnvironmentFromName(c.Projects, projName, envName)
+	if err != nil {
+		return history.Entry{}, 0, requestError{http.StatusNotFound, "no such project/environment"}
+	}
+	prevName := proj.PreviousStage(env.Name)
+	if prevName == "" {
+		return history.Entry{}, 0, requestError{http.StatusBadRequest, fmt.Sprintf("%s-%s has no previous stage to promote from", proj.Name, env.Name)}
+	}
+	prev, err := config.EnvironmentFromName(c.Projects, projName, prevName)
+	if err != nil {
+		return history.Entry{}, 0, requestError{http.StatusNotFound, "no such project/environment"}
+	}
+
+	ctrl, err := h.controls(c.DeployUser, proj)
+	if err != nil {
+		glog.Errorf("Failed to build revision control of %s: %v", proj.Name, err)
+		return history.Entry{}, 0, err
+	}
+	rev, srcRev, err := stageRevision(ctx, ctrl, proj, *prev)
+	if err != nil {
+		glog.Errorf("Failed to get the revision running in %s-%s: %v", proj.Name, prev.Name, err)
+		return history.Entry{}, 0, requestError{http.StatusConflict, err.Error()}
+	}
+	if soak := time.Duration(proj.SoakTime); soak > 0 {
+		if err := checkSoak(h.store, proj.Name, prev.Name, rev, soak, t); err != nil {
+			return history.Entry{}, 0, requestError{http.StatusConflict, err.Error()}
+		}
+	}
+
+	from, srcFrom, err := stageRevision(ctx, ctrl, proj, *env)
+	if err != nil {
+		glog.Warningf("Failed to get the revision running in %s-%s: %v", proj.Name, env.Name, err)
+		if cur, err := currentDeploy(h.store, proj.Name, env.Name); err == nil {
+			from = cur.Range.To
+			if cur.SourceRange != nil {
+				srcFrom = cur.SourceRange.To
+			}
+		}
+	}
+	if from == rev {
+		return history.Entry{}, 0, requestError{http.StatusConflict, fmt.Sprintf("%s-%s already runs %s", proj.Name, env.Name, rev.Short())}
+	}
+
+	glog.Infof("%s is promoting %s from %s to %s", user, rev, prev.Name, env.Name)
+	return h.start(ctx, deployRequest{
+		Project:      proj.Name,
+		Environment:  env.Name,
+		Range:        history.RevRange{From: from, To: rev},
+		SourceRange:  history.RevRange{From: srcFrom, To: srcRev},
+		User:         user,
+		Force:        force,
+		PromotedFrom: prev.Name,
+	})
+}
+
+// stageRevision returns the revision which is running in all the hosts of "env".
+// It returns an error if the hosts run different revisions.
+func stageRevision(ctx context.Context, ctrl revision.Control, proj config.Project, env config.Environment) (rev, srcRev revision.Revision, err error) {
+	if len(env.Hosts) == 0 {
+		return "", "", fmt.Errorf("%s-%s has no hosts", proj.Name, env.Name)
+	}
+	for i, host := range env.Hosts {
+		r, s, err := ctrl.LatestDeployed(ctx, host, proj, env)
+		if err != nil {
+			return "", "", err
+		}
+		if i > 0 && r != rev {
+			return "", "", fmt.Errorf("hosts in %s-%s run different revisions: %s and %s", proj.Name, env.Name, rev.Short(), r.Short())
+		}
+		rev, srcRev = r, s
+	}
+	return rev, srcRev, nil
+}
+
+// checkSoak returns an error unless "rev" has been successfully running in "env" of "proj" for "soak" at "t".
+// It judges from the latest finished deployment into the environment.
+func checkSoak(store history.DeployStore, proj, env string, rev revision.Revision, soak time.Duration, t time.Time) error {
+	entries, err := store.List(proj, env)
+	if err != nil {
+		glog.Errorf("Failed to read entries of %s-%s: %v", proj, env, err)
+		return err
+	}
+	for _, e := range entries {
+		if !e.State.Finished() {
+			continue
+		}
+		if e.State != history.StateSucceeded {
+			return fmt.Errorf("the latest deployment %s into %s-%s did not succeed", e.ID, proj, env)
+		}
+		if e.Range.To != rev {
+			return fmt.Errorf("%s was not deployed into %s-%s by the latest deployment", rev.Short(), proj, env)
+		}
+		since := e.EndTime
+		if since.IsZero() {
+			since = e.Time
+		}
+		if d := t.Sub(since); d < soak {
+			return fmt.Errorf("%s has been running in %s-%s only for %v; soak time is %v", rev.Short(), proj, env, d, soak)
+		}
+		return nil
+	}
+	return fmt.Errorf("no deployment into %s-%s is recorded", proj, env)
+}
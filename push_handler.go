@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gengo/goship/lib/auth"
+	"github.com/gengo/goship/lib/notification"
+	"github.com/golang/glog"
+	"golang.org/x/net/websocket"
+)
+
+// PushHandler streams the output and events of deployments over websocket.
+// i.e. ws://127.0.0.1:8000/web_push?deploy=<deploy ID>
+// or ws://127.0.0.1:8000/web_push?project=<project>&environment=<environment>
+//
+// The output of a running deployment which has been written before the connection is replayed first.
+// Users can subscribe only to projects which they can read.
+type PushHandler struct {
+	dh DeployHandler
+}
+
+func (h PushHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u, err := auth.CurrentUser(r)
+	if err != nil {
+		glog.Errorf("Failed to get current user: %v", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	f, err := pushFilter(h.dh, r, u)
+	if err != nil {
+		if re, ok := err.(requestError); ok {
+			http.Error(w, re.msg, re.status)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s := websocket.Server{
+		Handshake: checkSameOrigin,
+		Handler: func(ws *websocket.Conn) {
+			h.dh.hub.ServeWebsocket(ws, f)
+		},
+	}
+	s.ServeHTTP(w, r)
+}
+
+// pushFilter returns the filter of messages which "r" subscribes to with the parameters "deploy", "project" and "environment".
+// It returns an error unless "u" can read the project of the messages.
+func pushFilter(dh DeployHandler, r *http.Request, u auth.User) (notification.Filter, error) {
+	api := APIHandler{dh: dh}
+	if id := r.FormValue("deploy"); id != "" {
+		e, err := api.loadDeploy(u, id)
+		if err != nil {
+			return notification.Filter{}, err
+		}
+		return notification.Filter{DeployID: e.ID, Project: e.Project, Environment: e.Environment}, nil
+	}
+	projName, envName := r.FormValue("project"), r.FormValue("environment")
+	if projName == "" {
+		return notification.Filter{}, requestError{http.StatusBadRequest, "deploy or project is required"}
+	}
+	if envName == "" {
+		if _, _, err := api.loadProject(u, projName); err != nil {
+			return notification.Filter{}, err
+		}
+	} else if _, _, _, err := api.loadEnvironment(u, projName, envName); err != nil {
+		return notification.Filter{}, err
+	}
+	return notification.Filter{Project: projName, Environment: envName}, nil
+}
+
+// checkSameOrigin rejects websocket connections from pages of other sites.
+// Otherwise those pages could read the output of deployments with the cookie of the user.
+// Connections without Origin, i.e. from non-browser clients, are accepted.
+func checkSameOrigin(cfg *websocket.Config, r *http.Request) error {
+	origin, err := websocket.Origin(cfg, r)
+	if err != nil {
+		return err
+	}
+	if origin != nil && origin.Host != r.Host {
+		return fmt.Errorf("cross-origin websocket connection from %s", origin)
+	}
+	cfg.Origin = origin
+	return nil
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/gengo/goship/lib/acl"
+	"github.com/gengo/goship/lib/auth"
+	"github.com/gengo/goship/lib/config"
+	"github.com/gengo/goship/lib/freeze"
+	"github.com/gengo/goship/lib/history"
+	"github.com/gengo/goship/lib/revision"
+	"github.com/gengo/goship/lib/schedule"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// ScheduleHandler lists or adds scheduled deployments.
+//
+// GET returns pending schedules in JSON, optionally filtered by project and environment.
+// i.e. http://127.0.0.1:8000/schedules?project=admin&environment=staging
+//
+// POST schedules a deployment at the time "at".
+// "at" is either in RFC 3339 or in "2006-01-02 15:04" in the time zone "time_zone".
+// i.e. http://127.0.0.1:8000/schedules?project=admin&environment=staging&to_revision=abc123&at=2015-10-21+10:00&time_zone=Asia/Tokyo
+type ScheduleHandler struct {
+	ac  acl.AccessControl
+	ecl *etcd.Client
+}
+
+func (h ScheduleHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c, err := config.Load(h.ecl)
+	if err != nil {
+		glog.Errorf("Failed to fetch latest configuration: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	u, err := auth.CurrentUser(r)
+	if err != nil {
+		glog.Errorf("Failed to fetch current user: %v", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if r.Method == "POST" {
+		h.add(w, r, c, u)
+		return
+	}
+
+	schedules, err := schedule.List(h.ecl)
+	if err != nil {
+		glog.Errorf("Failed to list schedules: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	readable := acl.ReadableProjects(h.ac, c.Projects, u)
+	projName, envName := r.FormValue("project"), r.FormValue("environment")
+	filtered := []schedule.Schedule{}
+	for _, s := range schedules {
+		if _, err := config.ProjectFromName(readable, s.Project); err != nil {
+			continue
+		}
+		if (projName != "" && projName != s.Project) || (envName != "" && envName != s.Environment) {
+			continue
+		}
+		filtered = append(filtered, s)
+	}
+	buf, err := json.Marshal(filtered)
+	if err != nil {
+		glog.Errorf("Failed to marshal response: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf)
+}
+
+func (h ScheduleHandler) add(w http.ResponseWriter, r *http.Request, c config.Config, u auth.User) {
+	now := time.Now()
+	s := schedule.Schedule{
+		Project:     r.FormValue("project"),
+		Environment: r.FormValue("environment"),
+		Range: history.RevRange{
+			From: revision.Revision(r.FormValue("from_revision")),
+			To:   revision.Revision(r.FormValue("to_revision")),
+		},
+		User:      u.Name,
+		CreatedAt: now,
+	}
+	if s.Range.To == "" {
+		http.Error(w, "to_revision not specified", http.StatusBadRequest)
+		return
+	}
+	if from, to := r.FormValue("from_source_revision"), r.FormValue("to_source_revision"); from != "" || to != "" {
+		s.SourceRange = &history.RevRange{From: revision.Revision(from), To: revision.Revision(to)}
+	}
+	var err error
+	if s.Time, err = parseScheduleTime(r.FormValue("at"), r.FormValue("time_zone")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !s.Time.After(now) {
+		http.Error(w, "scheduled time must be in the future", http.StatusBadRequest)
+		return
+	}
+
+	proj, err := config.ProjectFromName(c.Projects, s.Project)
+	if err != nil {
+		http.Error(w, "no such project", http.StatusNotFound)
+		return
+	}
+	if _, err := config.EnvironmentFromName(c.Projects, s.Project, s.Environment); err != nil {
+		http.Error(w, "no such project/environment", http.StatusNotFound)
+		return
+	}
+	// Locks and freeze windows are checked when the deployment starts.
+	repo := proj.SourceRepo()
+	if !h.ac.Deployable(repo.RepoOwner, repo.RepoName, u.Name) {
+		http.Error(w, "permission denied", http.StatusForbidden)
+		return
+	}
+
+	if s.ID, err = schedule.Add(h.ecl, s); err != nil {
+		glog.Errorf("Failed to add schedule: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	glog.Infof("%s scheduled deployment %s of %s-%s to %s at %s", u.Name, s.ID, s.Project, s.Environment, s.Range.To, s.Time)
+
+	buf, err := json.Marshal(s)
+	if err != nil {
+		glog.Errorf("Failed to marshal response: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(buf)
+}
+
+// parseScheduleTime parses "at" in RFC 3339, or in freeze.TimeLayout in the time zone "tz".
+func parseScheduleTime(at, tz string) (time.Time, error) {
+	if at == "" {
+		return time.Time{}, fmt.Errorf("at not specified")
+	}
+	if t, err := time.Parse(time.RFC3339, at); err == nil {
+		return t, nil
+	}
+	loc := time.UTC
+	if tz != "" {
+		var err error
+		if loc, err = time.LoadLocation(tz); err != nil {
+			return time.Time{}, fmt.Errorf("invalid time_zone %q: %v", tz, err)
+		}
+	}
+	t, err := time.ParseInLocation(freeze.TimeLayout, at, loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q", at)
+	}
+	return t, nil
+}
+
+// CancelScheduleHandler cancels a scheduled deployment.
+// i.e. http://127.0.0.1:8000/schedules/cancel?id=<schedule ID>
+type CancelScheduleHandler struct {
+	ac  acl.AccessControl
+	ecl *etcd.Client
+}
+
+func (h CancelScheduleHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	u, err := auth.CurrentUser(r)
+	if err != nil {
+		glog.Errorf("Failed to fetch current user: %v", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	id := r.FormValue("id")
+	s, err := schedule.Get(h.ecl, id)
+	if err == schedule.ErrNotFound {
+		http.Error(w, "no such schedule", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		glog.Errorf("Failed to get schedule %s: %v", id, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	c, err := config.Load(h.ecl)
+	if err != nil {
+		glog.Errorf("Failed to fetch latest configuration: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	proj, err := config.ProjectFromName(c.Projects, s.Project)
+	if err != nil {
+		http.Error(w, "no such project", http.StatusNotFound)
+		return
+	}
+	repo := proj.SourceRepo()
+	if !h.ac.Deployable(repo.RepoOwner, repo.RepoName, u.Name) {
+		http.Error(w, "permission denied", http.StatusForbidden)
+		return
+	}
+	if err := schedule.Cancel(h.ecl, id); err == schedule.ErrNotFound {
+		http.Error(w, "schedule has already started or been cancelled", http.StatusConflict)
+		return
+	} else if err != nil {
+		glog.Errorf("Failed to cancel schedule %s: %v", id, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	glog.Infof("%s cancelled scheduled deployment %s of %s-%s", u.Name, id, s.Project, s.Environment)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// runSchedule starts the scheduled deployment "s" on behalf of the user who scheduled it.
+// Locks, freeze windows and permissions are checked in the same way as manual deployments.
+// If the deployment does not start, it is recorded in the history as rejected.
+func (h DeployHandler) runSchedule(s schedule.Schedule) {
+	req := deployRequest{
+		Project:     s.Project,
+		Environment: s.Environment,
+		Range:       s.Range,
+		User:        s.User,
+		ScheduleID:  s.ID,
+	}
+	if s.SourceRange != nil {
+		req.SourceRange = *s.SourceRange
+	}
+	if req.Range.From == "" {
+		if cur, err := currentDeploy(h.store, s.Project, s.Environment); err == nil {
+			req.Range.From = cur.Range.To
+		}
+	}
+	entry, _, err := h.start(context.Background(), req)
+	if err == nil {
+		glog.Infof("Started scheduled deployment %s as %s", s.ID, entry.ID)
+		return
+	}
+	glog.Errorf("Failed to start scheduled deployment %s of %s-%s: %v", s.ID, s.Project, s.Environment, err)
+	if _, err := h.recordRejectedSchedule(s, req.Range, err, time.Now()); err != nil {
+		glog.Errorf("Failed to record rejected schedule %s: %v", s.ID, err)
+	}
+	c, cerr := config.Load(h.ecl)
+	if cerr != nil {
+		glog.Errorf("Failed to fetch latest configuration: %v", cerr)
+		return
+	}
+	if c.Notify != "" {
+		msg := fmt.Sprintf("Scheduled deployment of %s to *%s* by %s was not started: %v", s.Project, s.Environment, s.User, err)
+		if err := notify(c.Notify, msg); err != nil {
+			glog.Errorf("Failed to notify: %v", err)
+		}
+	}
+}
+
+// recordRejectedSchedule records the scheduled deployment "s" of "deploy" which did not start at "t" because of "cause".
+// The deployment is cancelled if it was rejected, and failed otherwise. "cause" is written to its output.
+func (h DeployHandler) recordRejectedSchedule(s schedule.Schedule, deploy history.RevRange, cause error, t time.Time) (history.Entry, error) {
+	e := history.Entry{
+		ID:          history.NewID(t),
+		Project:     s.Project,
+		Environment: s.Environment,
+		Range:       deploy,
+		SourceRange: s.SourceRange,
+		User:        s.User,
+		Time:        t,
+		ScheduleID:  s.ID,
+		Reason:      history.ReasonScheduleRejected,
+	}
+	state := history.StateFailed
+	if _, ok := cause.(requestError); ok {
+		state = history.StateCancelled
+	}
+	e.Finish(state, t)
+	if err := h.outputs.open(e, 0); err != nil {
+		glog.Errorf("Failed to open output of %s: %v", e.ID, err)
+	} else {
+		h.writeLine(e, fmt.Sprintf("Scheduled deployment %s was not started: %v", s.ID, cause))
+		h.outputs.close(e.ID)
+	}
+	if _, err := h.store.Append(e); err != nil {
+		return history.Entry{}, err
+	}
+	broadcastEvent(h.hub, e, string(e.State), s.User)
+	return e, nil
+}
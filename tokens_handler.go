@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/gengo/goship/lib/auth"
+	"github.com/gengo/goship/lib/config"
+	"github.com/gengo/goship/lib/token"
+	helpers "github.com/gengo/goship/lib/view-helpers"
+	"github.com/golang/glog"
+)
+
+// TokensHandler shows API tokens of the current user.
+// i.e. http://127.0.0.1:8000/tokens
+//
+// Tokens are created and revoked through the API.
+type TokensHandler struct {
+	ecl    *etcd.Client
+	assets helpers.Assets
+}
+
+func (h TokensHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u, err := auth.CurrentUser(r)
+	if err != nil {
+		glog.Errorf("Failed to get current user: %v", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	c, err := config.Load(h.ecl)
+	if err != nil {
+		glog.Errorf("Failed to fetch latest configuration: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tokens, err := visibleTokens(h.ecl, u, c.IsAdmin(u.Name))
+	if err != nil {
+		glog.Errorf("Failed to list tokens: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	t, err := template.New("tokens.html").ParseFiles("templates/tokens.html", "templates/base.html")
+	if err != nil {
+		glog.Errorf("Failed to parse template: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	js, css := h.assets.Templates()
+	params := map[string]interface{}{
+		"Javascript": js,
+		"Stylesheet": css,
+		"User":       u,
+		"Page":       "tokens",
+		"Admin":      c.IsAdmin(u.Name),
+		"Tokens":     tokens,
+	}
+	helpers.RespondWithTemplate(w, "text/html", t, "base", params)
+}
+
+// apiTokenRequest is the request body of token creation.
+type apiTokenRequest struct {
+	Name string `json:"name"`
+	// User is the name of the service account which the token acts as.
+	// The token is a personal token of the current user if it is empty.
+	User     string        `json:"user"`
+	Projects []string      `json:"projects"`
+	Scopes   []token.Scope `json:"scopes"`
+	// ExpiresIn is a duration after which the token expires, e.g. "720h". The token does not expire if it is empty.
+	ExpiresIn string `json:"expires_in"`
+}
+
+// apiCreatedToken is the response body of token creation.
+type apiCreatedToken struct {
+	token.Token
+	// Secret is the value of the Authorization header "Bearer <secret>". It is not shown again.
+	Secret string `json:"secret"`
+}
+
+// tokens responds with the tokens visible to "u" to GET requests, and creates a token on POST requests.
+func (h APIHandler) tokens(w http.ResponseWriter, r *http.Request, u auth.User) {
+	if !allowMethods(w, r, "GET", "POST") {
+		return
+	}
+	c, err := h.loadTokenConfig(u)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if r.Method == "GET" {
+		tokens, err := visibleTokens(h.dh.ecl, u, c.IsAdmin(u.Name))
+		if err != nil {
+			glog.Errorf("Failed to list tokens: %v", err)
+			writeAPIError(w, err)
+			return
+		}
+		writeAPIJSON(w, http.StatusOK, tokens)
+		return
+	}
+
+	var body apiTokenRequest
+	if err := decodeAPIRequest(r, &body); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	t := token.Token{
+		Name:      body.Name,
+		User:      u.Name,
+		Projects:  body.Projects,
+		Scopes:    body.Scopes,
+		CreatedBy: u.Name,
+		CreatedAt: time.Now(),
+	}
+	if body.User != "" && body.User != u.Name {
+		if !c.IsAdmin(u.Name) {
+			writeAPIError(w, requestError{http.StatusForbidden, "only admins can create service tokens"})
+			return
+		}
+		t.User, t.Service = body.User, true
+	}
+	if body.ExpiresIn != "" {
+		d, err := time.ParseDuration(body.ExpiresIn)
+		if err != nil || d <= 0 {
+			writeAPIError(w, requestError{http.StatusBadRequest, fmt.Sprintf("invalid expires_in %q", body.ExpiresIn)})
+			return
+		}
+		t.Expiry = t.CreatedAt.Add(d)
+	}
+	if err := t.Validate(); err != nil {
+		writeAPIError(w, requestError{http.StatusBadRequest, err.Error()})
+		return
+	}
+	secret, t, err := token.Create(h.dh.ecl, t)
+	if err != nil {
+		glog.Errorf("Failed to create token: %v", err)
+		writeAPIError(w, err)
+		return
+	}
+	glog.Infof("AUDIT: %s created token %s (%s) for %s with scopes %q", u.Name, t.ID, t.Name, t.User, t.Scopes)
+	writeAPIJSON(w, http.StatusCreated, apiCreatedToken{Token: t, Secret: secret})
+}
+
+// revokeToken revokes the token "id".
+// Tokens can be revoked by their users, their creators and admins.
+func (h APIHandler) revokeToken(w http.ResponseWriter, r *http.Request, u auth.User, id string) {
+	if !allowMethods(w, r, "DELETE") {
+		return
+	}
+	c, err := h.loadTokenConfig(u)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	t, err := token.Get(h.dh.ecl, id)
+	if err == token.ErrNotFound {
+		writeAPIError(w, requestError{http.StatusNotFound, err.Error()})
+		return
+	}
+	if err != nil {
+		glog.Errorf("Failed to get token %s: %v", id, err)
+		writeAPIError(w, err)
+		return
+	}
+	if !tokenVisible(t, u, c.IsAdmin(u.Name)) {
+		writeAPIError(w, requestError{http.StatusNotFound, token.ErrNotFound.Error()})
+		return
+	}
+	if err := token.Revoke(h.dh.ecl, id); err != nil {
+		if err == token.ErrNotFound {
+			writeAPIError(w, requestError{http.StatusNotFound, err.Error()})
+			return
+		}
+		glog.Errorf("Failed to revoke token %s: %v", id, err)
+		writeAPIError(w, err)
+		return
+	}
+	glog.Infof("AUDIT: %s revoked token %s (%s) of %s", u.Name, t.ID, t.Name, t.User)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// loadTokenConfig returns the latest configuration unless "u" was authenticated with a token.
+// Tokens cannot manage tokens so that a leaked token cannot be used to create another one.
+func (h APIHandler) loadTokenConfig(u auth.User) (config.Config, error) {
+	if u.Token != nil {
+		return config.Config{}, requestError{http.StatusForbidden, "tokens cannot be managed with tokens"}
+	}
+	c, err := config.Load(h.dh.ecl)
+	if err != nil {
+		glog.Errorf("Failed to fetch latest configuration: %v", err)
+		return config.Config{}, err
+	}
+	return c, nil
+}
+
+// visibleTokens returns the tokens which "u" can see and revoke.
+func visibleTokens(client config.ETCDInterface, u auth.User, admin bool) ([]token.Token, error) {
+	all, err := token.List(client)
+	if err != nil {
+		return nil, err
+	}
+	tokens := []token.Token{}
+	for _, t := range all {
+		if tokenVisible(t, u, admin) {
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens, nil
+}
+
+// tokenVisible returns true if "u" can see and revoke "t".
+func tokenVisible(t token.Token, u auth.User, admin bool) bool {
+	return admin || t.User == u.Name || t.CreatedBy == u.Name
+}
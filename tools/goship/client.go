@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/websocket"
+)
+
+// client is a client of the Goship API.
+type client struct {
+	// server is the base URL of Goship, e.g. https://goship.example.com.
+	server *url.URL
+	// token is the secret of an API token.
+	token string
+}
+
+// apiError is the response body of the API on errors.
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// do sends a request to the API at "path" and decodes the response into "out" unless it is nil.
+// "path" is relative to /api/v1 and can have a query string.
+// "in" is sent as the JSON request body unless it is nil.
+func (c client) do(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		buf, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(buf)
+	}
+	u := *c.server
+	if i := strings.Index(path, "?"); i >= 0 {
+		path, u.RawQuery = path[:i], path[i+1:]
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v1" + path
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		var e apiError
+		if err := json.Unmarshal(buf, &e); err != nil || e.Error == "" {
+			return fmt.Errorf("%s %s: %s", method, u.Path, resp.Status)
+		}
+		return fmt.Errorf("%s %s: %s: %s", method, u.Path, resp.Status, e.Error)
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.Unmarshal(buf, out)
+}
+
+// pushMessage is a message from the websocket hub of Goship.
+type pushMessage struct {
+	Project     string
+	Environment string
+	DeployID    string
+	// StdoutLine is a line of the output of the deployment.
+	StdoutLine string
+	// Event is a change of the state of the deployment, e.g. "succeeded". It is empty for lines of output.
+	Event string
+	User  string
+}
+
+// subscribe connects to the websocket hub of Goship and sends the messages of the deployment "id" to the returned channel.
+// The channel is closed when the connection is closed.
+func (c client) subscribe(id string) (<-chan pushMessage, io.Closer, error) {
+	u := *c.server
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	default:
+		u.Scheme = "ws"
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/web_push"
+	u.RawQuery = url.Values{"deploy": {id}}.Encode()
+	cfg, err := websocket.NewConfig(u.String(), c.server.String())
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.token != "" {
+		cfg.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	ws, err := websocket.DialConfig(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	ch := make(chan pushMessage, 256)
+	go func() {
+		defer close(ch)
+		for {
+			var msg pushMessage
+			if err := websocket.JSON.Receive(ws, &msg); err != nil {
+				return
+			}
+			ch <- msg
+		}
+	}()
+	return ch, ws, nil
+}
@@ -0,0 +1,409 @@
+// Command goship is a command-line client of Goship.
+// It talks to the REST API of Goship with an API token.
+//
+//	export GOSHIP_SERVER=https://goship.example.com GOSHIP_TOKEN=goship_...
+//	goship status admin
+//	goship deploy admin staging --rev 0123abc -f
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gengo/goship/handlers/commits"
+	"github.com/gengo/goship/lib/config"
+	"github.com/gengo/goship/lib/history"
+)
+
+const usage = `Usage: goship [flags] <command> [args]
+
+Commands:
+  status <project>                                        latest revisions in each environment
+  deploy <project> <env> [--rev REV] [--force] [-f]       deploys REV (default: latest deployable revision)
+  lock <project> <env> [--reason R] [--expires-in D]      locks the environment
+  unlock <project> <env>                                  unlocks the environment
+  comment <project> <env> <comment>                       updates the comment on the environment
+  history <project> <env> [--limit N] [--user U]          recent deployments
+  logs [-f] <deploy ID>                                   output of a deployment
+
+Flags:
+`
+
+var (
+	server  = flag.String("server", os.Getenv("GOSHIP_SERVER"), "base URL of Goship (default $GOSHIP_SERVER)")
+	token   = flag.String("token", os.Getenv("GOSHIP_TOKEN"), "API token (default $GOSHIP_TOKEN)")
+	jsonOut = flag.Bool("json", false, "print responses in JSON")
+)
+
+// command is a subcommand of goship.
+type command struct {
+	// args is the number of positional arguments.
+	args int
+	// flags defines flags of the subcommand in "fs" and returns the implementation of the subcommand.
+	flags func(fs *flag.FlagSet) func(c client, args []string) error
+}
+
+var commands = map[string]command{
+	"status":  {args: 1, flags: statusCmd},
+	"deploy":  {args: 2, flags: deployCmd},
+	"lock":    {args: 2, flags: lockCmd},
+	"unlock":  {args: 2, flags: unlockCmd},
+	"comment": {args: 3, flags: commentCmd},
+	"history": {args: 2, flags: historyCmd},
+	"logs":    {args: 1, flags: logsCmd},
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	name := flag.Arg(0)
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", name)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.BoolVar(jsonOut, "json", *jsonOut, "print responses in JSON")
+	run := cmd.flags(fs)
+	args, err := parseArgs(fs, flag.Args()[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if len(args) != cmd.args {
+		fmt.Fprintf(os.Stderr, "%s takes %d arguments\n", name, cmd.args)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if *server == "" {
+		fmt.Fprintln(os.Stderr, "-server or $GOSHIP_SERVER must be specified")
+		os.Exit(2)
+	}
+	u, err := url.Parse(*server)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid server URL %q: %v\n", *server, err)
+		os.Exit(2)
+	}
+	if err := run(client{server: u, token: *token}, args); err != nil {
+		fmt.Fprintf(os.Stderr, "goship %s: %v\n", name, err)
+		os.Exit(1)
+	}
+}
+
+// parseArgs parses "args" with "fs" and returns positional arguments.
+// Unlike fs.Parse, flags can follow positional arguments.
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// printJSON prints "v" in JSON.
+func printJSON(v interface{}) error {
+	buf, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Printf("%s\n", buf)
+	return err
+}
+
+// printTable prints "rows" as a table with "header".
+func printTable(header []string, rows [][]string) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+func envPath(proj, env string) string {
+	return fmt.Sprintf("/projects/%s/environments/%s", proj, env)
+}
+
+func statusCmd(fs *flag.FlagSet) func(client, []string) error {
+	return func(c client, args []string) error {
+		var envs []commits.Environment
+		if err := c.do("GET", fmt.Sprintf("/projects/%s/status", args[0]), nil, &envs); err != nil {
+			return err
+		}
+		if *jsonOut {
+			return printJSON(envs)
+		}
+		var rows [][]string
+		for _, env := range envs {
+			locked := ""
+			if env.Locked {
+				locked = "locked"
+			}
+			for _, d := range env.Deployments {
+				deployed := string(d.ShortRevision)
+				if d.Revision == "" {
+					deployed = "unknown"
+				} else if d.Revision != env.Revision {
+					deployed += " (behind)"
+				}
+				rows = append(rows, []string{env.Name, d.HostName, deployed, string(env.ShortRevision), locked, env.Comment})
+			}
+			if len(env.Deployments) == 0 {
+				rows = append(rows, []string{env.Name, "", "", string(env.ShortRevision), locked, env.Comment})
+			}
+		}
+		return printTable([]string{"ENV", "HOST", "DEPLOYED", "LATEST", "LOCKED", "COMMENT"}, rows)
+	}
+}
+
+// deployResponse is the response body of deployments.
+type deployResponse struct {
+	ID       string            `json:"id"`
+	State    history.State     `json:"state"`
+	Position int               `json:"position"`
+	Approval *history.Approval `json:"approval,omitempty"`
+}
+
+func deployCmd(fs *flag.FlagSet) func(client, []string) error {
+	rev := fs.String("rev", "", "revision to deploy (default: latest deployable revision)")
+	from := fs.String("from", "", "revision deployed from (default: revision of the latest successful deployment)")
+	force := fs.Bool("force", false, "force the deployment into a locked environment (admins only)")
+	dryRun := fs.Bool("dry-run", false, "print the plan of the deployment without starting it")
+	follow := fs.Bool("f", false, "follow the output of the deployment")
+	return func(c client, args []string) error {
+		proj, env := args[0], args[1]
+		body := map[string]interface{}{
+			"to_revision":   *rev,
+			"from_revision": *from,
+			"force":         *force,
+			"dry_run":       *dryRun,
+		}
+		if *rev == "" {
+			var st commits.Environment
+			if err := c.do("GET", envPath(proj, env)+"/status", nil, &st); err != nil {
+				return err
+			}
+			if st.Revision == "" {
+				return fmt.Errorf("cannot find the latest deployable revision of %s-%s; specify --rev", proj, env)
+			}
+			body["to_revision"] = st.Revision
+		}
+		if *dryRun {
+			var plan map[string]interface{}
+			if err := c.do("POST", envPath(proj, env)+"/deploys", body, &plan); err != nil {
+				return err
+			}
+			return printJSON(plan)
+		}
+
+		var resp deployResponse
+		if err := c.do("POST", envPath(proj, env)+"/deploys", body, &resp); err != nil {
+			return err
+		}
+		if *jsonOut {
+			if err := printJSON(resp); err != nil {
+				return err
+			}
+		} else {
+			switch {
+			case resp.State == history.StateAwaitingApproval:
+				fmt.Printf("%s is awaiting approval by another user until %s\n", resp.ID, resp.Approval.Expiry.Local().Format(time.RFC1123))
+			case resp.Position > 0:
+				fmt.Printf("%s is waiting at position %d in the queue\n", resp.ID, resp.Position)
+			default:
+				fmt.Printf("%s is %s\n", resp.ID, resp.State)
+			}
+		}
+		if !*follow {
+			return nil
+		}
+		return followLogs(c, resp.ID, os.Stdout)
+	}
+}
+
+func lockCmd(fs *flag.FlagSet) func(client, []string) error {
+	reason := fs.String("reason", "", "why the environment is locked")
+	expiresIn := fs.String("expires-in", "", "duration after which the lock is released, e.g. 2h")
+	return func(c client, args []string) error {
+		var l config.Lock
+		body := map[string]string{"reason": *reason, "expires_in": *expiresIn}
+		if err := c.do("PUT", envPath(args[0], args[1])+"/lock", body, &l); err != nil {
+			return err
+		}
+		if *jsonOut {
+			return printJSON(l)
+		}
+		fmt.Printf("%s-%s is %s\n", args[0], args[1], l)
+		return nil
+	}
+}
+
+func unlockCmd(fs *flag.FlagSet) func(client, []string) error {
+	return func(c client, args []string) error {
+		if err := c.do("DELETE", envPath(args[0], args[1])+"/lock", nil, nil); err != nil {
+			return err
+		}
+		if *jsonOut {
+			return printJSON(map[string]bool{"unlocked": true})
+		}
+		fmt.Printf("%s-%s is unlocked\n", args[0], args[1])
+		return nil
+	}
+}
+
+func commentCmd(fs *flag.FlagSet) func(client, []string) error {
+	return func(c client, args []string) error {
+		var resp map[string]string
+		if err := c.do("PUT", envPath(args[0], args[1])+"/comment", map[string]string{"comment": args[2]}, &resp); err != nil {
+			return err
+		}
+		if *jsonOut {
+			return printJSON(resp)
+		}
+		fmt.Printf("Updated the comment on %s-%s\n", args[0], args[1])
+		return nil
+	}
+}
+
+func historyCmd(fs *flag.FlagSet) func(client, []string) error {
+	limit := fs.Int("limit", 20, "maximum number of deployments")
+	user := fs.String("user", "", "show only deployments by the user")
+	return func(c client, args []string) error {
+		q := url.Values{"limit": {strconv.Itoa(*limit)}}
+		if *user != "" {
+			q.Set("user", *user)
+		}
+		var entries []history.Entry
+		if err := c.do("GET", envPath(args[0], args[1])+"/deploys?"+q.Encode(), nil, &entries); err != nil {
+			return err
+		}
+		if *jsonOut {
+			return printJSON(entries)
+		}
+		var rows [][]string
+		for _, e := range entries {
+			rows = append(rows, []string{
+				e.ID,
+				e.Time.Local().Format("2006-01-02 15:04"),
+				e.User,
+				fmt.Sprintf("%s..%s", e.Range.From.Short(), e.Range.To.Short()),
+				string(e.State),
+			})
+		}
+		return printTable([]string{"ID", "TIME", "USER", "REVISIONS", "STATE"}, rows)
+	}
+}
+
+// deployOutput is a part of the output of a deployment.
+type deployOutput struct {
+	ID       string        `json:"id"`
+	State    history.State `json:"state"`
+	Output   string        `json:"output"`
+	Offset   int           `json:"offset"`
+	Finished bool          `json:"finished"`
+}
+
+func logsCmd(fs *flag.FlagSet) func(client, []string) error {
+	follow := fs.Bool("f", false, "follow the output until the deployment finishes")
+	return func(c client, args []string) error {
+		if *follow {
+			return followLogs(c, args[0], os.Stdout)
+		}
+		var out deployOutput
+		if err := c.do("GET", fmt.Sprintf("/deploys/%s/output", args[0]), nil, &out); err != nil {
+			return err
+		}
+		if *jsonOut {
+			return printJSON(out)
+		}
+		_, err := io.WriteString(os.Stdout, out.Output)
+		return err
+	}
+}
+
+// followLogs prints the output of the deployment "id" to "w" until it finishes.
+// The output is received from the websocket hub, which replays the output so far of running deployments.
+// The output of a finished deployment is fetched from the API instead.
+// It returns an error unless the deployment succeeds.
+func followLogs(c client, id string, w io.Writer) error {
+	msgs, conn, err := c.subscribe(id)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var e history.Entry
+	if err := c.do("GET", fmt.Sprintf("/deploys/%s", id), nil, &e); err != nil {
+		return err
+	}
+	if e.State.Finished() {
+		var out deployOutput
+		if err := c.do("GET", fmt.Sprintf("/deploys/%s/output", id), nil, &out); err != nil {
+			return err
+		}
+		if *jsonOut {
+			for _, line := range strings.SplitAfter(out.Output, "\n") {
+				if line != "" {
+					printJSON(map[string]string{"DeployID": id, "StdoutLine": strings.TrimSuffix(line, "\n")})
+				}
+			}
+		} else {
+			io.WriteString(w, out.Output)
+		}
+		return finalState(id, out.State)
+	}
+
+	for msg := range msgs {
+		if msg.DeployID != id {
+			continue
+		}
+		if *jsonOut {
+			printJSON(msg)
+		} else if msg.Event == "" {
+			fmt.Fprintln(w, msg.StdoutLine)
+		}
+		if !history.State(msg.Event).Finished() {
+			continue
+		}
+		// A cancelled deployment keeps running until its command exits.
+		if err := c.do("GET", fmt.Sprintf("/deploys/%s", id), nil, &e); err != nil {
+			return err
+		}
+		if e.State.Finished() {
+			return finalState(id, e.State)
+		}
+	}
+	return fmt.Errorf("connection to %s was closed before %s finished", c.server, id)
+}
+
+// finalState returns an error unless "s" is StateSucceeded.
+func finalState(id string, s history.State) error {
+	if s != history.StateSucceeded {
+		return fmt.Errorf("deployment %s %s", id, s)
+	}
+	return nil
+}